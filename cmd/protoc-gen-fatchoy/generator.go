@@ -0,0 +1,348 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	contextPackage = protogen.GoImportPath("context")
+	fatchoyPackage = protogen.GoImportPath("qchen.fun/fatchoy")
+	qnetPackage    = protogen.GoImportPath("qchen.fun/fatchoy/qnet")
+
+	messageOptionsName = "google.protobuf.MessageOptions"
+)
+
+func generate(gen *protogen.Plugin, msgIdOpt string) error {
+	var hasService bool
+	for _, f := range gen.Files {
+		if f.Generate && len(f.Services) > 0 {
+			hasService = true
+		}
+	}
+	if !hasService {
+		return nil
+	}
+	xt, err := findMsgIdOption(gen, msgIdOpt)
+	if err != nil {
+		return err
+	}
+	for _, f := range gen.Files {
+		if !f.Generate || len(f.Services) == 0 {
+			continue
+		}
+		for _, service := range f.Services {
+			if err := checkService(service, xt); err != nil {
+				return err
+			}
+		}
+		generateFile(gen, f)
+	}
+	return nil
+}
+
+// 查找消息ID选项
+func findMsgIdOption(gen *protogen.Plugin, msgIdOpt string) (protoreflect.ExtensionDescriptor, error) {
+	var found []protoreflect.ExtensionDescriptor
+	for _, f := range gen.Files {
+		var extensions = f.Desc.Extensions()
+		for i := 0; i < extensions.Len(); i++ {
+			var xt = extensions.Get(i)
+			if xt.ContainingMessage().FullName() != messageOptionsName {
+				continue
+			}
+			if msgIdOpt != "" {
+				if string(xt.FullName()) == msgIdOpt {
+					return xt, nil
+				}
+			} else if xt.Name() == "msg_id" {
+				found = append(found, xt)
+			}
+		}
+	}
+	if msgIdOpt != "" {
+		return nil, fmt.Errorf("message option %s not found", msgIdOpt)
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("message option msg_id not found, use --fatchoy_opt=msgid=<name>")
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("ambiguous message option msg_id, use --fatchoy_opt=msgid=<name>")
+	}
+}
+
+// 消息选项里的ID，protoc传过来的自定义选项是未知字段
+func messageID(msg *protogen.Message, xt protoreflect.ExtensionDescriptor) int32 {
+	var opts = msg.Desc.Options()
+	if opts == nil {
+		return 0
+	}
+	var m = opts.ProtoReflect()
+	var id int32
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.IsExtension() && fd.FullName() == xt.FullName() {
+			id = int32(v.Int())
+			return false
+		}
+		return true
+	})
+	if id != 0 {
+		return id
+	}
+	var b = m.GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0
+		}
+		b = b[n:]
+		if num == xt.Number() && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0
+			}
+			id = int32(v)
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return 0
+		}
+		b = b[n:]
+	}
+	return id
+}
+
+// RpcServer按请求消息ID分发，请求和响应都需要有消息ID并且符合Req/Ack命名
+func checkService(service *protogen.Service, xt protoreflect.ExtensionDescriptor) error {
+	var unary = make(map[string]string)
+	var streams = make(map[string]string)
+	for _, method := range service.Methods {
+		var fullname = fmt.Sprintf("%s.%s", service.Desc.FullName(), method.Desc.Name())
+		var reqName = string(method.Input.Desc.Name())
+		var ackName = string(method.Output.Desc.Name())
+		if messageID(method.Input, xt) == 0 {
+			return fmt.Errorf("%s: request %s has no %s", fullname, method.Input.Desc.FullName(), xt.FullName())
+		}
+		if messageID(method.Output, xt) == 0 {
+			return fmt.Errorf("%s: response %s has no %s", fullname, method.Output.Desc.FullName(), xt.FullName())
+		}
+		if !strings.HasSuffix(reqName, "Req") {
+			return fmt.Errorf("%s: request %s should be named as FooReq", fullname, reqName)
+		}
+		var registry = unary
+		if isStream(method) {
+			registry = streams
+			if !hasValidSuffix(ackName) {
+				return fmt.Errorf("%s: response %s should end with Req, Ack or Ntf", fullname, ackName)
+			}
+		} else if ackName != strings.TrimSuffix(reqName, "Req")+"Ack" ||
+			method.Input.GoIdent.GoImportPath != method.Output.GoIdent.GoImportPath {
+			return fmt.Errorf("%s: response of %s should be %sAck", fullname, reqName, strings.TrimSuffix(reqName, "Req"))
+		}
+		if prev, found := registry[reqName]; found {
+			return fmt.Errorf("%s: request %s already used by %s", fullname, reqName, prev)
+		}
+		registry[reqName] = fullname
+	}
+	return nil
+}
+
+func hasValidSuffix(name string) bool {
+	return strings.HasSuffix(name, "Req") || strings.HasSuffix(name, "Ack") || strings.HasSuffix(name, "Ntf")
+}
+
+// 客户端流按双向流处理，第一个请求作为open帧发送
+func isStream(method *protogen.Method) bool {
+	return method.Desc.IsStreamingClient() || method.Desc.IsStreamingServer()
+}
+
+func generateFile(gen *protogen.Plugin, file *protogen.File) *protogen.GeneratedFile {
+	var filename = file.GeneratedFilenamePrefix + "_fatchoy.pb.go"
+	var g = gen.NewGeneratedFile(filename, file.GoImportPath)
+	g.P("// Code generated by protoc-gen-fatchoy. DO NOT EDIT.")
+	g.P("// source: ", file.Desc.Path())
+	g.P()
+	g.P("package ", file.GoPackageName)
+	g.P()
+	for _, service := range file.Services {
+		genClient(g, service)
+		genServer(g, service)
+	}
+	return g
+}
+
+func clientSignature(g *protogen.GeneratedFile, service *protogen.Service, method *protogen.Method) string {
+	var s = method.GoName + "(ctx " + g.QualifiedGoIdent(contextPackage.Ident("Context")) +
+		", node " + g.QualifiedGoIdent(fatchoyPackage.Ident("NodeID")) +
+		", req *" + g.QualifiedGoIdent(method.Input.GoIdent) +
+		", opts ..." + g.QualifiedGoIdent(qnetPackage.Ident("CallOption")) + ") "
+	if isStream(method) {
+		return s + "(*" + streamName(service, method, "Client") + ", error)"
+	}
+	return s + "(*" + g.QualifiedGoIdent(method.Output.GoIdent) + ", error)"
+}
+
+func serverSignature(g *protogen.GeneratedFile, service *protogen.Service, method *protogen.Method) string {
+	var s = method.GoName + "(ctx " + g.QualifiedGoIdent(contextPackage.Ident("Context")) +
+		", req *" + g.QualifiedGoIdent(method.Input.GoIdent)
+	if isStream(method) {
+		return s + ", stream *" + streamName(service, method, "Server") + ") error"
+	}
+	return s + ") (*" + g.QualifiedGoIdent(method.Output.GoIdent) + ", error)"
+}
+
+func streamName(service *protogen.Service, method *protogen.Method, side string) string {
+	return service.GoName + "_" + method.GoName + side
+}
+
+func unexport(s string) string {
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func genComments(g *protogen.GeneratedFile, comments protogen.Comments, fallback string) {
+	if comments != "" {
+		g.P(strings.TrimSuffix(comments.String(), "\n"))
+	} else {
+		g.P("// ", fallback)
+	}
+}
+
+func genClient(g *protogen.GeneratedFile, service *protogen.Service) {
+	var clientName = service.GoName + "Client"
+	var implName = unexport(clientName)
+	var rpcClient = g.QualifiedGoIdent(qnetPackage.Ident("RpcClient"))
+	var rpcStream = g.QualifiedGoIdent(qnetPackage.Ident("RpcStream"))
+
+	genComments(g, service.Comments.Leading, service.GoName+"服务的客户端")
+	g.P("type ", clientName, " interface {")
+	for _, method := range service.Methods {
+		g.P(method.Comments.Leading, clientSignature(g, service, method))
+	}
+	g.P("}")
+	g.P()
+	g.P("type ", implName, " struct {")
+	g.P("client *", rpcClient)
+	g.P("}")
+	g.P()
+	g.P("func New", clientName, "(client *", rpcClient, ") ", clientName, " {")
+	g.P("return &", implName, "{client: client}")
+	g.P("}")
+	g.P()
+
+	for _, method := range service.Methods {
+		g.P("func (c *", implName, ") ", clientSignature(g, service, method), " {")
+		if !isStream(method) {
+			g.P("var ack = new(", method.Output.GoIdent, ")")
+			g.P("if err := c.client.Invoke(ctx, node, req, ack, opts...); err != nil {")
+			g.P("return nil, err")
+			g.P("}")
+			g.P("return ack, nil")
+			g.P("}")
+			g.P()
+			continue
+		}
+		var open = "OpenStream"
+		if !method.Desc.IsStreamingClient() {
+			open = "OpenServerStream"
+		}
+		var name = streamName(service, method, "Client")
+		g.P("stream, err := c.client.", open, "(ctx, node, req, opts...)")
+		g.P("if err != nil {")
+		g.P("return nil, err")
+		g.P("}")
+		g.P("return &", name, "{stream}, nil")
+		g.P("}")
+		g.P()
+
+		g.P("// ", service.GoName, ".", method.GoName, "的客户端流")
+		g.P("type ", name, " struct {")
+		g.P("*", rpcStream)
+		g.P("}")
+		g.P()
+		if method.Desc.IsStreamingClient() {
+			genSend(g, name, method.Input)
+		}
+		genRecv(g, name, method.Output)
+	}
+}
+
+func genServer(g *protogen.GeneratedFile, service *protogen.Service) {
+	var serverName = service.GoName + "Server"
+	var rpcServer = g.QualifiedGoIdent(qnetPackage.Ident("RpcServer"))
+	var rpcStream = g.QualifiedGoIdent(qnetPackage.Ident("RpcStream"))
+
+	g.P("// ", service.GoName, "服务的服务端接口")
+	g.P("type ", serverName, " interface {")
+	for _, method := range service.Methods {
+		g.P(method.Comments.Leading, serverSignature(g, service, method))
+	}
+	g.P("}")
+	g.P()
+
+	g.P("// 把srv的方法注册到RpcServer")
+	g.P("func Register", serverName, "(s *", rpcServer, ", srv ", serverName, ") error {")
+	for _, method := range service.Methods {
+		if !isStream(method) {
+			g.P("if err := s.Register(srv.", method.GoName, "); err != nil {")
+		} else {
+			g.P("if err := s.RegisterStream(func(ctx ", contextPackage.Ident("Context"), ", req *", method.Input.GoIdent,
+				", stream *", rpcStream, ") error {")
+			g.P("return srv.", method.GoName, "(ctx, req, &", streamName(service, method, "Server"), "{stream})")
+			g.P("}); err != nil {")
+		}
+		g.P("return err")
+		g.P("}")
+	}
+	g.P("return nil")
+	g.P("}")
+	g.P()
+
+	for _, method := range service.Methods {
+		if !isStream(method) {
+			continue
+		}
+		var name = streamName(service, method, "Server")
+		g.P("// ", service.GoName, ".", method.GoName, "的服务端流")
+		g.P("type ", name, " struct {")
+		g.P("*", rpcStream)
+		g.P("}")
+		g.P()
+		genSend(g, name, method.Output)
+		if method.Desc.IsStreamingClient() {
+			genRecv(g, name, method.Input)
+		}
+	}
+}
+
+func genSend(g *protogen.GeneratedFile, name string, msg *protogen.Message) {
+	g.P("func (x *", name, ") Send(m *", msg.GoIdent, ") error {")
+	g.P("return x.RpcStream.Send(m)")
+	g.P("}")
+	g.P()
+}
+
+func genRecv(g *protogen.GeneratedFile, name string, msg *protogen.Message) {
+	g.P("func (x *", name, ") Recv() (*", msg.GoIdent, ", error) {")
+	g.P("msg, err := x.RpcStream.Recv()")
+	g.P("if err != nil {")
+	g.P("return nil, err")
+	g.P("}")
+	g.P("if m, ok := msg.(*", msg.GoIdent, "); ok {")
+	g.P("return m, nil")
+	g.P("}")
+	g.P("return nil, ", qnetPackage.Ident("ErrStreamUnexpectedMsg"))
+	g.P("}")
+	g.P()
+}
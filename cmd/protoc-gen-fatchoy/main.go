@@ -0,0 +1,26 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+// protoc-gen-fatchoy根据proto文件里的service定义，生成基于qnet.RpcClient的客户端和服务端接口
+//
+//	protoc --go_out=. --fatchoy_out=. --fatchoy_opt=msgid=pkg.msg_id foo.proto
+//
+// msgid是packet.RegisterMsgID使用的消息ID选项，不指定时查找名为msg_id的MessageOptions扩展
+package main
+
+import (
+	"flag"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+func main() {
+	var flags flag.FlagSet
+	var msgIdOpt = flags.String("msgid", "", "full name of message id option")
+	protogen.Options{
+		ParamFunc: flags.Set,
+	}.Run(func(gen *protogen.Plugin) error {
+		return generate(gen, *msgIdOpt)
+	})
+}
@@ -0,0 +1,124 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/compiler/protogen"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/pluginpb"
+
+	"qchen.fun/fatchoy/internal/echopb"
+	"qchen.fun/fatchoy/internal/testpb"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+const goldenFile = "../../internal/echopb/echo_fatchoy.pb.go"
+
+// 模拟protoc的请求，自定义选项以未知字段传给插件
+func makeRequest(t *testing.T, param string, files ...*descriptorpb.FileDescriptorProto) *pluginpb.CodeGeneratorRequest {
+	var req = &pluginpb.CodeGeneratorRequest{
+		FileToGenerate: []string{files[len(files)-1].GetName()},
+		Parameter:      proto.String(param),
+		ProtoFile: append([]*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto),
+		}, files...),
+	}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	req = new(pluginpb.CodeGeneratorRequest)
+	if err := (proto.UnmarshalOptions{Resolver: new(protoregistry.Types)}).Unmarshal(data, req); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return req
+}
+
+func runPlugin(t *testing.T, req *pluginpb.CodeGeneratorRequest) *pluginpb.CodeGeneratorResponse {
+	var flags flag.FlagSet
+	var msgIdOpt = flags.String("msgid", "", "")
+	gen, err := protogen.Options{ParamFunc: flags.Set}.New(req)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := generate(gen, *msgIdOpt); err != nil {
+		gen.Error(err)
+	}
+	return gen.Response()
+}
+
+func TestGenerateGolden(t *testing.T) {
+	for _, param := range []string{"paths=source_relative,msgid=testpb.msg_id", "paths=source_relative"} {
+		var req = makeRequest(t, param,
+			protodesc.ToFileDescriptorProto(testpb.File_internal_testpb_test_proto),
+			protodesc.ToFileDescriptorProto(echopb.File_internal_echopb_echo_proto))
+		var resp = runPlugin(t, req)
+		if resp.Error != nil {
+			t.Fatalf("%s: %s", param, resp.GetError())
+		}
+		if len(resp.File) != 1 || resp.File[0].GetName() != "internal/echopb/echo_fatchoy.pb.go" {
+			t.Fatalf("%s: unexpected files %v", param, resp.File)
+		}
+		var got = []byte(resp.File[0].GetContent())
+		if *update {
+			if err := ioutil.WriteFile(goldenFile, got, 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(goldenFile)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: generated code not match %s, run go test -update\n%s", param, goldenFile, got)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	var testFile = protodesc.ToFileDescriptorProto(testpb.File_internal_testpb_test_proto)
+	var echoFile = protodesc.ToFileDescriptorProto(echopb.File_internal_echopb_echo_proto)
+
+	tests := []struct {
+		param  string
+		mutate func(fd *descriptorpb.FileDescriptorProto)
+		errMsg string
+	}{
+		{"msgid=testpb.no_such_id", nil, "not found"},
+		{"", func(fd *descriptorpb.FileDescriptorProto) {
+			fd.MessageType[0].Options = nil
+		}, "has no testpb.msg_id"},
+		{"", func(fd *descriptorpb.FileDescriptorProto) {
+			fd.Service[0].Method[0].OutputType = proto.String(".echopb.ChatAck")
+		}, "should be PingAck"},
+		{"", func(fd *descriptorpb.FileDescriptorProto) {
+			fd.Service[0].Method[0].InputType = proto.String(".echopb.WatchNtf")
+		}, "should be named as FooReq"},
+		{"", func(fd *descriptorpb.FileDescriptorProto) {
+			fd.Service[0].Method[2].InputType = proto.String(".echopb.WatchReq")
+		}, "already used by echopb.Echo.Watch"},
+	}
+	for i, tc := range tests {
+		var fd = proto.Clone(echoFile).(*descriptorpb.FileDescriptorProto)
+		if tc.mutate != nil {
+			tc.mutate(fd)
+		}
+		var resp = runPlugin(t, makeRequest(t, tc.param, testFile, fd))
+		if resp.Error == nil || !strings.Contains(resp.GetError(), tc.errMsg) {
+			t.Fatalf("case %d: unexpected error %q", i, resp.GetError())
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"math"
 
 	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/x/bufpool"
 	"qchen.fun/fatchoy/x/cipher"
 )
 
@@ -22,7 +23,8 @@ type Encoder interface {
 	// 把`pkt`编码到`w`，内部除了flag不应该修改pkt的其它字段
 	WritePacket(w io.Writer, encrypt cipher.BlockCryptor, pkt fatchoy.IPacket) (int, error)
 
-	// 按协议格式读取head和body
+	// 按协议格式读取head和body，内置的编码从bufpool分配head和body所在的同一块缓冲区，
+	// head在前，用完后可以用bufpool.Put(head)归还，见packet.SetBuffer
 	ReadHeadBody(r io.Reader) ([]byte, []byte, error)
 
 	// 根据head和body解码消息到`pkt`
@@ -32,6 +34,22 @@ type Encoder interface {
 	ReadPacket(r io.Reader, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error
 }
 
+// 从bufpool分配读取包头的缓冲区，一般的小包不需要再扩容
+func getReadBuffer(n int) []byte {
+	return bufpool.Get(n)
+}
+
+// 扩容到`size`，已读取的头部会复制到新的缓冲区
+func growReadBuffer(buf []byte, size int) []byte {
+	if size <= cap(buf) {
+		return buf[:size]
+	}
+	var nb = bufpool.Get(size)
+	copy(nb, buf)
+	bufpool.Put(buf)
+	return nb
+}
+
 // 读取2字节开头的数据
 func ReadLenData(r io.Reader) ([]byte, error) {
 	var tmp [2]byte
@@ -39,6 +57,9 @@ func ReadLenData(r io.Reader) ([]byte, error) {
 		return nil, err
 	}
 	var length = binary.BigEndian.Uint16(tmp[:])
+	if length < 2 {
+		return nil, fmt.Errorf("invalid data length %d", length)
+	}
 	var buf = make([]byte, length-2)
 	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
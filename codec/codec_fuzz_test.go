@@ -0,0 +1,79 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+//go:build go1.18
+// +build go1.18
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/x/cipher"
+)
+
+func fuzzSeedPackets(f *testing.F, enc Encoder) {
+	var packets = []*testPacket{
+		{command: 1, seq: 2, body: []byte("hello")},
+		{command: 3, flag: fatchoy.PFlagError, body: []byte{0x02}},
+		{command: 4, body: bytes.Repeat([]byte("abc"), 100)},
+	}
+	if enc.Version() >= VersionV2 {
+		packets = append(packets, &testPacket{command: 5, node: 6, refer: []fatchoy.NodeID{7, 8},
+			ext: &fatchoy.PacketExt{CorrelationID: 9, Metadata: map[string]string{"k": "v"}}})
+	}
+	for _, pkt := range packets {
+		var w bytes.Buffer
+		if _, err := enc.WritePacket(&w, nil, pkt); err != nil {
+			f.Fatalf("WritePacket: %v", err)
+		}
+		f.Add(w.Bytes())
+	}
+}
+
+// 任意输入都只返回错误，不应该panic
+func fuzzDecode(f *testing.F, enc Encoder) {
+	fuzzSeedPackets(f, enc)
+	var decrypt = cipher.NewCrypt("aes-128", []byte("0123456789abcdef"), []byte("0123456789abcdef"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		enc.ReadPacket(bytes.NewReader(data), decrypt, &testPacket{})
+
+		// 不经过ReadHeadBody，直接解码任意的head和body
+		for _, n := range []int{V1HeaderSize, V2HeaderSize} {
+			if len(data) >= n {
+				enc.UnmarshalPacket(data[:n], data[n:], nil, &testPacket{})
+			}
+		}
+		enc.UnmarshalPacket(data, nil, nil, &testPacket{})
+	})
+}
+
+func FuzzCodecV1Decode(f *testing.F) {
+	fuzzDecode(f, NewV1Encoder(0))
+}
+
+func FuzzCodecV2Decode(f *testing.F) {
+	fuzzDecode(f, NewV2Encoder(0))
+}
+
+func FuzzReadLenData(f *testing.F) {
+	f.Add([]byte{0, 0})
+	f.Add([]byte{0, 1})
+	f.Add([]byte{0, 7, 'h', 'e', 'l', 'l', 'o'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		buf, err := ReadLenData(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		var w bytes.Buffer
+		if _, err := WriteLenData(&w, buf); err != nil {
+			t.Fatalf("WriteLenData: %v", err)
+		}
+		if !bytes.Equal(w.Bytes(), data[:w.Len()]) {
+			t.Fatalf("round trip mismatch")
+		}
+	})
+}
@@ -0,0 +1,343 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+
+	"qchen.fun/fatchoy"
+)
+
+// 压缩算法，编码在packet flag的PFlagCompressMask位里，0为zlib，兼容之前的版本
+const (
+	CompressZlib = 0
+	CompressGzip = 1
+	CompressLZ4  = 2 // LZ4块压缩，速度最快
+	CompressZstd = 3
+)
+
+var (
+	MaxUncompressBytes = 64 * 1024 * 1024 // 解压后的最大长度，64M
+
+	ErrUncompressOverflow = errors.New("uncompressed size overflow")
+	ErrUnknownDictionary  = errors.New("unknown compression dictionary")
+
+	compressors [fatchoy.PFlagCompressMask>>compressShift + 1]Compressor
+)
+
+const compressShift = 2
+
+// 压缩算法接口，需要支持并发调用
+type Compressor interface {
+	ID() uint8
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Uncompress(data []byte) ([]byte, error)
+}
+
+func init() {
+	RegisterCompressor(NewZlibCompressor(flate.DefaultCompression))
+	RegisterCompressor(NewGzipCompressor(gzip.DefaultCompression))
+	RegisterCompressor(NewLZ4Compressor())
+	zc, _ := NewZstdCompressor(zstd.SpeedDefault)
+	RegisterCompressor(zc)
+}
+
+// 注册压缩算法，会替换相同ID的算法，比如替换为带字典的zlib
+func RegisterCompressor(c Compressor) {
+	if int(c.ID()) >= len(compressors) {
+		panic(fmt.Sprintf("compressor %s id %d out of range", c.Name(), c.ID()))
+	}
+	compressors[c.ID()] = c
+}
+
+func GetCompressor(id uint8) Compressor {
+	if int(id) < len(compressors) {
+		return compressors[id]
+	}
+	return nil
+}
+
+func GetCompressorByName(name string) Compressor {
+	for _, c := range compressors {
+		if c != nil && c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// 按算法压缩，返回压缩后的数据和设置了压缩标记的flag
+func compressBody(body []byte, id uint8, flag fatchoy.PacketFlag) ([]byte, fatchoy.PacketFlag, error) {
+	var c = GetCompressor(id)
+	if c == nil {
+		return nil, flag, fmt.Errorf("unknown compression %d", id)
+	}
+	data, err := c.Compress(body)
+	if err != nil {
+		return nil, flag, err
+	}
+	flag = flag&^fatchoy.PFlagCompressMask | fatchoy.PacketFlag(id<<compressShift) | fatchoy.PFlagCompressed
+	return data, flag, nil
+}
+
+// 按flag记录的算法解压
+func uncompressBody(body []byte, flag fatchoy.PacketFlag) ([]byte, error) {
+	var id = uint8(flag&fatchoy.PFlagCompressMask) >> compressShift
+	var c = GetCompressor(id)
+	if c == nil {
+		return nil, fmt.Errorf("unknown compression %d", id)
+	}
+	return c.Uncompress(body)
+}
+
+// 读取全部解压后的内容，超过MaxUncompressBytes返回错误
+func readAllLimited(r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, int64(MaxUncompressBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(MaxUncompressBytes) {
+		return nil, ErrUncompressOverflow
+	}
+	return buf.Bytes(), nil
+}
+
+// zlib压缩，可以使用预设的字典提高小消息的压缩率，
+// zlib头部记录了字典的adler32校验和，解压时据此选择字典
+type zlibCompressor struct {
+	level int
+	dict  []byte            // 压缩使用的字典
+	dicts map[uint32][]byte // 解压可用的字典
+}
+
+// 字典一般是常见消息的样本拼接，第一个字典用于压缩，所有字典都可以用于解压
+func NewZlibCompressor(level int, dicts ...[]byte) Compressor {
+	var c = &zlibCompressor{
+		level: level,
+		dicts: make(map[uint32][]byte, len(dicts)),
+	}
+	for i, dict := range dicts {
+		if i == 0 {
+			c.dict = dict
+		}
+		c.dicts[adler32.Checksum(dict)] = dict
+	}
+	return c
+}
+
+func (c *zlibCompressor) ID() uint8 {
+	return CompressZlib
+}
+
+func (c *zlibCompressor) Name() string {
+	return "zlib"
+}
+
+func (c *zlibCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevelDict(&buf, c.level, c.dict)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *zlibCompressor) Uncompress(data []byte) ([]byte, error) {
+	var dict []byte
+	// FDICT标记
+	if len(data) >= 6 && data[1]&0x20 != 0 {
+		var found bool
+		if dict, found = c.dicts[binary.BigEndian.Uint32(data[2:])]; !found {
+			return nil, ErrUnknownDictionary
+		}
+	}
+	r, err := zlib.NewReaderDict(bytes.NewReader(data), dict)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimited(r)
+}
+
+// gzip压缩
+type gzipCompressor struct {
+	level int
+}
+
+func NewGzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+func (c *gzipCompressor) ID() uint8 {
+	return CompressGzip
+}
+
+func (c *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Uncompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimited(r)
+}
+
+// LZ4块压缩，压缩率略低但是速度很快，适合热点路径，格式为 `原始长度(uvarint) + LZ4 block`
+type lz4Compressor struct {
+	pool sync.Pool // *lz4.Compressor不能并发使用
+}
+
+func NewLZ4Compressor() Compressor {
+	return &lz4Compressor{
+		pool: sync.Pool{New: func() interface{} { return new(lz4.Compressor) }},
+	}
+}
+
+func (c *lz4Compressor) ID() uint8 {
+	return CompressLZ4
+}
+
+func (c *lz4Compressor) Name() string {
+	return "lz4"
+}
+
+func (c *lz4Compressor) Compress(data []byte) ([]byte, error) {
+	var buf = make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(data)))
+	var n = binary.PutUvarint(buf, uint64(len(data)))
+	if len(data) == 0 {
+		return buf[:n], nil
+	}
+	var zc = c.pool.Get().(*lz4.Compressor)
+	size, err := zc.CompressBlock(data, buf[n:])
+	c.pool.Put(zc)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n+size], nil
+}
+
+func (c *lz4Compressor) Uncompress(data []byte) ([]byte, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errors.New("lz4: invalid block header")
+	}
+	if size > uint64(MaxUncompressBytes) {
+		return nil, ErrUncompressOverflow
+	}
+	var out = make([]byte, size)
+	if size == 0 {
+		return out, nil
+	}
+	m, err := lz4.UncompressBlock(data[n:], out)
+	if err != nil {
+		return nil, err
+	}
+	if m != len(out) {
+		return nil, fmt.Errorf("lz4: uncompressed size %d != %d", m, len(out))
+	}
+	return out, nil
+}
+
+// zstd压缩，字典需要用`zstd --train`训练生成，帧头里有字典ID
+type zstdCompressor struct {
+	once    sync.Once
+	opts    []zstd.EOption
+	dicts   [][]byte
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+// 第一个字典用于压缩，所有字典都可以用于解压
+func NewZstdCompressor(level zstd.EncoderLevel, dicts ...[]byte) (Compressor, error) {
+	var c = &zstdCompressor{
+		opts:  []zstd.EOption{zstd.WithEncoderLevel(level)},
+		dicts: dicts,
+	}
+	if len(dicts) > 0 {
+		c.opts = append(c.opts, zstd.WithEncoderDict(dicts[0]))
+		// 有字典时立即检查字典格式
+		if err := c.init(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// encoder和decoder会分配较多内存，第一次使用时才创建
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil, c.opts...)
+		if c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil,
+			zstd.WithDecoderMaxMemory(uint64(MaxUncompressBytes)),
+			zstd.WithDecoderDicts(c.dicts...))
+	})
+	return c.err
+}
+
+func (c *zstdCompressor) ID() uint8 {
+	return CompressZstd
+}
+
+func (c *zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCompressor) Uncompress(data []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(data, nil)
+}
@@ -0,0 +1,114 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"testing"
+
+	"qchen.fun/fatchoy"
+)
+
+func TestCodecCompression(t *testing.T) {
+	var body = bytes.Repeat([]byte("fatchoy compression "), 100)
+	for _, id := range []uint8{CompressZlib, CompressGzip, CompressLZ4, CompressZstd} {
+		var c = GetCompressor(id)
+		if c == nil || GetCompressorByName(c.Name()) != c {
+			t.Fatalf("compressor %d not registered", id)
+		}
+		for _, enc := range []Encoder{NewV1Encoder(100, WithCompression(id)), NewV2Encoder(100, WithCompression(id)), NewV3Encoder(100, WithCompression(id))} {
+			var pkt = &testPacket{command: 1, flag: fatchoy.PFlagRpc, body: body}
+			var w bytes.Buffer
+			n, err := enc.WritePacket(&w, nil, pkt)
+			if err != nil {
+				t.Fatalf("%s %s Encode: %v", enc.Name(), c.Name(), err)
+			}
+			if n >= len(body) || pkt.flag&fatchoy.PFlagCompressed == 0 || uint8(pkt.flag&fatchoy.PFlagCompressMask)>>compressShift != id {
+				t.Fatalf("%s %s: size %d, flag %x", enc.Name(), c.Name(), n, pkt.flag)
+			}
+			var recv testPacket
+			if err := enc.ReadPacket(&w, nil, &recv); err != nil {
+				t.Fatalf("%s %s Decode: %v", enc.Name(), c.Name(), err)
+			}
+			if recv.flag != fatchoy.PFlagRpc || !bytes.Equal(recv.body, setBody(body)) {
+				t.Fatalf("%s %s: packet not equal, flag %x", enc.Name(), c.Name(), recv.flag)
+			}
+		}
+	}
+	if _, err := uncompressBody([]byte("hello"), fatchoy.PFlagCompressed|fatchoy.PFlagCompressMask); err == nil {
+		t.Fatalf("uncompress invalid data should fail")
+	}
+}
+
+func TestCompressDictionary(t *testing.T) {
+	var dict = []byte(`{"uid":10001,"name":"player","level":1,"gold":100,"items":[]}`)
+	var data = []byte(`{"uid":10086,"name":"player2","level":9,"gold":20,"items":[]}`)
+	var plain = NewZlibCompressor(flate.BestCompression)
+	var dc = NewZlibCompressor(flate.BestCompression, dict)
+	a, err := plain.Compress(data)
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	b, err := dc.Compress(data)
+	if err != nil {
+		t.Fatalf("Compress: %v", err)
+	}
+	if len(b) >= len(a) {
+		t.Fatalf("dictionary not work, %d >= %d", len(b), len(a))
+	}
+	if out, err := dc.Uncompress(b); err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("Uncompress: %v", err)
+	}
+	// 旧的字典仍然可以解压
+	var dc2 = NewZlibCompressor(flate.BestCompression, []byte("new dictionary"), dict)
+	if out, err := dc2.Uncompress(b); err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("Uncompress: %v", err)
+	}
+	if _, err := plain.Uncompress(b); !errors.Is(err, ErrUnknownDictionary) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := NewZstdCompressor(0, []byte("not a zstd dictionary")); err == nil {
+		t.Fatalf("invalid zstd dictionary should fail")
+	}
+}
+
+func TestUncompressOverflow(t *testing.T) {
+	var old = MaxUncompressBytes
+	defer func() { MaxUncompressBytes = old }()
+	var data = make([]byte, 1024)
+	for _, id := range []uint8{CompressZlib, CompressGzip, CompressLZ4} {
+		var c = GetCompressor(id)
+		compressed, err := c.Compress(data)
+		if err != nil {
+			t.Fatalf("%s Compress: %v", c.Name(), err)
+		}
+		MaxUncompressBytes = 100
+		if _, err := c.Uncompress(compressed); !errors.Is(err, ErrUncompressOverflow) {
+			t.Fatalf("%s: unexpected error %v", c.Name(), err)
+		}
+		MaxUncompressBytes = old
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	var body = bytes.Repeat([]byte("fatchoy compression benchmark "), 300)
+	for _, id := range []uint8{CompressZlib, CompressGzip, CompressLZ4, CompressZstd} {
+		var c = GetCompressor(id)
+		b.Run(c.Name(), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				data, err := c.Compress(body)
+				if err != nil {
+					b.Fatalf("Compress: %v", err)
+				}
+				if _, err := c.Uncompress(data); err != nil {
+					b.Fatalf("Uncompress: %v", err)
+				}
+			}
+		})
+	}
+}
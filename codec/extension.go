@@ -0,0 +1,247 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"qchen.fun/fatchoy"
+)
+
+// 扩展字段编码为 `len(2字节) + TLV...`，len不包含自身，
+// 每个TLV为 `tag(1字节) + len(1字节) + value`，未知的tag直接跳过。
+//
+// 扩展字段和head一样以明文传输，不会被加密，只有body会加密，
+// 不要把认证token等敏感数据放在Metadata里，应该放在body中。
+const (
+	ExtTagCorrelationID = 1 // RPC关联ID，4字节
+	ExtTagMetadata      = 2 // 一条元数据，`key长度(1字节) + key + value`
+	ExtTagStreamID      = 3 // 流ID，4字节
+	ExtTagStreamFlag    = 4 // 流帧标记，1字节
+	ExtTagTraceID       = 5 // 追踪ID
+	ExtTagDeadline      = 6 // 截止时间，unix毫秒，8字节
+)
+
+var (
+	ErrBadExtension      = errors.New("malformed packet extension")
+	ErrExtensionOverflow = errors.New("packet extension size overflow")
+)
+
+func marshalExtension(ext *fatchoy.PacketExt) ([]byte, error) {
+	if ext.IsEmpty() {
+		return nil, nil
+	}
+	var buf = make([]byte, 2, 8)
+	if ext.CorrelationID != 0 {
+		buf = append(buf, ExtTagCorrelationID, 4, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], ext.CorrelationID)
+	}
+	if ext.StreamID != 0 {
+		buf = append(buf, ExtTagStreamID, 4, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], ext.StreamID)
+		if ext.StreamFlag != 0 {
+			buf = append(buf, ExtTagStreamFlag, 1, ext.StreamFlag)
+		}
+	}
+	if ext.TraceID != "" {
+		if len(ext.TraceID) > math.MaxUint8 {
+			return nil, fmt.Errorf("trace id: %w", ErrExtensionOverflow)
+		}
+		buf = append(buf, ExtTagTraceID, byte(len(ext.TraceID)))
+		buf = append(buf, ext.TraceID...)
+	}
+	if ext.Deadline != 0 {
+		buf = append(buf, ExtTagDeadline, 8, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], uint64(ext.Deadline))
+	}
+	for _, k := range sortedKeys(ext.Metadata) {
+		var v = ext.Metadata[k]
+		if 1+len(k)+len(v) > math.MaxUint8 {
+			return nil, fmt.Errorf("metadata %s: %w", k, ErrExtensionOverflow)
+		}
+		buf = append(buf, ExtTagMetadata, byte(1+len(k)+len(v)), byte(len(k)))
+		buf = append(buf, k...)
+		buf = append(buf, v...)
+	}
+	if len(buf)-2 > math.MaxUint16 {
+		return nil, ErrExtensionOverflow
+	}
+	binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
+	return buf, nil
+}
+
+// 返回解析的扩展字段和占用的字节数
+func unmarshalExtension(data []byte) (*fatchoy.PacketExt, int, error) {
+	if len(data) < 2 {
+		return nil, 0, ErrBadExtension
+	}
+	var size = int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+size {
+		return nil, 0, ErrBadExtension
+	}
+	var ext = &fatchoy.PacketExt{}
+	var buf = data[2 : 2+size]
+	for len(buf) > 0 {
+		if len(buf) < 2 || len(buf) < 2+int(buf[1]) {
+			return nil, 0, ErrBadExtension
+		}
+		var tag, value = buf[0], buf[2 : 2+int(buf[1])]
+		switch tag {
+		case ExtTagCorrelationID:
+			if len(value) != 4 {
+				return nil, 0, ErrBadExtension
+			}
+			ext.CorrelationID = binary.BigEndian.Uint32(value)
+		case ExtTagStreamID:
+			if len(value) != 4 {
+				return nil, 0, ErrBadExtension
+			}
+			ext.StreamID = binary.BigEndian.Uint32(value)
+		case ExtTagStreamFlag:
+			if len(value) != 1 {
+				return nil, 0, ErrBadExtension
+			}
+			ext.StreamFlag = value[0]
+		case ExtTagTraceID:
+			ext.TraceID = string(value)
+		case ExtTagDeadline:
+			if len(value) != 8 {
+				return nil, 0, ErrBadExtension
+			}
+			ext.Deadline = int64(binary.BigEndian.Uint64(value))
+		case ExtTagMetadata:
+			if len(value) < 1 || len(value) < 1+int(value[0]) {
+				return nil, 0, ErrBadExtension
+			}
+			if ext.Metadata == nil {
+				ext.Metadata = make(map[string]string)
+			}
+			var n = 1 + int(value[0])
+			ext.Metadata[string(value[1:n])] = string(value[n:])
+		}
+		buf = buf[2+len(value):]
+	}
+	return ext, 2 + size, nil
+}
+
+func sortedKeys(md map[string]string) []string {
+	var keys = make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// V3的扩展字段编码为 `len(uvarint) + TLV...`，每个TLV为 `tag(uvarint) + len(uvarint) + value`，
+// 数值用varint编码，元数据为 `key长度(uvarint) + key + value`，没有长度限制
+func marshalExtensionV3(ext *fatchoy.PacketExt) []byte {
+	if ext.IsEmpty() {
+		return nil
+	}
+	var tlv []byte
+	if ext.CorrelationID != 0 {
+		tlv = appendTLV(tlv, ExtTagCorrelationID, appendUvarint(nil, uint64(ext.CorrelationID)))
+	}
+	if ext.StreamID != 0 {
+		tlv = appendTLV(tlv, ExtTagStreamID, appendUvarint(nil, uint64(ext.StreamID)))
+		if ext.StreamFlag != 0 {
+			tlv = appendTLV(tlv, ExtTagStreamFlag, []byte{ext.StreamFlag})
+		}
+	}
+	if ext.TraceID != "" {
+		tlv = appendTLV(tlv, ExtTagTraceID, []byte(ext.TraceID))
+	}
+	if ext.Deadline != 0 {
+		tlv = appendTLV(tlv, ExtTagDeadline, appendVarint(nil, ext.Deadline))
+	}
+	for _, k := range sortedKeys(ext.Metadata) {
+		var value = appendUvarint(nil, uint64(len(k)))
+		value = append(value, k...)
+		value = append(value, ext.Metadata[k]...)
+		tlv = appendTLV(tlv, ExtTagMetadata, value)
+	}
+	var buf = appendUvarint(make([]byte, 0, len(tlv)+binary.MaxVarintLen32), uint64(len(tlv)))
+	return append(buf, tlv...)
+}
+
+func appendTLV(buf []byte, tag uint64, value []byte) []byte {
+	buf = appendUvarint(buf, tag)
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// 返回解析的V3扩展字段和占用的字节数
+func unmarshalExtensionV3(data []byte) (*fatchoy.PacketExt, int, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return nil, 0, ErrBadExtension
+	}
+	var ext = &fatchoy.PacketExt{}
+	var buf = data[n : n+int(size)]
+	for len(buf) > 0 {
+		tag, n1 := binary.Uvarint(buf)
+		if n1 <= 0 {
+			return nil, 0, ErrBadExtension
+		}
+		length, n2 := binary.Uvarint(buf[n1:])
+		if n2 <= 0 || uint64(len(buf)-n1-n2) < length {
+			return nil, 0, ErrBadExtension
+		}
+		var value = buf[n1+n2 : n1+n2+int(length)]
+		buf = buf[n1+n2+int(length):]
+		switch tag {
+		case ExtTagCorrelationID:
+			v, err := uvarintValue(value, math.MaxUint32)
+			if err != nil {
+				return nil, 0, err
+			}
+			ext.CorrelationID = uint32(v)
+		case ExtTagStreamID:
+			v, err := uvarintValue(value, math.MaxUint32)
+			if err != nil {
+				return nil, 0, err
+			}
+			ext.StreamID = uint32(v)
+		case ExtTagStreamFlag:
+			if len(value) != 1 {
+				return nil, 0, ErrBadExtension
+			}
+			ext.StreamFlag = value[0]
+		case ExtTagTraceID:
+			ext.TraceID = string(value)
+		case ExtTagDeadline:
+			v, n := binary.Varint(value)
+			if n <= 0 || n != len(value) {
+				return nil, 0, ErrBadExtension
+			}
+			ext.Deadline = v
+		case ExtTagMetadata:
+			keyLen, n := binary.Uvarint(value)
+			if n <= 0 || uint64(len(value)-n) < keyLen {
+				return nil, 0, ErrBadExtension
+			}
+			if ext.Metadata == nil {
+				ext.Metadata = make(map[string]string)
+			}
+			var key = string(value[n : n+int(keyLen)])
+			ext.Metadata[key] = string(value[n+int(keyLen):])
+		}
+	}
+	return ext, n + int(size), nil
+}
+
+// value是一个完整的uvarint
+func uvarintValue(value []byte, max uint64) (uint64, error) {
+	v, n := binary.Uvarint(value)
+	if n <= 0 || n != len(value) || v > max {
+		return 0, ErrBadExtension
+	}
+	return v, nil
+}
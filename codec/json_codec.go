@@ -0,0 +1,261 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/packet"
+	"qchen.fun/fatchoy/x/cipher"
+)
+
+const (
+	VersionJSON = -1 // 调试用的文本协议，不参与版本协商
+)
+
+var (
+	JSONMaxLineBytes = 1024 * 1024 // 一行的最大长度，1M
+
+	ErrJSONCrypt = errors.New("JSON codec does not support encryption")
+)
+
+// 文本协议没有压缩、加密和二进制扩展，忽略这些标记
+const jsonIgnoredFlags = fatchoy.PFlagCompressed | fatchoy.PFlagCompressMask | fatchoy.PFlagEncrypted | fatchoy.PFlagExtension
+
+// 一行JSON对应的packet
+type jsonPacket struct {
+	Cmd    int32              `json:"cmd"`
+	Seq    uint16             `json:"seq,omitempty"`
+	Type   fatchoy.PacketType `json:"typ,omitempty"`
+	Flag   fatchoy.PacketFlag `json:"flg,omitempty"`
+	Node   fatchoy.NodeID     `json:"node,omitempty"`
+	Refers []fatchoy.NodeID   `json:"ref,omitempty"`
+	Ext    *fatchoy.PacketExt `json:"ext,omitempty"`
+	Errno  int32              `json:"errno,omitempty"`
+	Body   json.RawMessage    `json:"body,omitempty"`
+}
+
+// 每行一个JSON对象的文本协议，用于开发时通过nc、curl或者REPL调试服务，如：
+//
+//	{"cmd":1001,"seq":1,"body":{"text":"hello"}}
+//
+// 通过packet的注册表按cmd找到消息类型，body用protojson编解码；
+// 没有注册的cmd，body可以是字符串或者数值，其它JSON值按原始字节处理。
+// 错误响应的错误码在errno字段，不支持加密和压缩
+type codecJSON struct {
+}
+
+func NewJSONEncoder() Encoder {
+	return &codecJSON{}
+}
+
+func init() {
+	Register(NewJSONEncoder())
+}
+
+func (c *codecJSON) Name() string {
+	return "JSON"
+}
+
+func (c *codecJSON) Version() int {
+	return VersionJSON
+}
+
+// 根据cmd创建注册的消息，没有注册返回nil
+func createMessage(cmd int32) proto.Message {
+	if name := packet.GetMessageNameByID(cmd); name != "" {
+		return packet.CreateMessageByName(name)
+	}
+	return nil
+}
+
+func marshalJSONBody(pkt fatchoy.IPacket) ([]byte, error) {
+	switch v := pkt.Body().(type) {
+	case nil:
+		return nil, nil
+	case proto.Message:
+		return protojson.Marshal(v)
+	case []byte:
+		if msg := createMessage(pkt.Command()); msg != nil {
+			if err := proto.Unmarshal(v, msg); err != nil {
+				return nil, err
+			}
+			return protojson.Marshal(msg)
+		}
+		return json.Marshal(string(v))
+	default:
+		return json.Marshal(v)
+	}
+}
+
+func unmarshalJSONBody(data []byte, pkt fatchoy.IPacket) error {
+	if len(data) == 0 || string(data) == "null" {
+		return nil
+	}
+	if msg := createMessage(pkt.Command()); msg != nil {
+		if err := protojson.Unmarshal(data, msg); err != nil {
+			return err
+		}
+		pkt.SetBody(msg)
+		return nil
+	}
+	switch data[0] {
+	case '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		pkt.SetBody([]byte(s))
+	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		if i, err := n.Int64(); err == nil {
+			pkt.SetBody(i)
+		} else if f, err := n.Float64(); err == nil {
+			pkt.SetBody(f)
+		} else {
+			return err
+		}
+	default:
+		pkt.SetBody(data)
+	}
+	return nil
+}
+
+func (c *codecJSON) WritePacket(w io.Writer, encrypt cipher.BlockCryptor, pkt fatchoy.IPacket) (int, error) {
+	if encrypt != nil {
+		return 0, ErrJSONCrypt
+	}
+	var jp = jsonPacket{
+		Cmd:    pkt.Command(),
+		Seq:    pkt.Seq(),
+		Type:   pkt.Type(),
+		Flag:   pkt.Flag() &^ jsonIgnoredFlags,
+		Node:   pkt.Node(),
+		Refers: pkt.Refers(),
+	}
+	if ext := pkt.Extension(); !ext.IsEmpty() {
+		jp.Ext = ext
+	}
+	if (pkt.Flag() & fatchoy.PFlagError) != 0 {
+		jp.Errno = pkt.Errno()
+	} else {
+		body, err := marshalJSONBody(pkt)
+		if err != nil {
+			return 0, fmt.Errorf("marshal packet %d body: %w", pkt.Command(), err)
+		}
+		jp.Body = body
+	}
+	data, err := json.Marshal(&jp)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) >= JSONMaxLineBytes {
+		return 0, fmt.Errorf("packet %d payload size %d overflow", pkt.Command(), len(data))
+	}
+	data = append(data, '\n')
+	return w.Write(data)
+}
+
+// 读取一行，结尾没有换行时读到EOF为止
+func readLine(r io.Reader) ([]byte, error) {
+	var br io.ByteReader
+	if v, ok := r.(io.ByteReader); ok {
+		br = v
+	} else {
+		br = &byteReader{r: r}
+	}
+	var line []byte
+	for {
+		ch, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return line, nil
+			}
+			return nil, err
+		}
+		if ch == '\n' {
+			return line, nil
+		}
+		if len(line) >= JSONMaxLineBytes {
+			return nil, fmt.Errorf("line size %d overflow", len(line))
+		}
+		line = append(line, ch)
+	}
+}
+
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (b *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(b.r, b.buf[:]); err != nil {
+		return 0, err
+	}
+	return b.buf[0], nil
+}
+
+// 读取一行JSON作为body，head为空，跳过空行
+func (c *codecJSON) ReadHeadBody(r io.Reader) ([]byte, []byte, error) {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return nil, line, nil
+		}
+	}
+}
+
+func (c *codecJSON) UnmarshalPacket(header, body []byte, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+	if decrypt != nil {
+		return ErrJSONCrypt
+	}
+	var jp jsonPacket
+	if err := json.Unmarshal(body, &jp); err != nil {
+		return err
+	}
+	pkt.SetCommand(jp.Cmd)
+	pkt.SetSeq(jp.Seq)
+	pkt.SetType(jp.Type)
+	pkt.SetFlag(jp.Flag &^ jsonIgnoredFlags)
+	pkt.SetNode(jp.Node)
+	if len(jp.Refers) > 0 {
+		pkt.SetRefers(jp.Refers)
+	}
+	if !jp.Ext.IsEmpty() {
+		pkt.SetExtension(jp.Ext)
+	}
+	if jp.Errno != 0 {
+		pkt.SetErrno(jp.Errno)
+		return nil
+	}
+	pkt.SetFlag(pkt.Flag() &^ fatchoy.PFlagError)
+	if err := unmarshalJSONBody(jp.Body, pkt); err != nil {
+		return fmt.Errorf("unmarshal packet %d body: %w", jp.Cmd, err)
+	}
+	return nil
+}
+
+func (c *codecJSON) ReadPacket(r io.Reader, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+	head, body, err := c.ReadHeadBody(r)
+	if err != nil {
+		return err
+	}
+	return c.UnmarshalPacket(head, body, decrypt, pkt)
+}
@@ -0,0 +1,130 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package codec
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/internal/testpb"
+	"qchen.fun/fatchoy/packet"
+	"qchen.fun/fatchoy/x/cipher"
+)
+
+var registerOnce sync.Once
+
+func registerTestMessages() {
+	registerOnce.Do(func() {
+		packet.RegisterMsgID("testpb.msg_id")
+	})
+}
+
+func TestJSONCodec(t *testing.T) {
+	registerTestMessages()
+	var enc = GetEncoder("JSON")
+	if enc == nil {
+		t.Fatalf("JSON encoder not registered")
+	}
+	var msg = &testpb.EchoReq{Text: "hello"}
+	data, _ := proto.Marshal(msg)
+	var withExt = packet.New(1003, 4, fatchoy.PFlagRpc, "text")
+	withExt.SetNode(0x010002)
+	withExt.SetRefers([]fatchoy.NodeID{5, 6})
+	withExt.SetExtension(&fatchoy.PacketExt{CorrelationID: 7, Metadata: map[string]string{"token": "abc"}})
+	var refused = packet.New(1002, 3, 0, nil)
+	refused.SetErrno(404)
+
+	tests := []struct {
+		pkt  *packet.Packet
+		line string
+	}{
+		{packet.New(1001, 1, 0, msg), `{"cmd":1001,"seq":1,"body":{"text":"hello"}}`},
+		{packet.New(1001, 2, 0, data), `{"cmd":1001,"seq":2,"body":{"text":"hello"}}`},
+		{refused, `{"cmd":1002,"seq":3,"flg":16,"errno":404}`},
+		{withExt, `{"cmd":1003,"seq":4,"flg":32,"node":65538,"ref":[5,6],"ext":{"corr_id":7,"metadata":{"token":"abc"}},"body":"text"}`},
+		{packet.New(1004, 5, 0, int64(1234)), `{"cmd":1004,"seq":5,"body":1234}`},
+		{packet.New(1005, 6, 0, 1.5), `{"cmd":1005,"seq":6,"body":1.5}`},
+		{packet.New(1006, 7, 0, nil), `{"cmd":1006,"seq":7}`},
+	}
+	for i, tc := range tests {
+		var w bytes.Buffer
+		if _, err := enc.WritePacket(&w, nil, tc.pkt); err != nil {
+			t.Fatalf("case %d WritePacket: %v", i, err)
+		}
+		// protojson的输出可能有随机空格
+		var line = strings.ReplaceAll(strings.TrimSuffix(w.String(), "\n"), " ", "")
+		if line != tc.line {
+			t.Fatalf("case %d: %s != %s", i, line, tc.line)
+		}
+		var pkt = packet.Make()
+		if err := enc.ReadPacket(&w, nil, pkt); err != nil {
+			t.Fatalf("case %d ReadPacket: %v", i, err)
+		}
+		if pkt.Command() != tc.pkt.Command() || pkt.Seq() != tc.pkt.Seq() || pkt.Flag() != tc.pkt.Flag() ||
+			pkt.Errno() != tc.pkt.Errno() || !bytes.Equal(pkt.BodyToBytes(), tc.pkt.BodyToBytes()) {
+			t.Fatalf("case %d: packet not equal, %v != %v", i, pkt, tc.pkt)
+		}
+	}
+}
+
+func TestJSONCodecRead(t *testing.T) {
+	registerTestMessages()
+	var enc = NewJSONEncoder()
+	var input = "\n  {\"cmd\":1001,\"body\":{\"text\":\"hi\"}}\r\n\n{\"cmd\":2000,\"body\":[1,2]}"
+	var r = strings.NewReader(input)
+
+	var pkt = packet.Make()
+	if err := enc.ReadPacket(r, nil, pkt); err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	var req, ok = pkt.Body().(*testpb.EchoReq)
+	if !ok || req.Text != "hi" {
+		t.Fatalf("unexpected body %v", pkt.Body())
+	}
+	// 没有注册的消息按原始字节，最后一行可以没有换行
+	pkt = packet.Make()
+	if err := enc.ReadPacket(r, nil, pkt); err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	if s := pkt.BodyToString(); s != "[1,2]" {
+		t.Fatalf("unexpected body %s", s)
+	}
+
+	var bad = []string{
+		"{\"cmd\":1001",
+		"{\"cmd\":1001,\"body\":{\"unknown\":1}}",
+		"{\"cmd\":2000,\"body\":1e999}",
+	}
+	for _, line := range bad {
+		if err := enc.ReadPacket(strings.NewReader(line), nil, packet.Make()); err == nil {
+			t.Fatalf("expect error: %s", line)
+		}
+	}
+	var w bytes.Buffer
+	var encrypt = cipher.NewCrypt("aes-128", []byte("0123456789abcdef"), []byte("0123456789abcdef"))
+	if _, err := enc.WritePacket(&w, encrypt, packet.New(1, 0, 0, nil)); err != ErrJSONCrypt {
+		t.Fatalf("expect crypt error, got %v", err)
+	}
+}
+
+// 版本协商不会选中JSON
+func TestJSONCodecNegotiate(t *testing.T) {
+	for _, version := range []int{VersionJSON, 0} {
+		if enc := GetEncoderByVersion(version); enc != nil {
+			t.Fatalf("version %d: unexpected encoder %s", version, enc.Name())
+		}
+		if enc := Negotiate(NewV3Encoder(0), version); enc != nil {
+			t.Fatalf("version %d: unexpected negotiated encoder %s", version, enc.Name())
+		}
+	}
+	if enc := Negotiate(NewJSONEncoder(), VersionV3); enc != nil {
+		t.Fatalf("unexpected negotiated encoder %s", enc.Name())
+	}
+}
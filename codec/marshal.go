@@ -8,26 +8,54 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 
 	"qchen.fun/fatchoy"
 	"qchen.fun/fatchoy/x/cipher"
-	"qchen.fun/fatchoy/x/fsutil"
 )
 
-// 把packet序列化为字节流，有压缩和加密
-func marshalPacketBody(pkt fatchoy.IPacket, threshold int, encryptor cipher.BlockCryptor) ([]byte, error) {
-	var flag = pkt.Flag()
+// 使用AEAD解密时收到没有加密标记的消息
+var ErrNotEncrypted = errors.New("packet is not encrypted")
+
+// 编码选项
+type EncoderOption func(*encoderOptions)
+
+type encoderOptions struct {
+	compress uint8 // 压缩算法
+}
+
+// 使用指定的压缩算法，见RegisterCompressor
+func WithCompression(id uint8) EncoderOption {
+	return func(o *encoderOptions) {
+		o.compress = id
+	}
+}
+
+func newEncoderOptions(opts []EncoderOption) encoderOptions {
+	var o encoderOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// 把packet序列化为字节流，有压缩和加密。
+// AEAD需要把编码后的头部作为附加数据，这里只设置加密标记，编码头部之后再用sealPacketBody加密
+func marshalPacketBody(pkt fatchoy.IPacket, threshold int, compress uint8, encryptor cipher.BlockCryptor) ([]byte, error) {
+	var flag = pkt.Flag() &^ (fatchoy.PFlagCompressed | fatchoy.PFlagCompressMask)
 	var body = pkt.BodyToBytes()
 	if threshold > 0 && len(body) > threshold {
-		if data, err := fsutil.CompressBytes(body); err != nil {
+		if data, f, err := compressBody(body, compress, flag); err != nil {
 			return nil, fmt.Errorf("compress packet %v: %w", pkt.Command(), err)
 		} else {
 			body = data
-			flag |= fatchoy.PFlagCompressed
+			flag = f
 		}
 	}
-	if len(body) > 0 && encryptor != nil {
+	if _, ok := encryptor.(cipher.AEADCryptor); ok {
+		flag |= fatchoy.PFlagEncrypted // 空body也要认证
+	} else if len(body) > 0 && encryptor != nil {
 		body = encryptor.Encrypt(body)
 		flag |= fatchoy.PFlagEncrypted
 	}
@@ -35,28 +63,62 @@ func marshalPacketBody(pkt fatchoy.IPacket, threshold int, encryptor cipher.Bloc
 	return body, nil
 }
 
-// 把字节流反序列化为packet，有解密和解压
-func unmarshalPacketBody(body []byte, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+// 加密后body的长度，编码头部时需要
+func sealedBodySize(encryptor cipher.BlockCryptor, body []byte) int {
+	if aead, ok := encryptor.(cipher.AEADCryptor); ok {
+		return len(body) + aead.Overhead()
+	}
+	return len(body)
+}
+
+// AEAD加密body，编码后的头部`aad`作为附加数据一起认证，其它加密方式在marshalPacketBody已经完成
+func sealPacketBody(encryptor cipher.BlockCryptor, aad, body []byte) []byte {
+	if aead, ok := encryptor.(cipher.AEADCryptor); ok {
+		return aead.Seal(body, aad)
+	}
+	return body
+}
+
+// 把字节流反序列化为packet，有解密和解压，`aad`是AEAD认证的头部，需要和sealPacketBody一致
+func unmarshalPacketBody(aad, body []byte, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
 	var flag = pkt.Flag()
-	if (flag & fatchoy.PFlagEncrypted) != 0 {
+	if aead, ok := decrypt.(cipher.AEADCryptor); ok {
+		// 没有加密标记的消息会绕过认证和重放检查
+		if (flag & fatchoy.PFlagEncrypted) == 0 {
+			return fmt.Errorf("packet %v: %w", pkt.Command(), ErrNotEncrypted)
+		}
+		plain, err := aead.Open(body, aad)
+		if err != nil {
+			return fmt.Errorf("decrypt packet %v: %w", pkt.Command(), err)
+		}
+		body = plain
+		flag = flag &^ fatchoy.PFlagEncrypted
+	} else if (flag & fatchoy.PFlagEncrypted) != 0 {
 		if decrypt == nil {
 			return fmt.Errorf("packet %v must be decrypted", pkt.Command())
 		}
 		body = decrypt.Decrypt(body)
 		flag = flag &^ fatchoy.PFlagEncrypted
 	}
+	if len(body) == 0 {
+		pkt.SetFlag(flag)
+		return nil
+	}
 	if (flag & fatchoy.PFlagCompressed) != 0 {
-		if uncompressed, err := fsutil.UncompressBytes(body); err != nil {
+		if uncompressed, err := uncompressBody(body, flag); err != nil {
 			return fmt.Errorf("decompress packet %d: %w", pkt.Command(), err)
 		} else {
 			body = uncompressed
-			flag = flag &^ fatchoy.PFlagCompressed
+			flag = flag &^ (fatchoy.PFlagCompressed | fatchoy.PFlagCompressMask)
 		}
 	}
 	pkt.SetFlag(flag)
 	// 如果有FlagError，则body是数值错误码
 	if (flag & fatchoy.PFlagError) != 0 {
-		x, _ := binary.Varint(body) // TODO: deal varint error
+		x, n := binary.Varint(body)
+		if n <= 0 {
+			return fmt.Errorf("packet %d invalid errno", pkt.Command())
+		}
 		pkt.SetBody(x)
 	} else {
 		pkt.SetBody(body)
@@ -22,6 +22,7 @@ type testPacket struct {
 	node     fatchoy.NodeID
 	body     []byte
 	refer    []fatchoy.NodeID
+	ext      *fatchoy.PacketExt
 	endpoint fatchoy.MessageEndpoint
 }
 
@@ -93,6 +94,14 @@ func (m *testPacket) AddRefers(v ...fatchoy.NodeID) {
 	m.refer = append(m.refer, v...)
 }
 
+func (m *testPacket) Extension() *fatchoy.PacketExt {
+	return m.ext
+}
+
+func (m *testPacket) SetExtension(v *fatchoy.PacketExt) {
+	m.ext = v
+}
+
 func (m *testPacket) Endpoint() fatchoy.MessageEndpoint {
 	return m.endpoint
 }
@@ -101,6 +110,9 @@ func (m *testPacket) SetEndpoint(v fatchoy.MessageEndpoint) {
 	m.endpoint = v
 }
 
+func (m *testPacket) Release() {
+}
+
 func (m *testPacket) Clone() fatchoy.IPacket {
 	return &testPacket{
 		command:  m.command,
@@ -109,6 +121,7 @@ func (m *testPacket) Clone() fatchoy.IPacket {
 		typ:      m.typ,
 		body:     m.body,
 		refer:    m.refer,
+		ext:      m.ext,
 		endpoint: m.endpoint,
 	}
 }
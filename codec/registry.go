@@ -15,3 +15,16 @@ func Register(v Encoder) {
 func GetEncoder(name string) Encoder {
 	return registry[name]
 }
+
+// 根据协议版本获取编码器，用于和对端协商版本，版本号小于1的编码器（如JSON）不参与协商
+func GetEncoderByVersion(version int) Encoder {
+	if version < VersionV1 {
+		return nil
+	}
+	for _, v := range registry {
+		if v.Version() == version {
+			return v
+		}
+	}
+	return nil
+}
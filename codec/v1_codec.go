@@ -9,20 +9,24 @@ import (
 	"io"
 
 	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/x/bufpool"
 	"qchen.fun/fatchoy/x/cipher"
 )
 
 // V1格式编码
 type codecV1 struct {
 	threshold int
+	compress  uint8 // 压缩算法
 }
 
-func NewV1Encoder(threshold int) Encoder {
+func NewV1Encoder(threshold int, opts ...EncoderOption) Encoder {
+	var o = newEncoderOptions(opts)
 	if threshold <= 0 {
 		threshold = 4096 // 默认压缩阈值，4K
 	}
 	return &codecV1{
 		threshold: threshold,
+		compress:  o.compress,
 	}
 }
 
@@ -40,17 +44,18 @@ func (c *codecV1) Version() int {
 
 // 把`pkt`编码到`w`，内部除了flag不应该修改pkt的其它字段
 func (c *codecV1) WritePacket(w io.Writer, encrypt cipher.BlockCryptor, pkt fatchoy.IPacket) (int, error) {
-	body, err := marshalPacketBody(pkt, c.threshold, encrypt)
+	body, err := marshalPacketBody(pkt, c.threshold, c.compress, encrypt)
 	if err != nil {
 		return 0, err
 	}
-	var nbytes = V1HeaderSize + len(body)
+	var nbytes = V1HeaderSize + sealedBodySize(encrypt, body)
 	if nbytes > V1MaxPayloadBytes {
 		return 0, fmt.Errorf("packet %d payload size %d overflow", pkt.Command(), nbytes)
 	}
 	var headbuf = make([]byte, V1HeaderSize)
 	var head = V1Header(headbuf)
 	head.Pack(pkt, uint16(nbytes))
+	body = sealPacketBody(encrypt, headbuf[:V1HeaderSize-4], body)
 	var checksum = head.CalcChecksum(body)
 	head.SetChecksum(checksum)
 
@@ -65,24 +70,29 @@ func (c *codecV1) WritePacket(w io.Writer, encrypt cipher.BlockCryptor, pkt fatc
 
 // 按V1协议格式读取head和body
 func (codecV1) ReadHeadBody(r io.Reader) ([]byte, []byte, error) {
-	var buf [V1HeaderSize]byte
-	if _, err := io.ReadFull(r, buf[:]); err != nil {
+	var buf = getReadBuffer(V1HeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		bufpool.Put(buf)
 		return nil, nil, err
 	}
-	var head = V1Header(buf[:])
-	var length = head.Len()
-	if length > V1MaxPayloadBytes {
+	var length = V1Header(buf).Len()
+	if length < V1HeaderSize || length > V1MaxPayloadBytes {
+		bufpool.Put(buf)
 		return nil, nil, fmt.Errorf("payload size %d overflow", length)
 	}
-	var payload = make([]byte, length-V1HeaderSize)
-	if _, err := io.ReadFull(r, payload); err != nil {
+	buf = growReadBuffer(buf, int(length))
+	if _, err := io.ReadFull(r, buf[V1HeaderSize:]); err != nil {
+		bufpool.Put(buf)
 		return nil, nil, err
 	}
-	return head, payload, nil
+	return buf[:V1HeaderSize], buf[V1HeaderSize:], nil
 }
 
 // 解码消息到`pkt`
 func (codecV1) UnmarshalPacket(header, body []byte, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+	if len(header) < V1HeaderSize {
+		return fmt.Errorf("invalid header size %d", len(header))
+	}
 	var head = V1Header(header)
 	pkt.SetFlag(fatchoy.PacketFlag(head.Flag()))
 	pkt.SetSeq(head.Seq())
@@ -92,10 +102,7 @@ func (codecV1) UnmarshalPacket(header, body []byte, decrypt cipher.BlockCryptor,
 	if crc := head.CalcChecksum(body); crc != checksum {
 		return fmt.Errorf("packet %v checksum mismatch %x != %x", pkt.Command(), checksum, crc)
 	}
-	if len(body) > 0 {
-		return unmarshalPacketBody(body, decrypt, pkt)
-	}
-	return nil
+	return unmarshalPacketBody(header[:V1HeaderSize-4], body, decrypt, pkt)
 }
 
 // 从`r`里读取消息到`pkt`
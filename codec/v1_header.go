@@ -58,12 +58,8 @@ func (h V1Header) Checksum() uint32 {
 
 // 校验码包含head和body
 func (h V1Header) CalcChecksum(payload []byte) uint32 {
-	var hasher = crc32.NewIEEE()
-	hasher.Write(h[:V1HeaderSize-4])
-	if len(payload) > 0 {
-		hasher.Write(payload)
-	}
-	return hasher.Sum32()
+	var crc = crc32.ChecksumIEEE(h[:V1HeaderSize-4])
+	return crc32.Update(crc, crc32.IEEETable, payload)
 }
 
 func (h V1Header) SetChecksum(crc uint32) {
@@ -11,20 +11,24 @@ import (
 	"math"
 
 	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/x/bufpool"
 	"qchen.fun/fatchoy/x/cipher"
 )
 
 // V2格式编码
 type codecV2 struct {
 	threshold int
+	compress  uint8 // 压缩算法
 }
 
-func NewV2Encoder(threshold int) Encoder {
+func NewV2Encoder(threshold int, opts ...EncoderOption) Encoder {
+	var o = newEncoderOptions(opts)
 	if threshold <= 0 {
 		threshold = 8192 // 默认压缩阈值，8K
 	}
 	return &codecV2{
 		threshold: threshold,
+		compress:  o.compress,
 	}
 }
 
@@ -46,26 +50,37 @@ func (c *codecV2) WritePacket(w io.Writer, encrypt cipher.BlockCryptor, pkt fatc
 	if n := len(refers); n > math.MaxUint8 {
 		return 0, fmt.Errorf("packet %d refer count #%d overflow", pkt.Command(), n)
 	}
-	body, err := marshalPacketBody(pkt, c.threshold, encrypt)
+	body, err := marshalPacketBody(pkt, c.threshold, c.compress, encrypt)
 	if err != nil {
 		return 0, err
 	}
+	ext, err := marshalExtension(pkt.Extension())
+	if err != nil {
+		return 0, fmt.Errorf("packet %d: %w", pkt.Command(), err)
+	}
+	if len(ext) > 0 {
+		pkt.SetFlag(pkt.Flag() | fatchoy.PFlagExtension)
+	} else {
+		pkt.SetFlag(pkt.Flag() &^ fatchoy.PFlagExtension)
+	}
 
-	var nn = V2HeaderSize + len(refers)*4
-	var nbytes = nn + len(body)
+	var nn = V2HeaderSize + len(refers)*4 + len(ext)
+	var nbytes = nn + sealedBodySize(encrypt, body)
 	if nbytes > V2MaxPayloadBytes {
 		return 0, fmt.Errorf("packet %d payload size %d overflow", pkt.Command(), nbytes)
 	}
 	var buf = make([]byte, nn)
-	if len(refers) > 0 {
-		var i = V2HeaderSize
-		for _, node := range refers {
-			binary.BigEndian.PutUint32(buf[i:], uint32(node))
-			i += 4
-		}
+	var i = V2HeaderSize
+	for _, node := range refers {
+		binary.BigEndian.PutUint32(buf[i:], uint32(node))
+		i += 4
 	}
+	copy(buf[i:], ext)
 	var head = V2Header(buf)
 	head.Pack(pkt, uint8(len(refers)), uint32(nbytes))
+	if encrypt != nil {
+		body = sealPacketBody(encrypt, v2AdditionalData(buf, buf[V2HeaderSize:]), body)
+	}
 	var checksum = head.CalcChecksum(buf[V2HeaderSize:], body)
 	head.SetChecksum(checksum)
 
@@ -80,24 +95,34 @@ func (c *codecV2) WritePacket(w io.Writer, encrypt cipher.BlockCryptor, pkt fatc
 
 // 按V2协议格式读取head和body
 func (codecV2) ReadHeadBody(r io.Reader) ([]byte, []byte, error) {
-	var buf [V2HeaderSize]byte
-	if _, err := io.ReadFull(r, buf[:]); err != nil {
+	var buf = getReadBuffer(V2HeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		bufpool.Put(buf)
 		return nil, nil, err
 	}
-	var head = V2Header(buf[:])
-	var length = head.Len()
-	if length > V2MaxPayloadBytes {
+	return readV2Payload(r, buf)
+}
+
+// 头部已经读到`buf`，继续读取body
+func readV2Payload(r io.Reader, buf []byte) ([]byte, []byte, error) {
+	var length = V2Header(buf).Len()
+	if length < V2HeaderSize || length > V2MaxPayloadBytes {
+		bufpool.Put(buf)
 		return nil, nil, fmt.Errorf("payload size %d overflow", length)
 	}
-	var payload = make([]byte, length-V2HeaderSize)
-	if _, err := io.ReadFull(r, payload); err != nil {
+	buf = growReadBuffer(buf, int(length))
+	if _, err := io.ReadFull(r, buf[V2HeaderSize:]); err != nil {
+		bufpool.Put(buf)
 		return nil, nil, err
 	}
-	return head, payload, nil
+	return buf[:V2HeaderSize], buf[V2HeaderSize:], nil
 }
 
 // 解码消息到`pkt`
 func (codecV2) UnmarshalPacket(header, body []byte, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+	if len(header) < V2HeaderSize {
+		return fmt.Errorf("invalid header size %d", len(header))
+	}
 	var head = V2Header(header)
 	pkt.SetFlag(fatchoy.PacketFlag(head.Flag()))
 	pkt.SetType(fatchoy.PacketType(head.Type()))
@@ -122,11 +147,27 @@ func (codecV2) UnmarshalPacket(header, body []byte, decrypt cipher.BlockCryptor,
 		}
 		pkt.SetRefers(refers)
 	}
-	body = body[pos:]
-	if len(body) > 0 {
-		return unmarshalPacketBody(body, decrypt, pkt)
+	if (pkt.Flag() & fatchoy.PFlagExtension) != 0 {
+		ext, n, err := unmarshalExtension(body[pos:])
+		if err != nil {
+			return fmt.Errorf("packet %d: %w", pkt.Command(), err)
+		}
+		pos += n
+		pkt.SetExtension(ext)
+		pkt.SetFlag(pkt.Flag() &^ fatchoy.PFlagExtension)
 	}
-	return nil
+	var aad []byte
+	if decrypt != nil {
+		aad = v2AdditionalData(header, body[:pos])
+	}
+	return unmarshalPacketBody(aad, body[pos:], decrypt, pkt)
+}
+
+// AEAD认证的附加数据，包括除校验码以外的头部，以及refer和扩展字段
+func v2AdditionalData(header, refer []byte) []byte {
+	var aad = make([]byte, 0, V2HeaderSize-4+len(refer))
+	aad = append(aad, header[:V2HeaderSize-4]...)
+	return append(aad, refer...)
 }
 
 // 从`r`里读取消息到`pkt`
@@ -7,6 +7,9 @@ package codec
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"testing"
 
 	"qchen.fun/fatchoy"
@@ -99,3 +102,133 @@ func BenchmarkCodecMarshal(b *testing.B) {
 	}
 	w.Reset()
 }
+
+func TestCodecAuthFailed(t *testing.T) {
+	var c = NewV2Encoder(0)
+	encrypt, _ := createCryptor("chacha20-poly1305")
+	decrypt := cipher.NewCrypt("chacha20-poly1305", encrypt.Key(), encrypt.IV())
+	var w bytes.Buffer
+	if _, err := c.WritePacket(&w, encrypt, newTestPacket(100)); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var data = w.Bytes()
+	data[len(data)-1] ^= 0x01 // 篡改tag
+	head, body, err := c.ReadHeadBody(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadHeadBody: %v", err)
+	}
+	V2Header(head).SetChecksum(V2Header(head).CalcChecksum(nil, body))
+	var pkt testPacket
+	if err := c.UnmarshalPacket(head, body, decrypt, &pkt); !errors.Is(err, cipher.ErrAuthFailed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCodecExtension(t *testing.T) {
+	var c = NewV2Encoder(0)
+	var pkt = newTestPacket(100)
+	var md = map[string]string{"token": "abc", "trace": ""}
+	pkt.SetExtension(&fatchoy.PacketExt{CorrelationID: 0x12345678, Metadata: md, StreamID: 3, StreamFlag: 2})
+	var clone = append([]byte(nil), pkt.BodyToBytes()...)
+	var w bytes.Buffer
+	if _, err := c.WritePacket(&w, nil, pkt); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var recv testPacket
+	if err := c.ReadPacket(&w, nil, &recv); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	pkt.SetBody(clone)
+	if !isEqualPacket(t, pkt, &recv) || len(recv.Refers()) != 2 {
+		t.Fatalf("packet not equal: %v != %v", pkt, &recv)
+	}
+	var ext = recv.Extension()
+	if ext == nil || ext.CorrelationID != 0x12345678 || len(ext.Metadata) != len(md) || ext.StreamID != 3 || ext.StreamFlag != 2 {
+		t.Fatalf("unexpected extension %+v", ext)
+	}
+	for k, v := range md {
+		if s, found := ext.Metadata[k]; !found || s != v {
+			t.Fatalf("metadata %s: %q != %q", k, s, v)
+		}
+	}
+	if recv.Flag()&fatchoy.PFlagExtension != 0 {
+		t.Fatalf("extension flag should be cleared")
+	}
+
+	// 未知的tag被跳过
+	var data = []byte{0, 9, 99, 1, 0xff, ExtTagCorrelationID, 4, 0, 0, 0, 1}
+	if ext, n, err := unmarshalExtension(data); err != nil || n != len(data) || ext.CorrelationID != 1 {
+		t.Fatalf("unmarshalExtension: %v, %d, %+v", err, n, ext)
+	}
+	if _, _, err := unmarshalExtension(data[:6]); err != ErrBadExtension {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pkt.SetExtension(&fatchoy.PacketExt{Metadata: map[string]string{"key": strutil.RandString(300)}})
+	if _, err := c.WritePacket(&w, nil, pkt); !errors.Is(err, ErrExtensionOverflow) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// 篡改头部后重新计算校验码，只有AEAD的认证能发现
+func tamperHeader(enc Encoder, head, body []byte) {
+	switch enc.Version() {
+	case VersionV1:
+		head[4] ^= 0x01 // seq
+		V1Header(head).SetChecksum(V1Header(head).CalcChecksum(body))
+	case VersionV2:
+		head[11] ^= 0x01 // node
+		V2Header(head).SetChecksum(V2Header(head).CalcChecksum(nil, body))
+	case VersionV3:
+		body[1] ^= 0x01 // type
+		binary.BigEndian.PutUint32(head[len(head)-4:], crc32.ChecksumIEEE(body))
+	}
+}
+
+func TestCodecAEADHeader(t *testing.T) {
+	for _, c := range []Encoder{NewV1Encoder(0), NewV2Encoder(0), NewV3Encoder(0)} {
+		encrypt, _ := createCryptor("aes-gcm")
+		decrypt := cipher.NewCrypt("aes-gcm", encrypt.Key(), encrypt.IV())
+
+		// 去掉加密标记的明文消息
+		var w bytes.Buffer
+		if _, err := c.WritePacket(&w, nil, newTestPacket(100)); err != nil {
+			t.Fatalf("%s: Encode: %v", c.Name(), err)
+		}
+		var pkt testPacket
+		if err := c.ReadPacket(&w, decrypt, &pkt); !errors.Is(err, ErrNotEncrypted) {
+			t.Fatalf("%s: plaintext packet: %v", c.Name(), err)
+		}
+
+		// 篡改头部
+		w.Reset()
+		if _, err := c.WritePacket(&w, encrypt, newTestPacket(100)); err != nil {
+			t.Fatalf("%s: Encode: %v", c.Name(), err)
+		}
+		head, body, err := c.ReadHeadBody(&w)
+		if err != nil {
+			t.Fatalf("%s: ReadHeadBody: %v", c.Name(), err)
+		}
+		tamperHeader(c, head, body)
+		if err := c.UnmarshalPacket(head, body, decrypt, &pkt); !errors.Is(err, cipher.ErrAuthFailed) {
+			t.Fatalf("%s: tampered header: %v", c.Name(), err)
+		}
+
+		// 空body也要加密和认证，重放会被拒绝
+		w.Reset()
+		var empty = newTestPacket(0)
+		if _, err := c.WritePacket(&w, encrypt, empty); err != nil {
+			t.Fatalf("%s: Encode: %v", c.Name(), err)
+		}
+		var data = append([]byte(nil), w.Bytes()...)
+		pkt = testPacket{}
+		if err := c.ReadPacket(&w, decrypt, &pkt); err != nil {
+			t.Fatalf("%s: Decode empty body: %v", c.Name(), err)
+		}
+		if pkt.Command() != empty.Command() || len(pkt.BodyToBytes()) != 0 || pkt.Flag()&fatchoy.PFlagEncrypted != 0 {
+			t.Fatalf("%s: empty body mismatch: %v", c.Name(), &pkt)
+		}
+		if err := c.ReadPacket(bytes.NewReader(data), decrypt, &pkt); !errors.Is(err, cipher.ErrReplayed) {
+			t.Fatalf("%s: replayed empty body: %v", c.Name(), err)
+		}
+	}
+}
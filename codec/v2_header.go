@@ -20,6 +20,7 @@ const (
 // V2协议主要用于server内部的通信，一条消息大致分为下面这3段：
 //  `header + refer(变长） + body`
 // refer指的是节点的session号，个数由header中的`nref`指定，主要用于协议转发和广播等等
+// flag有PFlagExtension时，refer和body之间还有一段扩展字段，见extension.go
 //
 // V2协议头，len包含header和body
 //       -----------------------------------------------------
@@ -69,15 +70,9 @@ func (h V2Header) Checksum() uint32 {
 
 // 校验码包含head和body
 func (h V2Header) CalcChecksum(refer, payload []byte) uint32 {
-	var hasher = crc32.NewIEEE()
-	hasher.Write(h[:V2HeaderSize-4])
-	if len(refer) > 0 {
-		hasher.Write(refer)
-	}
-	if len(payload) > 0 {
-		hasher.Write(payload)
-	}
-	return hasher.Sum32()
+	var crc = crc32.ChecksumIEEE(h[:V2HeaderSize-4])
+	crc = crc32.Update(crc, crc32.IEEETable, refer)
+	return crc32.Update(crc, crc32.IEEETable, payload)
 }
 
 func (h V2Header) SetChecksum(crc uint32) {
@@ -0,0 +1,372 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/x/bufpool"
+	"qchen.fun/fatchoy/x/cipher"
+)
+
+const (
+	VersionV3         = 3
+	V3Magic           = 0xF3             // V3协议的第一个字节，V2的第一个字节是长度的高位，不会超过0x80
+	V3MaxPayloadBytes = 16 * 1024 * 1024 // 16M
+)
+
+// V3协议用varint编码头部字段，小包的头部比V2小很多，扩展字段用varint编码的TLV，见extension.go
+//
+//	`magic(1) + len(uvarint) + crc32(4) + payload`
+//
+// len是payload的长度，crc32是payload的校验和，payload为：
+//
+//	`flag(1) + type(1) + seq(uvarint) + cmd(varint) + node(uvarint) + #ref(uvarint) + refer(uvarint...) + ext + body`
+//
+// flag有PFlagExtension时才有ext
+
+var ErrBadV3Packet = errors.New("malformed V3 packet")
+
+// V3格式编码
+type codecV3 struct {
+	threshold int
+	compress  uint8 // 压缩算法
+}
+
+func NewV3Encoder(threshold int, opts ...EncoderOption) Encoder {
+	var o = newEncoderOptions(opts)
+	if threshold <= 0 {
+		threshold = 8192 // 默认压缩阈值，8K
+	}
+	return &codecV3{
+		threshold: threshold,
+		compress:  o.compress,
+	}
+}
+
+func init() {
+	Register(NewV3Encoder(0))
+}
+
+func (c *codecV3) Name() string {
+	return "V3"
+}
+
+func (c *codecV3) Version() int {
+	return VersionV3
+}
+
+// 把`pkt`编码到`w`，内部除了flag不应该修改pkt的其它字段
+func (c *codecV3) WritePacket(w io.Writer, encrypt cipher.BlockCryptor, pkt fatchoy.IPacket) (int, error) {
+	body, err := marshalPacketBody(pkt, c.threshold, c.compress, encrypt)
+	if err != nil {
+		return 0, err
+	}
+	var ext = marshalExtensionV3(pkt.Extension())
+	if len(ext) > 0 {
+		pkt.SetFlag(pkt.Flag() | fatchoy.PFlagExtension)
+	} else {
+		pkt.SetFlag(pkt.Flag() &^ fatchoy.PFlagExtension)
+	}
+
+	var refers = pkt.Refers()
+	var buf = make([]byte, 0, 24+len(refers)*binary.MaxVarintLen32+len(ext))
+	buf = append(buf, byte(pkt.Flag()), byte(pkt.Type()))
+	buf = appendUvarint(buf, uint64(pkt.Seq()))
+	buf = appendVarint(buf, int64(pkt.Command()))
+	buf = appendUvarint(buf, uint64(pkt.Node()))
+	buf = appendUvarint(buf, uint64(len(refers)))
+	for _, node := range refers {
+		buf = appendUvarint(buf, uint64(node))
+	}
+	buf = append(buf, ext...)
+
+	var size = len(buf) + sealedBodySize(encrypt, body)
+	if size > V3MaxPayloadBytes {
+		return 0, fmt.Errorf("packet %d payload size %d overflow", pkt.Command(), size)
+	}
+	body = sealPacketBody(encrypt, buf, body)
+	var crc = crc32.NewIEEE()
+	crc.Write(buf)
+	crc.Write(body)
+	var head = make([]byte, 1, 1+binary.MaxVarintLen32+4)
+	head[0] = V3Magic
+	head = appendUvarint(head, uint64(size))
+	head = append(head, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(head[len(head)-4:], crc.Sum32())
+
+	if _, err := w.Write(head); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(buf); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return 0, err
+	}
+	return len(head) + size, nil
+}
+
+// 按V3协议格式读取head和body
+func (codecV3) ReadHeadBody(r io.Reader) ([]byte, []byte, error) {
+	var buf = getReadBuffer(1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		bufpool.Put(buf)
+		return nil, nil, err
+	}
+	if buf[0] != V3Magic {
+		var magic = buf[0]
+		bufpool.Put(buf)
+		return nil, nil, fmt.Errorf("%w: magic %x", ErrBadV3Packet, magic)
+	}
+	return readV3HeadBody(r, buf)
+}
+
+// 读取magic之后的V3包，magic已经读到`buf`，返回的head包含magic
+func readV3HeadBody(r io.Reader, buf []byte) ([]byte, []byte, error) {
+	var length uint64
+	for shift := uint(0); ; shift += 7 {
+		if shift >= 7*binary.MaxVarintLen32 {
+			bufpool.Put(buf)
+			return nil, nil, fmt.Errorf("%w: length overflow", ErrBadV3Packet)
+		}
+		var pos = len(buf)
+		buf = append(buf, 0)
+		if _, err := io.ReadFull(r, buf[pos:]); err != nil {
+			bufpool.Put(buf)
+			return nil, nil, err
+		}
+		length |= uint64(buf[pos]&0x7f) << shift
+		if buf[pos] < 0x80 {
+			break
+		}
+	}
+	if length > V3MaxPayloadBytes {
+		bufpool.Put(buf)
+		return nil, nil, fmt.Errorf("payload size %d overflow", length)
+	}
+	// crc32和payload一起读
+	var headLen = len(buf) + 4
+	buf = growReadBuffer(buf, headLen+int(length))
+	if _, err := io.ReadFull(r, buf[headLen-4:]); err != nil {
+		bufpool.Put(buf)
+		return nil, nil, err
+	}
+	return buf[:headLen], buf[headLen:], nil
+}
+
+// 解码消息到`pkt`
+func (codecV3) UnmarshalPacket(header, body []byte, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+	if len(header) < 6 || header[0] != V3Magic {
+		return ErrBadV3Packet
+	}
+	var checksum = binary.BigEndian.Uint32(header[len(header)-4:])
+	if crc := crc32.ChecksumIEEE(body); crc != checksum {
+		return fmt.Errorf("packet checksum mismatch %x != %x", checksum, crc)
+	}
+	if len(body) < 2 {
+		return ErrBadV3Packet
+	}
+	pkt.SetFlag(fatchoy.PacketFlag(body[0]))
+	pkt.SetType(fatchoy.PacketType(body[1]))
+	var d = v3Decoder{buf: body[2:]}
+	var seq = d.uvarint(math.MaxUint16)
+	var cmd = d.varint()
+	var node = d.uvarint(math.MaxUint32)
+	var refcnt = d.uvarint(uint64(len(d.buf)))
+	if d.err != nil || cmd < math.MinInt32 || cmd > math.MaxInt32 {
+		return ErrBadV3Packet
+	}
+	pkt.SetSeq(uint16(seq))
+	pkt.SetCommand(int32(cmd))
+	pkt.SetNode(fatchoy.NodeID(node))
+	if refcnt > 0 {
+		var refers = make([]fatchoy.NodeID, 0, refcnt)
+		for i := uint64(0); i < refcnt; i++ {
+			refers = append(refers, fatchoy.NodeID(d.uvarint(math.MaxUint32)))
+		}
+		if d.err != nil {
+			return fmt.Errorf("packet %d: %w", pkt.Command(), d.err)
+		}
+		pkt.SetRefers(refers)
+	}
+	if (pkt.Flag() & fatchoy.PFlagExtension) != 0 {
+		ext, n, err := unmarshalExtensionV3(d.buf)
+		if err != nil {
+			return fmt.Errorf("packet %d: %w", pkt.Command(), err)
+		}
+		d.buf = d.buf[n:]
+		pkt.SetExtension(ext)
+		pkt.SetFlag(pkt.Flag() &^ fatchoy.PFlagExtension)
+	}
+	// flag到扩展字段作为AEAD认证的附加数据
+	return unmarshalPacketBody(body[:len(body)-len(d.buf)], d.buf, decrypt, pkt)
+}
+
+// 从`r`里读取消息到`pkt`
+func (c *codecV3) ReadPacket(r io.Reader, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+	head, body, err := c.ReadHeadBody(r)
+	if err != nil {
+		return err
+	}
+	return c.UnmarshalPacket(head, body, decrypt, pkt)
+}
+
+type v3Decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *v3Decoder) uvarint(max uint64) uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 || v > max {
+		d.err = ErrBadV3Packet
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *v3Decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = ErrBadV3Packet
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	var n = binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	var n = binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// 根据第一个字节判断V2还是V3协议
+func DetectVersion(b byte) int {
+	if b == V3Magic {
+		return VersionV3
+	}
+	return VersionV2
+}
+
+// 兼容V2和V3的编码，按指定的版本编码，解码时根据第一个字节自动识别，用于从V2逐步迁移到V3
+type codecCompat struct {
+	writer Encoder
+	v2     Encoder
+	v3     Encoder
+}
+
+func NewCompatEncoder(version, threshold int, opts ...EncoderOption) Encoder {
+	var c = &codecCompat{
+		v2: NewV2Encoder(threshold, opts...),
+		v3: NewV3Encoder(threshold, opts...),
+	}
+	c.writer = c.v2
+	if version >= VersionV3 {
+		c.writer = c.v3
+	}
+	return c
+}
+
+// 按双方都支持的最高版本编码，remoteVersion是对端Encoder.Version()的值，
+// 沿用local的压缩阈值和编码选项，没有可用的版本时返回nil
+func Negotiate(local Encoder, remoteVersion int) Encoder {
+	var version = local.Version()
+	if remoteVersion < version {
+		version = remoteVersion
+	}
+	var threshold, opts = encoderSettings(local)
+	switch {
+	case version >= VersionV2:
+		return NewCompatEncoder(version, threshold, opts...)
+	case version == VersionV1:
+		return NewV1Encoder(threshold, opts...)
+	default:
+		return GetEncoderByVersion(version)
+	}
+}
+
+// 取出encoder的压缩阈值和编码选项
+func encoderSettings(enc Encoder) (int, []EncoderOption) {
+	var threshold int
+	var compress uint8
+	switch c := enc.(type) {
+	case *codecV1:
+		threshold, compress = c.threshold, c.compress
+	case *codecV2:
+		threshold, compress = c.threshold, c.compress
+	case *codecV3:
+		threshold, compress = c.threshold, c.compress
+	case *codecCompat:
+		return encoderSettings(c.writer)
+	default:
+		return 0, nil
+	}
+	return threshold, []EncoderOption{WithCompression(compress)}
+}
+
+func (c *codecCompat) Name() string {
+	return "Compat"
+}
+
+// 编码使用的版本
+func (c *codecCompat) Version() int {
+	return c.writer.Version()
+}
+
+func (c *codecCompat) WritePacket(w io.Writer, encrypt cipher.BlockCryptor, pkt fatchoy.IPacket) (int, error) {
+	return c.writer.WritePacket(w, encrypt, pkt)
+}
+
+func (c *codecCompat) ReadHeadBody(r io.Reader) ([]byte, []byte, error) {
+	var buf = getReadBuffer(V2HeaderSize)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		bufpool.Put(buf)
+		return nil, nil, err
+	}
+	if DetectVersion(buf[0]) == VersionV3 {
+		return readV3HeadBody(r, buf[:1])
+	}
+	if _, err := io.ReadFull(r, buf[1:]); err != nil {
+		bufpool.Put(buf)
+		return nil, nil, err
+	}
+	return readV2Payload(r, buf)
+}
+
+func (c *codecCompat) UnmarshalPacket(header, body []byte, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+	if len(header) > 0 && DetectVersion(header[0]) == VersionV3 {
+		return c.v3.UnmarshalPacket(header, body, decrypt, pkt)
+	}
+	return c.v2.UnmarshalPacket(header, body, decrypt, pkt)
+}
+
+func (c *codecCompat) ReadPacket(r io.Reader, decrypt cipher.BlockCryptor, pkt fatchoy.IPacket) error {
+	head, body, err := c.ReadHeadBody(r)
+	if err != nil {
+		return err
+	}
+	return c.UnmarshalPacket(head, body, decrypt, pkt)
+}
@@ -0,0 +1,191 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"testing"
+
+	"qchen.fun/fatchoy"
+)
+
+// 用V2和V3编解码同一个packet，结果应该一致
+func roundTripV2V3(t testing.TB, pkt *testPacket) (*testPacket, *testPacket) {
+	var recv [2]*testPacket
+	for i, c := range []Encoder{NewV2Encoder(0), NewV3Encoder(0)} {
+		var sent = *pkt
+		var w bytes.Buffer
+		if _, err := c.WritePacket(&w, nil, &sent); err != nil {
+			t.Fatalf("%s Encode: %v", c.Name(), err)
+		}
+		recv[i] = &testPacket{}
+		if err := c.ReadPacket(&w, nil, recv[i]); err != nil {
+			t.Fatalf("%s Decode: %v", c.Name(), err)
+		}
+		if w.Len() != 0 {
+			t.Fatalf("%s: %d bytes left", c.Name(), w.Len())
+		}
+	}
+	return recv[0], recv[1]
+}
+
+func TestCodecV3RoundTrip(t *testing.T) {
+	var ext = &fatchoy.PacketExt{
+		CorrelationID: 0xfedcba98,
+		Metadata:      map[string]string{"token": "abc", "empty": ""},
+		StreamID:      7,
+		StreamFlag:    3,
+		TraceID:       "4bf92f3577b34da6a3ce929d0e0e4736",
+		Deadline:      1634400000123,
+	}
+	tests := []*testPacket{
+		{command: 1234, seq: 5678, node: 0x010002, body: []byte("hello")},
+		{command: -1, seq: 0xffff, node: 0xffffffff, typ: fatchoy.PTypeMulticast, refer: []fatchoy.NodeID{1, 0xffffffff, 3}},
+		{command: 0x7fffffff, flag: fatchoy.PFlagRpc, ext: ext, body: bytes.Repeat([]byte("fatchoy"), 2000)},
+		{command: 1, flag: fatchoy.PFlagRpc, ext: &fatchoy.PacketExt{CorrelationID: 1}},
+	}
+	for i, pkt := range tests {
+		v2, v3 := roundTripV2V3(t, pkt)
+		if !reflect.DeepEqual(v2, v3) {
+			t.Fatalf("case %d: V2 and V3 not equal\n%+v\n%+v", i, v2, v3)
+		}
+		if v3.command != pkt.command || v3.seq != pkt.seq || v3.node != pkt.node || v3.typ != pkt.typ ||
+			v3.flag != pkt.flag || !bytes.Equal(v3.body, setBody(pkt.body)) || len(v3.refer) != len(pkt.refer) {
+			t.Fatalf("case %d: packet not equal\n%+v\n%+v", i, pkt, v3)
+		}
+		if !pkt.ext.IsEmpty() && !reflect.DeepEqual(pkt.ext, v3.ext) {
+			t.Fatalf("case %d: extension not equal\n%+v\n%+v", i, pkt.ext, v3.ext)
+		}
+	}
+
+	// 小包的头部比V2小
+	var w2, w3 bytes.Buffer
+	NewV2Encoder(0).WritePacket(&w2, nil, &testPacket{command: 100, seq: 1})
+	NewV3Encoder(0).WritePacket(&w3, nil, &testPacket{command: 100, seq: 1})
+	if w3.Len() >= w2.Len() {
+		t.Fatalf("V3 size %d >= V2 size %d", w3.Len(), w2.Len())
+	}
+}
+
+func TestCodecV3Encrypt(t *testing.T) {
+	for _, n := range []int{0, 100, 10000} {
+		testProtoCodec(t, n, newTestPacket(n), NewV3Encoder(0))
+	}
+}
+
+func TestCodecV3Malformed(t *testing.T) {
+	var c = NewV3Encoder(0)
+	var w bytes.Buffer
+	var pkt = &testPacket{command: 1, refer: []fatchoy.NodeID{1, 2}, ext: &fatchoy.PacketExt{CorrelationID: 1}}
+	if _, err := c.WritePacket(&w, nil, pkt); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var data = w.Bytes()
+	for i := 0; i < len(data); i++ {
+		if _, _, err := c.ReadHeadBody(bytes.NewReader(data[:i])); err == nil {
+			t.Fatalf("truncated at %d should fail", i)
+		}
+	}
+	head, body, err := c.ReadHeadBody(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadHeadBody: %v", err)
+	}
+	// 校验和正确，但是内容被截断
+	for i := 0; i < len(body); i++ {
+		var h = append([]byte(nil), head...)
+		var payload = body[:i]
+		var crc = crc32Checksum(payload)
+		copy(h[len(h)-4:], crc[:])
+		if err := c.UnmarshalPacket(h, payload, nil, &testPacket{}); !errors.Is(err, ErrBadV3Packet) && !errors.Is(err, ErrBadExtension) {
+			t.Fatalf("truncated payload at %d: unexpected error %v", i, err)
+		}
+	}
+	if _, _, err := c.ReadHeadBody(bytes.NewReader([]byte{0x01, 0x02})); !errors.Is(err, ErrBadV3Packet) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := c.ReadHeadBody(bytes.NewReader([]byte{V3Magic, 0xff, 0xff, 0xff, 0xff, 0xff})); !errors.Is(err, ErrBadV3Packet) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCodecNegotiate(t *testing.T) {
+	if enc := GetEncoderByVersion(VersionV3); enc == nil || enc.Name() != "V3" {
+		t.Fatalf("unexpected encoder %v", enc)
+	}
+	var v2 = Negotiate(NewV3Encoder(0), VersionV2)
+	var v3 = Negotiate(NewV3Encoder(0), VersionV3)
+	if v2.Version() != VersionV2 || v3.Version() != VersionV3 {
+		t.Fatalf("unexpected version %d, %d", v2.Version(), v3.Version())
+	}
+	if enc := Negotiate(NewV2Encoder(0), VersionV1); enc.Version() != VersionV1 {
+		t.Fatalf("unexpected version %d", enc.Version())
+	}
+
+	// 同一个连接上混合V2和V3的包
+	var w bytes.Buffer
+	for i := 0; i < 10; i++ {
+		var enc = v2
+		if i%2 == 1 {
+			enc = v3
+		}
+		var pkt = &testPacket{command: int32(i), seq: uint16(i), body: []byte("hello")}
+		if _, err := enc.WritePacket(&w, nil, pkt); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		var pkt testPacket
+		if err := v2.ReadPacket(&w, nil, &pkt); err != nil {
+			t.Fatalf("Decode #%d: %v", i, err)
+		}
+		if pkt.command != int32(i) || pkt.seq != uint16(i) || !bytes.Equal(pkt.body, setBody([]byte("hello"))) {
+			t.Fatalf("unexpected packet #%d: %+v", i, pkt)
+		}
+	}
+}
+
+// testPacket.SetBody会用gob编码
+func setBody(body []byte) []byte {
+	if len(body) == 0 {
+		return nil
+	}
+	var pkt testPacket
+	pkt.SetBody(body)
+	return pkt.body
+}
+
+func crc32Checksum(data []byte) [4]byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], crc32.ChecksumIEEE(data))
+	return b
+}
+
+// 协商的encoder沿用本地的压缩阈值和算法
+func TestCodecNegotiateSettings(t *testing.T) {
+	var local = NewV3Encoder(16, WithCompression(CompressLZ4))
+	var body = bytes.Repeat([]byte("hello"), 10)
+	for _, version := range []int{VersionV1, VersionV2, VersionV3} {
+		var enc = Negotiate(local, version)
+		var pkt = &testPacket{command: 1, body: body}
+		var w bytes.Buffer
+		if _, err := enc.WritePacket(&w, nil, pkt); err != nil {
+			t.Fatalf("v%d Encode: %v", version, err)
+		}
+		if pkt.flag&fatchoy.PFlagCompressed == 0 || uint8(pkt.flag&fatchoy.PFlagCompressMask)>>compressShift != CompressLZ4 {
+			t.Fatalf("v%d packet should be compressed by LZ4, flag %x", version, pkt.flag)
+		}
+		var decoded testPacket
+		if err := enc.ReadPacket(&w, nil, &decoded); err != nil {
+			t.Fatalf("v%d Decode: %v", version, err)
+		}
+		if !bytes.Equal(decoded.body, setBody(body)) {
+			t.Fatalf("v%d body mismatch", version)
+		}
+	}
+}
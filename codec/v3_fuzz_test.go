@@ -0,0 +1,61 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+//go:build go1.18
+// +build go1.18
+
+package codec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"qchen.fun/fatchoy"
+)
+
+// 任意输入都不应该panic
+func FuzzCodecV3Decode(f *testing.F) {
+	var w bytes.Buffer
+	var pkt = &testPacket{command: 1, seq: 2, refer: []fatchoy.NodeID{3}, body: []byte("hello"),
+		ext: &fatchoy.PacketExt{CorrelationID: 4, Metadata: map[string]string{"k": "v"}}}
+	NewV3Encoder(0).WritePacket(&w, nil, pkt)
+	f.Add(w.Bytes())
+	f.Add([]byte{V3Magic, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var c = NewCompatEncoder(VersionV3, 0)
+		head, body, err := c.ReadHeadBody(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		c.UnmarshalPacket(head, body, nil, &testPacket{})
+	})
+}
+
+// V2和V3编解码的结果一致
+func FuzzCodecV3RoundTrip(f *testing.F) {
+	f.Add(int32(1234), uint16(5678), uint32(0x010002), uint8(0), uint32(0), "", "", []byte("hello"))
+	f.Add(int32(-1), uint16(0xffff), uint32(0xffffffff), uint8(fatchoy.PFlagRpc), uint32(0xffffffff), "token", "abc", []byte{})
+	f.Fuzz(func(t *testing.T, cmd int32, seq uint16, node uint32, flag uint8, corrId uint32, key, value string, body []byte) {
+		if len(key)+len(value) >= 255 {
+			return // V2的元数据限制
+		}
+		var pkt = &testPacket{
+			command: cmd,
+			seq:     seq,
+			node:    fatchoy.NodeID(node),
+			flag:    fatchoy.PacketFlag(flag) & (fatchoy.PFlagRpc | fatchoy.PFlagError),
+			refer:   []fatchoy.NodeID{fatchoy.NodeID(node), fatchoy.NodeID(corrId)},
+			body:    body,
+			ext:     &fatchoy.PacketExt{CorrelationID: corrId},
+		}
+		if key != "" {
+			pkt.ext.Metadata = map[string]string{key: value}
+		}
+		v2, v3 := roundTripV2V3(t, pkt)
+		if !reflect.DeepEqual(v2, v3) {
+			t.Fatalf("V2 and V3 not equal\n%+v\n%+v", v2, v3)
+		}
+	})
+}
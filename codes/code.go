@@ -41,6 +41,11 @@ func (c Code) String() string {
 	return "??"
 }
 
+// 实现error接口，可以直接作为错误返回
+func (c Code) Error() string {
+	return c.String()
+}
+
 var codeName = map[int32]string{
 	0:  "OK",
 	1:  "UNKNOWN",
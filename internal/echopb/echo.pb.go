@@ -0,0 +1,474 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.26.0
+// 	protoc        (unknown)
+// source: internal/echopb/echo.proto
+
+package echopb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	_ "qchen.fun/fatchoy/internal/testpb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type PingReq struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Text string `protobuf:"bytes,1,opt,name=text,proto3" json:"text,omitempty"`
+}
+
+func (x *PingReq) Reset() {
+	*x = PingReq{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_echopb_echo_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PingReq) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PingReq) ProtoMessage() {}
+
+func (x *PingReq) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_echopb_echo_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PingReq.ProtoReflect.Descriptor instead.
+func (*PingReq) Descriptor() ([]byte, []int) {
+	return file_internal_echopb_echo_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *PingReq) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+type PingAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Text string `protobuf:"bytes,1,opt,name=text,proto3" json:"text,omitempty"`
+}
+
+func (x *PingAck) Reset() {
+	*x = PingAck{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_echopb_echo_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *PingAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PingAck) ProtoMessage() {}
+
+func (x *PingAck) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_echopb_echo_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PingAck.ProtoReflect.Descriptor instead.
+func (*PingAck) Descriptor() ([]byte, []int) {
+	return file_internal_echopb_echo_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *PingAck) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+type WatchReq struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Count int32 `protobuf:"varint,1,opt,name=count,proto3" json:"count,omitempty"`
+}
+
+func (x *WatchReq) Reset() {
+	*x = WatchReq{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_echopb_echo_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WatchReq) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchReq) ProtoMessage() {}
+
+func (x *WatchReq) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_echopb_echo_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchReq.ProtoReflect.Descriptor instead.
+func (*WatchReq) Descriptor() ([]byte, []int) {
+	return file_internal_echopb_echo_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *WatchReq) GetCount() int32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+type WatchNtf struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Seq int32 `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+}
+
+func (x *WatchNtf) Reset() {
+	*x = WatchNtf{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_echopb_echo_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *WatchNtf) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchNtf) ProtoMessage() {}
+
+func (x *WatchNtf) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_echopb_echo_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchNtf.ProtoReflect.Descriptor instead.
+func (*WatchNtf) Descriptor() ([]byte, []int) {
+	return file_internal_echopb_echo_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *WatchNtf) GetSeq() int32 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+type ChatReq struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Text string `protobuf:"bytes,1,opt,name=text,proto3" json:"text,omitempty"`
+}
+
+func (x *ChatReq) Reset() {
+	*x = ChatReq{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_echopb_echo_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ChatReq) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChatReq) ProtoMessage() {}
+
+func (x *ChatReq) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_echopb_echo_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChatReq.ProtoReflect.Descriptor instead.
+func (*ChatReq) Descriptor() ([]byte, []int) {
+	return file_internal_echopb_echo_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ChatReq) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+type ChatAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Text string `protobuf:"bytes,1,opt,name=text,proto3" json:"text,omitempty"`
+}
+
+func (x *ChatAck) Reset() {
+	*x = ChatAck{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_internal_echopb_echo_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ChatAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ChatAck) ProtoMessage() {}
+
+func (x *ChatAck) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_echopb_echo_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ChatAck.ProtoReflect.Descriptor instead.
+func (*ChatAck) Descriptor() ([]byte, []int) {
+	return file_internal_echopb_echo_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ChatAck) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+var File_internal_echopb_echo_proto protoreflect.FileDescriptor
+
+var file_internal_echopb_echo_proto_rawDesc = []byte{
+	0x0a, 0x1a, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x65, 0x63, 0x68, 0x6f, 0x70,
+	0x62, 0x2f, 0x65, 0x63, 0x68, 0x6f, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x06, 0x65, 0x63,
+	0x68, 0x6f, 0x70, 0x62, 0x1a, 0x1a, 0x69, 0x6e, 0x74, 0x65, 0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x74,
+	0x65, 0x73, 0x74, 0x70, 0x62, 0x2f, 0x74, 0x65, 0x73, 0x74, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x22, 0x24, 0x0a, 0x07, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x12, 0x12, 0x0a, 0x04, 0x74,
+	0x65, 0x78, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x65, 0x78, 0x74, 0x3a,
+	0x05, 0x88, 0xb5, 0x18, 0xd1, 0x0f, 0x22, 0x24, 0x0a, 0x07, 0x50, 0x69, 0x6e, 0x67, 0x41, 0x63,
+	0x6b, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x78, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x74, 0x65, 0x78, 0x74, 0x3a, 0x05, 0x88, 0xb5, 0x18, 0xd2, 0x0f, 0x22, 0x27, 0x0a, 0x08,
+	0x57, 0x61, 0x74, 0x63, 0x68, 0x52, 0x65, 0x71, 0x12, 0x14, 0x0a, 0x05, 0x63, 0x6f, 0x75, 0x6e,
+	0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x05, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x3a, 0x05,
+	0x88, 0xb5, 0x18, 0xd3, 0x0f, 0x22, 0x23, 0x0a, 0x08, 0x57, 0x61, 0x74, 0x63, 0x68, 0x4e, 0x74,
+	0x66, 0x12, 0x10, 0x0a, 0x03, 0x73, 0x65, 0x71, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x03,
+	0x73, 0x65, 0x71, 0x3a, 0x05, 0x88, 0xb5, 0x18, 0xd4, 0x0f, 0x22, 0x24, 0x0a, 0x07, 0x43, 0x68,
+	0x61, 0x74, 0x52, 0x65, 0x71, 0x12, 0x12, 0x0a, 0x04, 0x74, 0x65, 0x78, 0x74, 0x18, 0x01, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x65, 0x78, 0x74, 0x3a, 0x05, 0x88, 0xb5, 0x18, 0xd5, 0x0f,
+	0x22, 0x24, 0x0a, 0x07, 0x43, 0x68, 0x61, 0x74, 0x41, 0x63, 0x6b, 0x12, 0x12, 0x0a, 0x04, 0x74,
+	0x65, 0x78, 0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x74, 0x65, 0x78, 0x74, 0x3a,
+	0x05, 0x88, 0xb5, 0x18, 0xd6, 0x0f, 0x32, 0x8d, 0x01, 0x0a, 0x04, 0x45, 0x63, 0x68, 0x6f, 0x12,
+	0x28, 0x0a, 0x04, 0x50, 0x69, 0x6e, 0x67, 0x12, 0x0f, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x70, 0x62,
+	0x2e, 0x50, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x1a, 0x0f, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x70,
+	0x62, 0x2e, 0x50, 0x69, 0x6e, 0x67, 0x41, 0x63, 0x6b, 0x12, 0x2d, 0x0a, 0x05, 0x57, 0x61, 0x74,
+	0x63, 0x68, 0x12, 0x10, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x70, 0x62, 0x2e, 0x57, 0x61, 0x74, 0x63,
+	0x68, 0x52, 0x65, 0x71, 0x1a, 0x10, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x70, 0x62, 0x2e, 0x57, 0x61,
+	0x74, 0x63, 0x68, 0x4e, 0x74, 0x66, 0x30, 0x01, 0x12, 0x2c, 0x0a, 0x04, 0x43, 0x68, 0x61, 0x74,
+	0x12, 0x0f, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x70, 0x62, 0x2e, 0x43, 0x68, 0x61, 0x74, 0x52, 0x65,
+	0x71, 0x1a, 0x0f, 0x2e, 0x65, 0x63, 0x68, 0x6f, 0x70, 0x62, 0x2e, 0x43, 0x68, 0x61, 0x74, 0x41,
+	0x63, 0x6b, 0x28, 0x01, 0x30, 0x01, 0x42, 0x23, 0x5a, 0x21, 0x71, 0x63, 0x68, 0x65, 0x6e, 0x2e,
+	0x66, 0x75, 0x6e, 0x2f, 0x66, 0x61, 0x74, 0x63, 0x68, 0x6f, 0x79, 0x2f, 0x69, 0x6e, 0x74, 0x65,
+	0x72, 0x6e, 0x61, 0x6c, 0x2f, 0x65, 0x63, 0x68, 0x6f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f,
+	0x74, 0x6f, 0x33,
+}
+
+var (
+	file_internal_echopb_echo_proto_rawDescOnce sync.Once
+	file_internal_echopb_echo_proto_rawDescData = file_internal_echopb_echo_proto_rawDesc
+)
+
+func file_internal_echopb_echo_proto_rawDescGZIP() []byte {
+	file_internal_echopb_echo_proto_rawDescOnce.Do(func() {
+		file_internal_echopb_echo_proto_rawDescData = protoimpl.X.CompressGZIP(file_internal_echopb_echo_proto_rawDescData)
+	})
+	return file_internal_echopb_echo_proto_rawDescData
+}
+
+var file_internal_echopb_echo_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_internal_echopb_echo_proto_goTypes = []interface{}{
+	(*PingReq)(nil),  // 0: echopb.PingReq
+	(*PingAck)(nil),  // 1: echopb.PingAck
+	(*WatchReq)(nil), // 2: echopb.WatchReq
+	(*WatchNtf)(nil), // 3: echopb.WatchNtf
+	(*ChatReq)(nil),  // 4: echopb.ChatReq
+	(*ChatAck)(nil),  // 5: echopb.ChatAck
+}
+var file_internal_echopb_echo_proto_depIdxs = []int32{
+	0, // 0: echopb.Echo.Ping:input_type -> echopb.PingReq
+	2, // 1: echopb.Echo.Watch:input_type -> echopb.WatchReq
+	4, // 2: echopb.Echo.Chat:input_type -> echopb.ChatReq
+	1, // 3: echopb.Echo.Ping:output_type -> echopb.PingAck
+	3, // 4: echopb.Echo.Watch:output_type -> echopb.WatchNtf
+	5, // 5: echopb.Echo.Chat:output_type -> echopb.ChatAck
+	3, // [3:6] is the sub-list for method output_type
+	0, // [0:3] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_internal_echopb_echo_proto_init() }
+func file_internal_echopb_echo_proto_init() {
+	if File_internal_echopb_echo_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_internal_echopb_echo_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PingReq); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_echopb_echo_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*PingAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_echopb_echo_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchReq); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_echopb_echo_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*WatchNtf); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_echopb_echo_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ChatReq); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_internal_echopb_echo_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ChatAck); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_internal_echopb_echo_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_internal_echopb_echo_proto_goTypes,
+		DependencyIndexes: file_internal_echopb_echo_proto_depIdxs,
+		MessageInfos:      file_internal_echopb_echo_proto_msgTypes,
+	}.Build()
+	File_internal_echopb_echo_proto = out.File
+	file_internal_echopb_echo_proto_rawDesc = nil
+	file_internal_echopb_echo_proto_goTypes = nil
+	file_internal_echopb_echo_proto_depIdxs = nil
+}
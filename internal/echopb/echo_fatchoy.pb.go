@@ -0,0 +1,139 @@
+// Code generated by protoc-gen-fatchoy. DO NOT EDIT.
+// source: internal/echopb/echo.proto
+
+package echopb
+
+import (
+	context "context"
+	fatchoy "qchen.fun/fatchoy"
+	qnet "qchen.fun/fatchoy/qnet"
+)
+
+// Echo服务的客户端
+type EchoClient interface {
+	Ping(ctx context.Context, node fatchoy.NodeID, req *PingReq, opts ...qnet.CallOption) (*PingAck, error)
+	Watch(ctx context.Context, node fatchoy.NodeID, req *WatchReq, opts ...qnet.CallOption) (*Echo_WatchClient, error)
+	Chat(ctx context.Context, node fatchoy.NodeID, req *ChatReq, opts ...qnet.CallOption) (*Echo_ChatClient, error)
+}
+
+type echoClient struct {
+	client *qnet.RpcClient
+}
+
+func NewEchoClient(client *qnet.RpcClient) EchoClient {
+	return &echoClient{client: client}
+}
+
+func (c *echoClient) Ping(ctx context.Context, node fatchoy.NodeID, req *PingReq, opts ...qnet.CallOption) (*PingAck, error) {
+	var ack = new(PingAck)
+	if err := c.client.Invoke(ctx, node, req, ack, opts...); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+func (c *echoClient) Watch(ctx context.Context, node fatchoy.NodeID, req *WatchReq, opts ...qnet.CallOption) (*Echo_WatchClient, error) {
+	stream, err := c.client.OpenServerStream(ctx, node, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Echo_WatchClient{stream}, nil
+}
+
+// Echo.Watch的客户端流
+type Echo_WatchClient struct {
+	*qnet.RpcStream
+}
+
+func (x *Echo_WatchClient) Recv() (*WatchNtf, error) {
+	msg, err := x.RpcStream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := msg.(*WatchNtf); ok {
+		return m, nil
+	}
+	return nil, qnet.ErrStreamUnexpectedMsg
+}
+
+func (c *echoClient) Chat(ctx context.Context, node fatchoy.NodeID, req *ChatReq, opts ...qnet.CallOption) (*Echo_ChatClient, error) {
+	stream, err := c.client.OpenStream(ctx, node, req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Echo_ChatClient{stream}, nil
+}
+
+// Echo.Chat的客户端流
+type Echo_ChatClient struct {
+	*qnet.RpcStream
+}
+
+func (x *Echo_ChatClient) Send(m *ChatReq) error {
+	return x.RpcStream.Send(m)
+}
+
+func (x *Echo_ChatClient) Recv() (*ChatAck, error) {
+	msg, err := x.RpcStream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := msg.(*ChatAck); ok {
+		return m, nil
+	}
+	return nil, qnet.ErrStreamUnexpectedMsg
+}
+
+// Echo服务的服务端接口
+type EchoServer interface {
+	Ping(ctx context.Context, req *PingReq) (*PingAck, error)
+	Watch(ctx context.Context, req *WatchReq, stream *Echo_WatchServer) error
+	Chat(ctx context.Context, req *ChatReq, stream *Echo_ChatServer) error
+}
+
+// 把srv的方法注册到RpcServer
+func RegisterEchoServer(s *qnet.RpcServer, srv EchoServer) error {
+	if err := s.Register(srv.Ping); err != nil {
+		return err
+	}
+	if err := s.RegisterStream(func(ctx context.Context, req *WatchReq, stream *qnet.RpcStream) error {
+		return srv.Watch(ctx, req, &Echo_WatchServer{stream})
+	}); err != nil {
+		return err
+	}
+	if err := s.RegisterStream(func(ctx context.Context, req *ChatReq, stream *qnet.RpcStream) error {
+		return srv.Chat(ctx, req, &Echo_ChatServer{stream})
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Echo.Watch的服务端流
+type Echo_WatchServer struct {
+	*qnet.RpcStream
+}
+
+func (x *Echo_WatchServer) Send(m *WatchNtf) error {
+	return x.RpcStream.Send(m)
+}
+
+// Echo.Chat的服务端流
+type Echo_ChatServer struct {
+	*qnet.RpcStream
+}
+
+func (x *Echo_ChatServer) Send(m *ChatAck) error {
+	return x.RpcStream.Send(m)
+}
+
+func (x *Echo_ChatServer) Recv() (*ChatReq, error) {
+	msg, err := x.RpcStream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := msg.(*ChatReq); ok {
+		return m, nil
+	}
+	return nil, qnet.ErrStreamUnexpectedMsg
+}
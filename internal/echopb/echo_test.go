@@ -0,0 +1,155 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package echopb
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/packet"
+	"qchen.fun/fatchoy/qnet"
+)
+
+var registerOnce sync.Once
+
+type echoServer struct{}
+
+func (s *echoServer) Ping(ctx context.Context, req *PingReq) (*PingAck, error) {
+	if req.Text == "bad" {
+		return nil, codes.BadRequest
+	}
+	return &PingAck{Text: req.Text}, nil
+}
+
+func (s *echoServer) Watch(ctx context.Context, req *WatchReq, stream *Echo_WatchServer) error {
+	for i := int32(1); i <= req.Count; i++ {
+		if err := stream.Send(&WatchNtf{Seq: i}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *echoServer) Chat(ctx context.Context, req *ChatReq, stream *Echo_ChatServer) error {
+	for {
+		if err := stream.Send(&ChatAck{Text: req.Text}); err != nil {
+			return err
+		}
+		var err error
+		if req, err = stream.Recv(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func startEchoServer(t *testing.T) (EchoClient, func()) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	conn1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn2, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	var inbound = make(chan fatchoy.IPacket, 10)
+	var enc = codec.NewV2Encoder(0)
+	var a = qnet.NewTcpConn(1, conn1, enc, nil, inbound, 100, nil)
+	var b = qnet.NewTcpConn(2, conn2, enc, nil, inbound, 100, nil)
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+
+	var server = qnet.NewRpcServer()
+	if err := RegisterEchoServer(server, &echoServer{}); err != nil {
+		t.Fatalf("RegisterEchoServer: %v", err)
+	}
+	var ctx, cancel = context.WithCancel(context.Background())
+	var client = qnet.NewRpcClient(ctx, 10)
+	client.Go()
+	go func() {
+		for {
+			select {
+			case pkt := <-client.PendingQueue():
+				a.SendPacket(pkt)
+			case pkt := <-inbound:
+				if pkt.Endpoint() == b {
+					server.Dispatch(ctx, pkt)
+				} else {
+					client.Dispatch(pkt)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return NewEchoClient(client), func() {
+		cancel()
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestEchoStubs(t *testing.T) {
+	registerOnce.Do(func() { packet.RegisterMsgID("testpb.msg_id") })
+	client, stop := startEchoServer(t)
+	defer stop()
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ack, err := client.Ping(ctx, 1, &PingReq{Text: "hello"})
+	if err != nil || ack.Text != "hello" {
+		t.Fatalf("Ping: %v, %v", ack, err)
+	}
+	if _, err := client.Ping(ctx, 1, &PingReq{Text: "bad"}); err != codes.BadRequest {
+		t.Fatalf("Ping: unexpected error %v", err)
+	}
+
+	watch, err := client.Watch(ctx, 1, &WatchReq{Count: 3})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	for i := int32(1); i <= 3; i++ {
+		ntf, err := watch.Recv()
+		if err != nil || ntf.Seq != i {
+			t.Fatalf("Watch Recv: %v, %v", ntf, err)
+		}
+	}
+	if _, err := watch.Recv(); err != io.EOF {
+		t.Fatalf("Watch Recv: unexpected error %v", err)
+	}
+
+	chat, err := client.Chat(ctx, 1, &ChatReq{Text: "a"})
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	for _, text := range []string{"a", "b", "c"} {
+		if text != "a" {
+			if err := chat.Send(&ChatReq{Text: text}); err != nil {
+				t.Fatalf("Chat Send: %v", err)
+			}
+		}
+		ack, err := chat.Recv()
+		if err != nil || ack.Text != text {
+			t.Fatalf("Chat Recv: %v, %v", ack, err)
+		}
+	}
+	chat.CloseSend()
+	if _, err := chat.Recv(); err != io.EOF {
+		t.Fatalf("Chat Recv: unexpected error %v", err)
+	}
+}
@@ -59,8 +59,22 @@ func (n NodeID) Instance() uint16 {
 	return uint16(n)
 }
 
+// 是否广播节点，服务号为SERVICE_ALL或者实例号为INSTANCE_ALL
+func (n NodeID) IsBroadcast() bool {
+	return n.IsTypeBackend() && (n.Service() == SERVICE_ALL || n.Instance() == INSTANCE_ALL)
+}
+
+// 节点node是否匹配n，n的服务号为SERVICE_ALL时匹配所有服务，实例号为INSTANCE_ALL时匹配所有实例
+func (n NodeID) Match(node NodeID) bool {
+	if !n.IsTypeBackend() || !node.IsTypeBackend() {
+		return n == node
+	}
+	return (n.Service() == SERVICE_ALL || n.Service() == node.Service()) &&
+		(n.Instance() == INSTANCE_ALL || n.Instance() == node.Instance())
+}
+
 func (n NodeID) String() string {
-	return fmt.Sprintf("%02x%04x", int8(n.Service()), n.Instance())
+	return fmt.Sprintf("%02x%04x", n.Service(), n.Instance())
 }
 
 // 没有重复ID的有序集合
@@ -49,3 +49,46 @@ func TestNodeIDSet(t *testing.T) {
 		set = set.Insert(int32(i))
 	}
 }
+
+func TestNodeIDMatch(t *testing.T) {
+	var node = MakeNodeID(0x12, 0x34)
+	tests := []struct {
+		target    NodeID
+		broadcast bool
+		match     bool
+	}{
+		{node, false, true},
+		{MakeNodeID(0x12, 0x35), false, false},
+		{MakeNodeID(0x12, INSTANCE_ALL), true, true},
+		{MakeNodeID(0x13, INSTANCE_ALL), true, false},
+		{MakeNodeID(SERVICE_ALL, 0x34), true, true},
+		{MakeNodeID(SERVICE_ALL, INSTANCE_ALL), true, true},
+	}
+	for i, tc := range tests {
+		if v := tc.target.IsBroadcast(); v != tc.broadcast {
+			t.Fatalf("case %d: %v broadcast expect %v, got %v", i, tc.target, tc.broadcast, v)
+		}
+		if v := tc.target.Match(node); v != tc.match {
+			t.Fatalf("case %d: %v match %v expect %v, got %v", i, tc.target, node, tc.match, v)
+		}
+	}
+}
+
+func TestNodeIDString(t *testing.T) {
+	tests := []struct {
+		node NodeID
+		text string
+	}{
+		{MakeNodeID(0x12, 0x34), "120034"},
+		{MakeNodeID(0xab, 0xcdef), "abcdef"},
+		{MakeNodeID(0x80, 0x01), "800001"},
+	}
+	for _, tc := range tests {
+		if s := tc.node.String(); s != tc.text {
+			t.Fatalf("%d: expect %s, got %s", uint32(tc.node), tc.text, s)
+		}
+		if n := MustParseNodeID(tc.node.String()); n != tc.node {
+			t.Fatalf("parse %s: expect %d, got %d", tc.text, tc.node, n)
+		}
+	}
+}
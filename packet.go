@@ -12,10 +12,12 @@ import (
 type PacketFlag uint8
 
 const (
-	PFlagCompressed PacketFlag = 0x01 // 压缩
-	PFlagEncrypted  PacketFlag = 0x02 // 加密
-	PFlagError      PacketFlag = 0x10 // 错误标记
-	PFlagRpc        PacketFlag = 0x20 // RPC标记
+	PFlagCompressed   PacketFlag = 0x01 // 压缩
+	PFlagEncrypted    PacketFlag = 0x02 // 加密
+	PFlagCompressMask PacketFlag = 0x0C // 压缩算法，由codec设置
+	PFlagError        PacketFlag = 0x10 // 错误标记
+	PFlagRpc          PacketFlag = 0x20 // RPC标记
+	PFlagExtension    PacketFlag = 0x40 // 有扩展字段，由codec设置
 )
 
 // 消息编码类型
@@ -27,6 +29,21 @@ const (
 	PTypeMulticast PacketType = 2 // 组播消息
 )
 
+// 消息扩展字段，V2和V3协议编码在refer和body之间，以明文传输，不会被加密
+type PacketExt struct {
+	CorrelationID uint32            `json:"corr_id,omitempty"`     // RPC关联ID，用于匹配请求和响应，比seq的范围更大
+	Metadata      map[string]string `json:"metadata,omitempty"`    // 元数据，如租户、灰度标记等，明文传输
+	StreamID      uint32            `json:"stream_id,omitempty"`   // 流式RPC的流ID
+	StreamFlag    uint8             `json:"stream_flag,omitempty"` // 流式RPC的帧标记
+	TraceID       string            `json:"trace_id,omitempty"`    // 调用链追踪ID
+	Deadline      int64             `json:"deadline,omitempty"`    // 请求的截止时间，unix毫秒
+}
+
+func (e *PacketExt) IsEmpty() bool {
+	return e == nil || (e.CorrelationID == 0 && len(e.Metadata) == 0 && e.StreamID == 0 &&
+		e.TraceID == "" && e.Deadline == 0)
+}
+
 // 消息处理器
 type PacketHandler func(IPacket) error
 
@@ -61,6 +78,10 @@ type IPacket interface {
 	SetRefers([]NodeID)
 	AddRefers(...NodeID)
 
+	// 扩展字段，没有时返回nil
+	Extension() *PacketExt
+	SetExtension(*PacketExt)
+
 	// 绑定的endpoint
 	Endpoint() MessageEndpoint
 	SetEndpoint(MessageEndpoint)
@@ -68,6 +89,9 @@ type IPacket interface {
 	// clone一个packet
 	Clone() IPacket
 
+	// 放回对象池，调用后不能再使用
+	Release()
+
 	// 消息body，仅支持int64/float64/string/bytes/proto.Message类型
 	Body() interface{}
 	SetBody(v interface{})
@@ -6,9 +6,11 @@ package packet
 
 import (
 	"fmt"
+	"sync"
 
 	"google.golang.org/protobuf/proto"
 	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/x/bufpool"
 )
 
 // Packet表示一个应用层消息
@@ -20,11 +22,18 @@ type Packet struct {
 	Node_    fatchoy.NodeID          `json:"node,omitempty"` // 源/目标节点
 	Body_    interface{}             `json:"body,omitempty"` // 消息内容，int64/float64/string/bytes/proto.Message
 	Refers_  []fatchoy.NodeID        `json:"ref,omitempty"`  // 组播session列表
+	Ext_     *fatchoy.PacketExt      `json:"ext,omitempty"`  // 扩展字段
 	endpoint fatchoy.MessageEndpoint // 关联的endpoint
+	buf      []byte                  // 解码时body引用的缓冲区，Release时放回bufpool
 }
 
+var packetPool = sync.Pool{
+	New: func() interface{} { return new(Packet) },
+}
+
+// 从对象池获取，不调用Release也会被GC正常回收
 func Make() *Packet {
-	return &Packet{}
+	return packetPool.Get().(*Packet)
 }
 
 func New(command int32, seq uint16, flag fatchoy.PacketFlag, body interface{}) *Packet {
@@ -89,6 +98,14 @@ func (m *Packet) AddRefers(v ...fatchoy.NodeID) {
 	m.Refers_ = append(m.Refers_, v...)
 }
 
+func (m *Packet) Extension() *fatchoy.PacketExt {
+	return m.Ext_
+}
+
+func (m *Packet) SetExtension(ext *fatchoy.PacketExt) {
+	m.Ext_ = ext
+}
+
 func (m *Packet) Endpoint() fatchoy.MessageEndpoint {
 	return m.endpoint
 }
@@ -104,10 +121,29 @@ func (m *Packet) Reset() {
 	m.Type_ = 0
 	m.Node_ = 0
 	m.Refers_ = nil
+	m.Ext_ = nil
 	m.Body_ = nil
 	m.endpoint = nil
+	m.buf = nil
+}
+
+// 设置解码使用的缓冲区，body可能引用这块内存，Release时放回bufpool
+func (m *Packet) SetBuffer(buf []byte) {
+	m.buf = buf
+}
+
+// 把packet和它的缓冲区放回对象池，调用后不能再使用packet和它的body，
+// 包括Clone出来的packet的body
+func (m *Packet) Release() {
+	var buf = m.buf
+	m.Reset()
+	packetPool.Put(m)
+	if buf != nil {
+		bufpool.Put(buf)
+	}
 }
 
+// clone共享body，但不共享缓冲区
 func (m *Packet) Clone() fatchoy.IPacket {
 	var clone = Make()
 	clone.Cmd = m.Cmd
@@ -115,13 +151,14 @@ func (m *Packet) Clone() fatchoy.IPacket {
 	clone.Flg = m.Flg
 	clone.Type_ = m.Type_
 	clone.Refers_ = m.Refers_
+	clone.Ext_ = m.Ext_
 	clone.Body_ = m.Body_
 	return clone
 }
 
 func (m *Packet) Errno() int32 {
 	if (m.Flg & fatchoy.PFlagError) != 0 {
-		return m.Cmd
+		return int32(m.BodyToInt())
 	}
 	return 0
 }
@@ -138,9 +175,18 @@ func (m *Packet) ReplyWith(command int32, body interface{}) error {
 	pkt.Type_ = m.Type_
 	pkt.Node_ = m.Node_
 	pkt.Refers_ = m.Refers_
+	pkt.Ext_ = m.replyExt()
 	return m.endpoint.SendPacket(pkt)
 }
 
+// 响应带上请求的关联ID
+func (m *Packet) replyExt() *fatchoy.PacketExt {
+	if m.Ext_.IsEmpty() {
+		return nil
+	}
+	return &fatchoy.PacketExt{CorrelationID: m.Ext_.CorrelationID}
+}
+
 // 响应proto消息内容
 func (m *Packet) Reply(ack proto.Message) error {
 	var mid = GetMessageIDOf(ack)
@@ -164,6 +210,7 @@ func (m *Packet) RefuseWith(command, errno int32) error {
 	pkt.Type_ = m.Type_
 	pkt.Node_ = m.Node_
 	pkt.Refers_ = m.Refers_
+	pkt.Ext_ = m.replyExt()
 	pkt.SetErrno(errno)
 	return m.endpoint.SendPacket(pkt)
 }
@@ -56,19 +56,22 @@ func (m *Packet) SetBody(val interface{}) {
 	}
 }
 
-// 将body转为int64
+// 将body转为int64，bytes按小端解码，长度不对、类型不支持或者无法解析时返回0
 func (m *Packet) BodyToInt() int64 {
 	switch v := m.Body_.(type) {
+	case nil:
+		return 0
 	case int64:
 		return v
 	case float64:
 		return int64(v)
 	case string:
-		if n, err := strconv.ParseInt(v, 10, 64); err != nil {
-			panic(fmt.Sprintf("cannot convert packet %d body to int: %v", m.Cmd, err))
-		} else {
-			return n
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Errorf("cannot convert packet %d body to integer: %v", m.Cmd, err)
+			return 0
 		}
+		return n
 	case []byte:
 		switch len(v) {
 		case 0:
@@ -82,27 +85,31 @@ func (m *Packet) BodyToInt() int64 {
 		case 8:
 			return int64(binary.LittleEndian.Uint64(v))
 		default:
-			panic(fmt.Sprintf("cannot convert %d bytes to integer", len(v)))
+			log.Errorf("cannot convert packet %d body of %d bytes to integer", m.Cmd, len(v))
+			return 0
 		}
 	default:
-		panic(fmt.Sprintf("cannot convert %T to integer", v))
+		log.Errorf("cannot convert packet %d body %T to integer", m.Cmd, v)
+		return 0
 	}
-	return 0
 }
 
-// 将body转为float4
+// 将body转为float64，bytes按小端解码，长度不对、类型不支持或者无法解析时返回0
 func (m *Packet) BodyToFloat() float64 {
 	switch v := m.Body_.(type) {
+	case nil:
+		return 0
 	case int64:
 		return float64(v)
 	case float64:
 		return v
 	case string:
-		if f, err := strconv.ParseFloat(v, 64); err != nil {
-			panic(fmt.Sprintf("cannot convert packet %d body to float: %v", m.Cmd, err))
-		} else {
-			return f
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Errorf("cannot convert packet %d body to float: %v", m.Cmd, err)
+			return 0
 		}
+		return f
 	case []byte:
 		switch len(v) {
 		case 4:
@@ -111,23 +118,29 @@ func (m *Packet) BodyToFloat() float64 {
 		case 8:
 			b := binary.LittleEndian.Uint64(v)
 			return math.Float64frombits(b)
+		case 0:
+			return 0
 		default:
-			panic(fmt.Sprintf("cannot convert %d bytes to float", len(v)))
+			log.Errorf("cannot convert packet %d body of %d bytes to float", m.Cmd, len(v))
+			return 0
 		}
 	default:
-		panic(fmt.Sprintf("cannot convert %T to float", v))
+		log.Errorf("cannot convert packet %d body %T to float", m.Cmd, v)
+		return 0
 	}
 }
 
 // 将body转为string
 func (m *Packet) BodyToString() string {
 	switch v := m.Body_.(type) {
+	case nil:
+		return ""
 	case string:
 		return v
 	case []byte:
 		return string(v)
 	case int64:
-		return strconv.FormatInt(v, 64)
+		return strconv.FormatInt(v, 10)
 	case float64:
 		return strconv.FormatFloat(v, 'g', -1, 64)
 	case proto.Message:
@@ -152,6 +165,8 @@ func encodeUint64(n uint64) []byte {
 // 将body转为[]byte，用于网络传输
 func (m *Packet) BodyToBytes() []byte {
 	switch v := m.Body_.(type) {
+	case nil:
+		return nil
 	case string:
 		return []byte(v)
 	case []byte:
@@ -169,7 +184,6 @@ func (m *Packet) BodyToBytes() []byte {
 	default:
 		panic(fmt.Sprintf("cannot convert %T to bytes", v))
 	}
-	return nil
 }
 
 func (m *Packet) DecodeTo(msg proto.Message) error {
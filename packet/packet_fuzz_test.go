@@ -0,0 +1,58 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+//go:build go1.18
+// +build go1.18
+
+package packet
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// 从网络收到的bytes做类型转换不应该panic
+func FuzzBodyConversion(f *testing.F) {
+	f.Add(int32(1), []byte{})
+	f.Add(int32(2), []byte{1, 2, 3, 4})
+	f.Add(int32(3), []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	f.Add(int32(4), []byte("hello"))
+	f.Fuzz(func(t *testing.T, cmd int32, data []byte) {
+		var pkt = New(cmd, 0, 0, data)
+		pkt.BodyToInt()
+		pkt.BodyToFloat()
+		pkt.BodyToString()
+		pkt.Decode()
+		if !bytes.Equal(New(cmd, 0, 0, data).BodyToBytes(), data) {
+			t.Fatalf("bytes mismatch")
+		}
+	})
+}
+
+func FuzzBodyNumber(f *testing.F) {
+	f.Add(int64(0), 0.0)
+	f.Add(int64(math.MinInt64), math.Inf(-1))
+	f.Add(int64(math.MaxInt64), math.NaN())
+	f.Fuzz(func(t *testing.T, n int64, x float64) {
+		var pkt = New(1, 0, 0, n)
+		if len(pkt.BodyToBytes()) == 0 {
+			t.Fatalf("empty bytes of %d", n)
+		}
+		if s := pkt.BodyToString(); s == "" {
+			t.Fatalf("empty string of %d", n)
+		}
+		pkt.SetBody(x)
+		if len(pkt.BodyToBytes()) == 0 {
+			t.Fatalf("empty bytes of %v", x)
+		}
+		if s := pkt.BodyToString(); s == "" {
+			t.Fatalf("empty string of %v", x)
+		}
+		pkt.SetBody(nil)
+		if pkt.BodyToInt() != 0 || pkt.BodyToFloat() != 0 || pkt.BodyToString() != "" || pkt.BodyToBytes() != nil {
+			t.Fatalf("nil body conversion")
+		}
+	})
+}
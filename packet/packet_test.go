@@ -7,6 +7,11 @@ package packet
 import (
 	"testing"
 	"unsafe"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/x/bufpool"
 )
 
 func TestNewPacket(t *testing.T) {
@@ -26,3 +31,48 @@ func TestNewPacket(t *testing.T) {
 	clone.SetErrno(1002)
 	t.Logf("clone: %v", clone)
 }
+
+func TestPacketRelease(t *testing.T) {
+	var buf = bufpool.Get(100)
+	var pkt = Make()
+	pkt.SetCommand(1234)
+	pkt.SetBody(buf[20:])
+	pkt.SetBuffer(buf)
+	var clone = pkt.Clone()
+	pkt.Release()
+	if clone.Command() != 1234 {
+		t.Fatalf("clone command %d", clone.Command())
+	}
+
+	pkt = Make()
+	if pkt.Command() != 0 || pkt.Body() != nil || pkt.buf != nil {
+		t.Fatalf("packet not reset: %v", pkt)
+	}
+}
+
+// 无法转换的body返回0，不会panic
+func TestPacketBodyToNumber(t *testing.T) {
+	var bodies = []interface{}{"abc", wrapperspb.String("hello"), 1234}
+	for _, body := range bodies {
+		var pkt = New(1, 0, 0, body)
+		if n := pkt.BodyToInt(); n != 0 {
+			t.Fatalf("%T to int: %d", body, n)
+		}
+		if f := pkt.BodyToFloat(); f != 0 {
+			t.Fatalf("%T to float: %v", body, f)
+		}
+	}
+	var pkt = New(1, 0, fatchoy.PFlagError, wrapperspb.String("hello"))
+	if ec := pkt.Errno(); ec != 0 {
+		t.Fatalf("unexpected errno %d", ec)
+	}
+}
+
+func BenchmarkPacketRelease(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var pkt = Make()
+		pkt.SetBuffer(bufpool.Get(100))
+		pkt.Release()
+	}
+}
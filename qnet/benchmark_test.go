@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -138,3 +139,77 @@ LabelDone:
 	// Output:
 	// 	QPS: 100206.900193
 }
+
+// 发送b.N个小消息，对比每个消息都flush和合并flush的吞吐量
+func benchmarkTcpConnWrite(b *testing.B, maxBatch int) {
+	a, peer := makeTcpConnPair(b, nil, nil)
+	a.SetMaxBatchBytes(maxBatch)
+	a.Go(fatchoy.EndpointWriter)
+	var conn = peer.RawConn()
+	go io.Copy(io.Discard, conn)
+	defer conn.Close()
+
+	var pkt = packet.New(1, 1, 0, "hello, world")
+	var queue = a.OutboundQueue()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queue <- pkt
+	}
+	a.Close() // 等待发送完
+	b.SetBytes(a.Stats().Get(StatBytesSent) / int64(b.N))
+}
+
+func BenchmarkTcpConnWriteFlushEach(b *testing.B) {
+	benchmarkTcpConnWrite(b, 0)
+}
+
+func BenchmarkTcpConnWriteBatched(b *testing.B) {
+	benchmarkTcpConnWrite(b, TConnMaxBatchBytes)
+}
+
+// 循环读取同一段数据的连接，用于测试解码性能
+type replayConn struct {
+	net.Conn
+	data []byte
+	pos  int
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if c.pos == len(c.data) {
+		c.pos = 0
+	}
+	var n = copy(b, c.data[c.pos:])
+	c.pos += n
+	return n, nil
+}
+
+func (c *replayConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *replayConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func BenchmarkTcpConnReadPacket(b *testing.B) {
+	for _, enc := range []codec.Encoder{codec.NewV2Encoder(0), codec.NewV3Encoder(0)} {
+		b.Run(enc.Name(), func(b *testing.B) {
+			var buf bytes.Buffer
+			if _, err := enc.WritePacket(&buf, nil, packet.New(1001, 1, 0, make([]byte, 256))); err != nil {
+				b.Fatalf("WritePacket: %v", err)
+			}
+			var conn = NewTcpConn(1, &replayConn{data: buf.Bytes()}, enc, nil, nil, 0, nil)
+			b.SetBytes(int64(buf.Len()))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pkt, _, err := conn.readPacket()
+				if err != nil {
+					b.Fatalf("readPacket: %v", err)
+				}
+				pkt.Release()
+			}
+		})
+	}
+}
@@ -15,6 +15,9 @@ var (
 	ErrConnIsClosing        = errors.New("connection is closing when sending")
 	ErrConnOutboundOverflow = errors.New("connection outbound queue overflow")
 	ErrConnForceClose       = errors.New("connection forced to close")
+	ErrConnIdleTimeout      = errors.New("connection idle timeout")
+	ErrConnInboundOverflow  = errors.New("connection inbound queue overflow")
+	ErrWsUnexpectedMessage  = errors.New("websocket message must be binary")
 )
 
 type Error struct {
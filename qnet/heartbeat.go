@@ -0,0 +1,98 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/packet"
+)
+
+// 心跳保留的消息命令，不会投递到inbound
+const (
+	CommandPing int32 = -1
+	CommandPong int32 = -2
+)
+
+// 设置心跳，在Go()之前调用。
+// interval大于0时定时发送ping，对端会自动回复pong，RTT记录在Stats()的StatRTT；
+// timeout大于0时，超过timeout没有收到任何消息就断开连接，错误为ErrConnIdleTimeout
+func (c *StreamConn) SetHeartbeat(interval, timeout time.Duration) {
+	c.hbInterval = interval
+	c.idleTimeout = timeout
+}
+
+// 读超时时间
+func (c *StreamConn) readDeadline() time.Time {
+	if c.idleTimeout > 0 {
+		return time.Now().Add(c.idleTimeout)
+	}
+	return time.Now().Add(time.Duration(TConnReadTimeout) * time.Second)
+}
+
+// 读超时转换为ErrConnIdleTimeout
+func idleError(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrConnIdleTimeout
+	}
+	return err
+}
+
+// 处理ping/pong，返回true表示是心跳消息
+func (c *StreamConn) handleHeartbeat(pkt fatchoy.IPacket) bool {
+	switch pkt.Command() {
+	case CommandPing:
+		// ping的body可能引用读取缓冲区，需要复制
+		var body = append([]byte(nil), pkt.BodyToBytes()...)
+		var pong = packet.New(CommandPong, pkt.Seq(), 0, body)
+		select {
+		case c.outbound <- pong:
+		default:
+		}
+		return true
+
+	case CommandPong:
+		var body = pkt.BodyToBytes()
+		if len(body) == 8 {
+			var sent = int64(binary.BigEndian.Uint64(body))
+			var rtt = time.Duration(time.Now().UnixNano() - sent)
+			c.stats.Set(StatRTT, rtt.Microseconds())
+		}
+		return true
+	}
+	return false
+}
+
+// 定时发送ping
+func (c *StreamConn) heartbeatPump() {
+	defer c.wg.Done()
+	var ticker = time.NewTicker(c.hbInterval)
+	defer ticker.Stop()
+	var body [8]byte
+	for {
+		select {
+		case now := <-ticker.C:
+			binary.BigEndian.PutUint64(body[:], uint64(now.UnixNano()))
+			var ping = packet.New(CommandPing, 0, 0, append([]byte(nil), body[:]...))
+			select {
+			case c.outbound <- ping:
+			default: // 发送队列满了，跳过本次
+			}
+
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *StreamConn) startHeartbeat() {
+	if c.hbInterval > 0 {
+		c.wg.Add(1)
+		go c.heartbeatPump()
+	}
+}
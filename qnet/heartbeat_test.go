@@ -0,0 +1,80 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+)
+
+// 返回一对连接好的TcpConn
+func makeTcpConnPair(t testing.TB, errChan chan error, inbound chan fatchoy.IPacket) (*TcpConn, *TcpConn) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	conn1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn2, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	var enc = codec.NewV2Encoder(0)
+	var a = NewTcpConn(1, conn1, enc, errChan, inbound, 100, nil)
+	var b = NewTcpConn(2, conn2, enc, errChan, inbound, 100, nil)
+	return a, b
+}
+
+func TestHeartbeatRTT(t *testing.T) {
+	var errChan = make(chan error, 4)
+	var inbound = make(chan fatchoy.IPacket, 10)
+	a, b := makeTcpConnPair(t, errChan, inbound)
+	a.SetHeartbeat(10*time.Millisecond, time.Second)
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+	defer a.Close()
+	defer b.Close()
+
+	var deadline = time.Now().Add(5 * time.Second)
+	for a.Stats().Get(StatRTT) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no heartbeat RTT")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(inbound); n != 0 {
+		t.Fatalf("heartbeat should not be delivered, got %d", n)
+	}
+	if a.Stats().Get(StatPacketsRecv) == 0 || b.Stats().Get(StatPacketsRecv) == 0 {
+		t.Fatalf("heartbeat should be counted")
+	}
+}
+
+func TestHeartbeatIdleTimeout(t *testing.T) {
+	var errChan = make(chan error, 4)
+	var inbound = make(chan fatchoy.IPacket, 10)
+	a, b := makeTcpConnPair(t, errChan, inbound)
+	a.SetHeartbeat(0, 50*time.Millisecond)
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointWriter) // 不读也不发送
+	defer b.Close()
+
+	select {
+	case err := <-errChan:
+		var ne = err.(*Error)
+		if ne.Endpoint != a || ne.Err != ErrConnIdleTimeout {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("idle connection not kicked")
+	}
+}
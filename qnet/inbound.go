@@ -0,0 +1,97 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/log"
+)
+
+// inbound队列满时的处理方式
+type InboundPolicy int
+
+const (
+	InboundBlock        InboundPolicy = 0 // 一直阻塞直到有空间或者连接关闭
+	InboundBlockTimeout InboundPolicy = 1 // 最多阻塞指定时间，超时后丢弃消息
+	InboundDropNewest   InboundPolicy = 2 // 丢弃新收到的消息
+	InboundDropOldest   InboundPolicy = 3 // 丢弃队列里最早的一个消息，可能是其它endpoint的消息，仍然没有空间时丢弃新消息
+	InboundDisconnect   InboundPolicy = 4 // 断开连接，错误为ErrConnInboundOverflow
+)
+
+// 设置inbound队列满时的处理方式，在Go()之前调用，timeout仅用于InboundBlockTimeout。
+// InboundDropOldest需要能从inbound读取，只有server创建的endpoint支持，否则按InboundDropNewest处理
+func (c *StreamConn) SetInboundPolicy(policy InboundPolicy, timeout time.Duration) {
+	c.inPolicy = policy
+	c.inTimeout = timeout
+}
+
+// 把收到的消息投递到inbound，返回false表示连接已经关闭，丢弃的消息会被Release
+func (c *StreamConn) deliver(endpoint fatchoy.Endpoint, pkt fatchoy.IPacket) bool {
+	select {
+	case c.inbound <- pkt:
+		return true
+	default:
+	}
+
+	switch c.inPolicy {
+	case InboundBlockTimeout:
+		var timer = time.NewTimer(c.inTimeout)
+		defer timer.Stop()
+		select {
+		case c.inbound <- pkt:
+		case <-timer.C:
+			c.stats.Add(StatInboundTimeout, 1)
+			pkt.Release()
+		case <-c.done:
+			pkt.Release()
+			return false
+		}
+		return true
+
+	case InboundDropNewest:
+		c.stats.Add(StatInboundDropNewest, 1)
+		pkt.Release()
+		return true
+
+	case InboundDropOldest:
+		if c.inQueue == nil || cap(c.inQueue) == 0 {
+			c.stats.Add(StatInboundDropNewest, 1)
+			pkt.Release()
+			return true
+		}
+		// 只淘汰一次，空出的位置被其它endpoint抢占时丢弃新消息，避免一直循环
+		select {
+		case oldest := <-c.inQueue:
+			c.stats.Add(StatInboundDropOldest, 1)
+			oldest.Release()
+		default:
+		}
+		select {
+		case c.inbound <- pkt:
+		default:
+			c.stats.Add(StatInboundDropNewest, 1)
+			pkt.Release()
+		}
+		return true
+
+	case InboundDisconnect:
+		c.stats.Add(StatInboundDisconnect, 1)
+		log.Warnf("node %v(%s) inbound queue overflow, close", c.node, c.addr)
+		pkt.Release()
+		endpoint.ForceClose(ErrConnInboundOverflow)
+		return false
+
+	default:
+		select {
+		case c.inbound <- pkt: // 如果channel满了，这里会阻塞
+			return true
+		case <-c.done:
+			pkt.Release()
+			return false
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/packet"
+)
+
+func TestInboundPolicy(t *testing.T) {
+	tests := []struct {
+		policy InboundPolicy
+		stat   int
+		first  uint16 // 队列里第一个消息的seq
+	}{
+		{InboundBlockTimeout, StatInboundTimeout, 1},
+		{InboundDropNewest, StatInboundDropNewest, 1},
+		{InboundDropOldest, StatInboundDropOldest, 4},
+	}
+	for _, tc := range tests {
+		var inbound = make(chan fatchoy.IPacket, 2)
+		a, b := makeTcpConnPair(t, nil, inbound)
+		b.inQueue = inbound
+		b.SetInboundPolicy(tc.policy, 10*time.Millisecond)
+		a.Go(fatchoy.EndpointReadWriter)
+		b.Go(fatchoy.EndpointReadWriter)
+
+		for i := 1; i <= 5; i++ {
+			a.SendPacket(packet.New(1, uint16(i), 0, "hello"))
+		}
+		var deadline = time.Now().Add(5 * time.Second)
+		for b.Stats().Get(tc.stat) < 3 {
+			if time.Now().After(deadline) {
+				t.Fatalf("policy %d: %d packets overflow", tc.policy, b.Stats().Get(tc.stat))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if pkt := <-inbound; pkt.Seq() != tc.first {
+			t.Fatalf("policy %d: unexpected first seq %d", tc.policy, pkt.Seq())
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestInboundDisconnect(t *testing.T) {
+	var errChan = make(chan error, 4)
+	var inbound = make(chan fatchoy.IPacket, 1)
+	a, b := makeTcpConnPair(t, errChan, inbound)
+	b.SetInboundPolicy(InboundDisconnect, 0)
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+	defer a.Close()
+
+	for i := 1; i <= 3; i++ {
+		a.SendPacket(packet.New(1, uint16(i), 0, "hello"))
+	}
+	var timeout = time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-errChan:
+			var ne = err.(*Error)
+			if ne.Endpoint == b {
+				if ne.Err != ErrConnInboundOverflow || b.Stats().Get(StatInboundDisconnect) != 1 {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("connection not closed")
+		}
+	}
+}
+
+// 淘汰一次后仍然没有空间，丢弃新消息而不是一直循环
+func TestInboundDropOldestOnce(t *testing.T) {
+	var inbound = make(chan fatchoy.IPacket, 1)
+	a, b := makeTcpConnPair(t, nil, inbound)
+	b.inQueue = make(chan fatchoy.IPacket, 1) // 淘汰不会给inbound空出位置
+	b.SetInboundPolicy(InboundDropOldest, 0)
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+	defer a.Close()
+	defer b.Close()
+
+	for i := 1; i <= 3; i++ {
+		a.SendPacket(packet.New(1, uint16(i), 0, "hello"))
+	}
+	var deadline = time.Now().Add(5 * time.Second)
+	for b.Stats().Get(StatInboundDropNewest) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d packets dropped", b.Stats().Get(StatInboundDropNewest))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if pkt := <-inbound; pkt.Seq() != 1 {
+		t.Fatalf("unexpected first seq %d", pkt.Seq())
+	}
+}
+
+// 丢弃的消息放回对象池
+func TestInboundDropRelease(t *testing.T) {
+	var newPacket = func(seq uint16) fatchoy.IPacket {
+		var pkt = packet.Make()
+		pkt.SetCommand(1)
+		pkt.SetSeq(seq)
+		return pkt
+	}
+	for _, policy := range []InboundPolicy{InboundDropNewest, InboundDropOldest} {
+		var inbound = make(chan fatchoy.IPacket, 1)
+		var c StreamConn
+		c.Init(0, nil, inbound, 1, nil, nil)
+		c.inQueue = make(chan fatchoy.IPacket, 1) // 淘汰不会给inbound空出位置
+		c.SetInboundPolicy(policy, 0)
+		inbound <- newPacket(1)
+		var oldest = newPacket(2)
+		c.inQueue <- oldest
+
+		var pkt = newPacket(3)
+		if !c.deliver(nil, pkt) {
+			t.Fatalf("policy %d: deliver failed", policy)
+		}
+		if pkt.Command() != 0 {
+			t.Fatalf("policy %d: dropped packet not released", policy)
+		}
+		if policy == InboundDropOldest && oldest.Command() != 0 {
+			t.Fatalf("policy %d: evicted packet not released", policy)
+		}
+	}
+}
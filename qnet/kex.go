@@ -0,0 +1,288 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/x/cipher"
+)
+
+// 密钥交换握手，在连接建立后、开启读写之前执行
+//
+// 客户端发送ClientHello：
+//
+//	version(1字节) | cipher长度(1字节) | cipher名称 | 客户端临时公钥(32字节)
+//
+// 服务端回复ServerHello：
+//
+//	服务端临时公钥(32字节) | 签名算法(1字节) | 签名
+//
+// 签名覆盖双方的临时公钥和cipher名称，客户端用预先配置的服务端公钥验证。
+// 双方用X25519得到共享密钥后，通过HKDF-SHA256分别派生两个方向的key和iv，
+// 再用cipher.NewCrypt创建加解密器安装到endpoint。
+
+const (
+	kexVersion     = 1
+	kexKeySize     = 32 // X25519公钥大小
+	kexCryptKey    = 32 // 派生的key大小
+	kexCryptIV     = 16 // 派生的iv大小
+	kexSignRSA     = 1  // RSA-PSS SHA256
+	kexSignEd25519 = 2  // Ed25519
+)
+
+var (
+	KeyExchangeTimeout = 10 // 握手超时，10s
+
+	// 默认允许协商的cipher
+	KeyExchangeCiphers = []string{"aes-gcm", "chacha20-poly1305", "sm4-gcm", "aes-256", "aes-192", "aes-128", "sm4", "twofish", "salsa20"}
+
+	ErrKexBadMessage      = errors.New("key exchange: malformed message")
+	ErrKexBadSignature    = errors.New("key exchange: signature verification failed")
+	ErrKexCipherRejected  = errors.New("key exchange: cipher not supported")
+	ErrKexUnsupportedKey  = errors.New("key exchange: unsupported key type")
+	ErrKexVersionMismatch = errors.New("key exchange: version mismatch")
+)
+
+// 被签名的内容
+func kexTranscript(cipherName string, clientPub, serverPub []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("fatchoy key exchange")
+	buf.WriteString(cipherName)
+	buf.Write(clientPub)
+	buf.Write(serverPub)
+	var sum = sha256.Sum256(buf.Bytes())
+	return sum[:]
+}
+
+// 用HKDF派生一个方向的加解密器
+func kexDeriveCrypt(cipherName string, secret, salt []byte, info string) (cipher.BlockCryptor, error) {
+	var r = hkdf.New(sha256.New, secret, salt, []byte(info))
+	var buf = make([]byte, kexCryptKey+kexCryptIV)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return cipher.NewCrypt(cipherName, buf[:kexCryptKey], buf[kexCryptKey:]), nil
+}
+
+// 根据X25519共享密钥派生两个方向的加解密器
+func kexDerivePair(cipherName string, priv, peerPub, clientPub, serverPub []byte) (c2s, s2c cipher.BlockCryptor, err error) {
+	secret, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	var salt = append(append([]byte(nil), clientPub...), serverPub...)
+	if c2s, err = kexDeriveCrypt(cipherName, secret, salt, "fatchoy client to server"); err != nil {
+		return nil, nil, err
+	}
+	if s2c, err = kexDeriveCrypt(cipherName, secret, salt, "fatchoy server to client"); err != nil {
+		return nil, nil, err
+	}
+	return c2s, s2c, nil
+}
+
+// 生成X25519临时密钥对
+func kexGenerateKey() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	if pub, err = curve25519.X25519(priv, curve25519.Basepoint); err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+func kexSetDeadline(conn net.Conn) {
+	var deadline = time.Now().Add(time.Duration(KeyExchangeTimeout) * time.Second)
+	conn.SetDeadline(deadline)
+}
+
+// 服务端的密钥交换
+type KeyExchangeServer struct {
+	key     crypto.Signer
+	ciphers []string
+}
+
+// key为*rsa.PrivateKey或者ed25519.PrivateKey
+func NewKeyExchangeServer(key crypto.Signer) (*KeyExchangeServer, error) {
+	switch key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, ErrKexUnsupportedKey
+	}
+	return &KeyExchangeServer{
+		key:     key,
+		ciphers: KeyExchangeCiphers,
+	}, nil
+}
+
+// 设置允许协商的cipher
+func (s *KeyExchangeServer) SetCiphers(names ...string) {
+	s.ciphers = names
+}
+
+func (s *KeyExchangeServer) allowCipher(name string) bool {
+	for _, v := range s.ciphers {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *KeyExchangeServer) sign(digest []byte) (byte, []byte, error) {
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		var opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest, opts)
+		return kexSignRSA, sig, err
+	case ed25519.PrivateKey:
+		return kexSignEd25519, ed25519.Sign(key, digest), nil
+	}
+	return 0, nil, ErrKexUnsupportedKey
+}
+
+// 完成握手并给endpoint设置加解密
+func (s *KeyExchangeServer) Handshake(endpoint fatchoy.Endpoint) error {
+	var conn = endpoint.RawConn()
+	kexSetDeadline(conn)
+	defer conn.SetDeadline(time.Time{})
+
+	hello, err := codec.ReadLenData(conn)
+	if err != nil {
+		return err
+	}
+	if len(hello) < 2 {
+		return ErrKexBadMessage
+	}
+	if hello[0] != kexVersion {
+		return ErrKexVersionMismatch
+	}
+	var nameLen = int(hello[1])
+	if len(hello) != 2+nameLen+kexKeySize {
+		return ErrKexBadMessage
+	}
+	var cipherName = string(hello[2 : 2+nameLen])
+	var clientPub = hello[2+nameLen:]
+	if !s.allowCipher(cipherName) {
+		return fmt.Errorf("%w: %s", ErrKexCipherRejected, cipherName)
+	}
+
+	priv, serverPub, err := kexGenerateKey()
+	if err != nil {
+		return err
+	}
+	alg, sig, err := s.sign(kexTranscript(cipherName, clientPub, serverPub))
+	if err != nil {
+		return err
+	}
+	c2s, s2c, err := kexDerivePair(cipherName, priv, clientPub, clientPub, serverPub)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(serverPub)
+	buf.WriteByte(alg)
+	buf.Write(sig)
+	if err := writeLenData(conn, buf.Bytes()); err != nil {
+		return err
+	}
+	endpoint.SetEncryptPair(s2c, c2s)
+	return nil
+}
+
+// 客户端的密钥交换，Handshake可以作为TcpClient的握手函数
+type KeyExchangeClient struct {
+	pubkey     crypto.PublicKey
+	cipherName string
+}
+
+// pubkey为服务端的*rsa.PublicKey或者ed25519.PublicKey
+func NewKeyExchangeClient(pubkey crypto.PublicKey, cipherName string) (*KeyExchangeClient, error) {
+	switch pubkey.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, ErrKexUnsupportedKey
+	}
+	if len(cipherName) > 255 {
+		return nil, ErrKexBadMessage
+	}
+	return &KeyExchangeClient{
+		pubkey:     pubkey,
+		cipherName: cipherName,
+	}, nil
+}
+
+func (c *KeyExchangeClient) verify(alg byte, digest, sig []byte) error {
+	switch key := c.pubkey.(type) {
+	case *rsa.PublicKey:
+		if alg == kexSignRSA {
+			var opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			if rsa.VerifyPSS(key, crypto.SHA256, digest, sig, opts) == nil {
+				return nil
+			}
+		}
+	case ed25519.PublicKey:
+		if alg == kexSignEd25519 && ed25519.Verify(key, digest, sig) {
+			return nil
+		}
+	}
+	return ErrKexBadSignature
+}
+
+// 完成握手并给endpoint设置加解密
+func (c *KeyExchangeClient) Handshake(endpoint fatchoy.Endpoint) error {
+	var conn = endpoint.RawConn()
+	kexSetDeadline(conn)
+	defer conn.SetDeadline(time.Time{})
+
+	priv, clientPub, err := kexGenerateKey()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(kexVersion)
+	buf.WriteByte(byte(len(c.cipherName)))
+	buf.WriteString(c.cipherName)
+	buf.Write(clientPub)
+	if err := writeLenData(conn, buf.Bytes()); err != nil {
+		return err
+	}
+
+	hello, err := codec.ReadLenData(conn)
+	if err != nil {
+		return err
+	}
+	if len(hello) < kexKeySize+1 {
+		return ErrKexBadMessage
+	}
+	var serverPub = hello[:kexKeySize]
+	var digest = kexTranscript(c.cipherName, clientPub, serverPub)
+	if err := c.verify(hello[kexKeySize], digest, hello[kexKeySize+1:]); err != nil {
+		return err
+	}
+	c2s, s2c, err := kexDerivePair(c.cipherName, priv, serverPub, clientPub, serverPub)
+	if err != nil {
+		return err
+	}
+	endpoint.SetEncryptPair(c2s, s2c)
+	return nil
+}
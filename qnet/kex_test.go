@@ -0,0 +1,94 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/packet"
+	"qchen.fun/fatchoy/x/cipher"
+)
+
+// 在一对连接上执行密钥交换，返回两端的握手结果
+func runKeyExchange(t *testing.T, a, b *TcpConn, priv crypto.Signer, pub crypto.PublicKey, cipherName string) (error, error) {
+	server, err := NewKeyExchangeServer(priv)
+	if err != nil {
+		t.Fatalf("NewKeyExchangeServer: %v", err)
+	}
+	client, err := NewKeyExchangeClient(pub, cipherName)
+	if err != nil {
+		t.Fatalf("NewKeyExchangeClient: %v", err)
+	}
+	var done = make(chan error, 1)
+	go func() {
+		done <- server.Handshake(b)
+	}()
+	var clientErr = client.Handshake(a)
+	if clientErr != nil {
+		b.RawConn().Close()
+	}
+	return clientErr, <-done
+}
+
+func TestKeyExchange(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	rsaKey, err := cipher.LoadRSAPrivateKey(cipher.RSATestPrivateKey)
+	if err != nil {
+		t.Fatalf("LoadRSAPrivateKey: %v", err)
+	}
+	tests := []struct {
+		key        crypto.Signer
+		cipherName string
+	}{
+		{edKey, "chacha20-poly1305"},
+		{edKey, "aes-gcm"},
+		{rsaKey, "sm4"},
+	}
+	for _, tc := range tests {
+		var inbound = make(chan fatchoy.IPacket, 10)
+		a, b := makeTcpConnPair(t, nil, inbound)
+		clientErr, serverErr := runKeyExchange(t, a, b, tc.key, tc.key.Public(), tc.cipherName)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("%s handshake: %v, %v", tc.cipherName, clientErr, serverErr)
+		}
+		if !bytes.Equal(a.encrypt.Key(), b.decrypt.Key()) || !bytes.Equal(b.encrypt.Key(), a.decrypt.Key()) {
+			t.Fatalf("%s: key mismatch", tc.cipherName)
+		}
+		if bytes.Equal(a.encrypt.Key(), a.decrypt.Key()) {
+			t.Fatalf("%s: both directions use the same key", tc.cipherName)
+		}
+
+		a.Go(fatchoy.EndpointReadWriter)
+		b.Go(fatchoy.EndpointReadWriter)
+		a.SendPacket(packet.New(1, 1, 0, "hello"))
+		select {
+		case pkt := <-inbound:
+			if s := pkt.BodyToString(); s != "hello" {
+				t.Fatalf("%s: unexpected body %q", tc.cipherName, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timeout", tc.cipherName)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestKeyExchangeBadSignature(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	a, b := makeTcpConnPair(t, nil, nil)
+	defer a.RawConn().Close()
+	clientErr, _ := runKeyExchange(t, a, b, serverKey, otherPub, "aes-256")
+	if clientErr != ErrKexBadSignature {
+		t.Fatalf("unexpected error: %v", clientErr)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/log"
+)
+
+// 超过限速后的处理方式
+type RateLimitAction int
+
+const (
+	RateLimitDrop  RateLimitAction = 0 // 丢弃消息
+	RateLimitDelay RateLimitAction = 1 // 暂停读取，直到有足够的令牌
+	RateLimitClose RateLimitAction = 2 // 断开连接，错误为codes.OperationTooFrequent
+)
+
+// 令牌桶，容量为1秒的速率
+type tokenBucket struct {
+	rate   float64   // 每秒产生的令牌数
+	tokens float64   // 当前令牌数
+	last   time.Time // 上次更新时间
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) allow(n float64) bool {
+	return b.tokens >= n
+}
+
+// 取走n个令牌，返回需要等待的时间
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 每个endpoint的入站消息限速，只在reader线程里使用
+type RateLimiter struct {
+	action   RateLimitAction
+	packets  *tokenBucket           // 每秒消息数量
+	bytes    *tokenBucket           // 每秒字节数
+	commands map[int32]*tokenBucket // 每个命令每秒的消息数量
+}
+
+// packetsPerSec或bytesPerSec为0表示不限制。
+// 使用RateLimitDrop时，单个消息的大小不能超过bytesPerSec，否则总是会被丢弃
+func NewRateLimiter(packetsPerSec, bytesPerSec int, action RateLimitAction) *RateLimiter {
+	var l = &RateLimiter{
+		action:   action,
+		commands: make(map[int32]*tokenBucket),
+	}
+	if packetsPerSec > 0 {
+		l.packets = newTokenBucket(packetsPerSec)
+	}
+	if bytesPerSec > 0 {
+		l.bytes = newTokenBucket(bytesPerSec)
+	}
+	return l
+}
+
+// 设置单个命令每秒的消息数量
+func (l *RateLimiter) SetCommandLimit(command int32, perSec int) {
+	if perSec > 0 {
+		l.commands[command] = newTokenBucket(perSec)
+	} else {
+		delete(l.commands, command)
+	}
+}
+
+func (l *RateLimiter) Action() RateLimitAction {
+	return l.action
+}
+
+func (l *RateLimiter) buckets(command int32) []*tokenBucket {
+	var buckets = make([]*tokenBucket, 0, 3)
+	if l.packets != nil {
+		buckets = append(buckets, l.packets)
+	}
+	if b := l.commands[command]; b != nil {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// 检查一条消息，返回是否放行，以及RateLimitDelay时需要等待的时间
+func (l *RateLimiter) take(command int32, nbytes int, now time.Time) (bool, time.Duration) {
+	var buckets = l.buckets(command)
+	for _, b := range buckets {
+		b.refill(now)
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+	}
+	if l.action != RateLimitDelay {
+		for _, b := range buckets {
+			if !b.allow(1) {
+				return false, 0
+			}
+		}
+		if l.bytes != nil && !l.bytes.allow(float64(nbytes)) {
+			return false, 0
+		}
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(1); d > wait {
+			wait = d
+		}
+	}
+	if l.bytes != nil {
+		if d := l.bytes.reserve(float64(nbytes)); d > wait {
+			wait = d
+		}
+	}
+	return true, wait
+}
+
+// 设置入站限速，在Go()之前调用
+func (c *StreamConn) SetRateLimiter(limiter *RateLimiter) {
+	c.limiter = limiter
+}
+
+// 对收到的消息限速，返回false表示消息不应该投递
+func (c *StreamConn) throttle(endpoint fatchoy.Endpoint, pkt fatchoy.IPacket, nbytes int) bool {
+	if c.limiter == nil {
+		return true
+	}
+	ok, wait := c.limiter.take(pkt.Command(), nbytes, time.Now())
+	if ok && wait == 0 {
+		return true
+	}
+	switch c.limiter.action {
+	case RateLimitDelay:
+		c.stats.Add(StatPacketsDelayed, 1)
+		var timer = time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-c.done:
+			return false
+		}
+
+	case RateLimitClose:
+		c.stats.Add(StatPacketsDropped, 1)
+		log.Warnf("node %v(%s) message %v too frequent, close", c.node, c.addr, pkt.Command())
+		endpoint.ForceClose(codes.OperationTooFrequent)
+		return false
+
+	default:
+		c.stats.Add(StatPacketsDropped, 1)
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/packet"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	var l = NewRateLimiter(10, 0, RateLimitDrop)
+	l.SetCommandLimit(2, 2)
+	var now = time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take(2, 10, now); !ok {
+			t.Fatalf("command 2 #%d should pass", i)
+		}
+	}
+	if ok, _ := l.take(2, 10, now); ok {
+		t.Fatalf("command 2 should be limited")
+	}
+	for i := 0; i < 8; i++ {
+		if ok, _ := l.take(1, 10, now); !ok {
+			t.Fatalf("command 1 #%d should pass", i)
+		}
+	}
+	if ok, _ := l.take(1, 10, now); ok {
+		t.Fatalf("packets should be limited")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.take(2, 10, now); !ok {
+		t.Fatalf("command 2 should pass after refill")
+	}
+
+	var d = NewRateLimiter(0, 100, RateLimitDelay)
+	if ok, wait := d.take(1, 100, now); !ok || wait != 0 {
+		t.Fatalf("unexpected delay %v", wait)
+	}
+	if ok, wait := d.take(1, 50, now); !ok || wait != 500*time.Millisecond {
+		t.Fatalf("unexpected delay %v", wait)
+	}
+}
+
+func TestRateLimitClose(t *testing.T) {
+	var errChan = make(chan error, 4)
+	var inbound = make(chan fatchoy.IPacket, 100)
+	a, b := makeTcpConnPair(t, errChan, inbound)
+	b.SetRateLimiter(NewRateLimiter(5, 0, RateLimitClose))
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+	defer a.Close()
+
+	for i := 0; i < 10; i++ {
+		a.SendPacket(packet.New(1, uint16(i), 0, "flood"))
+	}
+	var timeout = time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-errChan:
+			var ne = err.(*Error)
+			if ne.Endpoint == b {
+				if ne.Err != codes.OperationTooFrequent {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if n := len(inbound); n != 5 {
+					t.Fatalf("delivered %d != 5", n)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("flooding connection not closed")
+		}
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	var errChan = make(chan error, 4)
+	var inbound = make(chan fatchoy.IPacket, 100)
+	a, b := makeTcpConnPair(t, errChan, inbound)
+	b.SetRateLimiter(NewRateLimiter(5, 0, RateLimitDrop))
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 10; i++ {
+		a.SendPacket(packet.New(1, uint16(i), 0, "flood"))
+	}
+	var deadline = time.Now().Add(5 * time.Second)
+	for b.Stats().Get(StatPacketsRecv) < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := b.Stats().Get(StatPacketsDropped); n < 4 {
+		t.Fatalf("dropped %d packets", n)
+	}
+}
+
+// ping也受限速，不会每个都回复pong
+func TestRateLimitPingFlood(t *testing.T) {
+	var errChan = make(chan error, 4)
+	var inbound = make(chan fatchoy.IPacket, 100)
+	a, b := makeTcpConnPair(t, errChan, inbound)
+	b.SetRateLimiter(NewRateLimiter(5, 0, RateLimitDrop))
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+	defer a.Close()
+	defer b.Close()
+
+	for i := 0; i < 50; i++ {
+		a.SendPacket(packet.New(CommandPing, uint16(i), 0, nil))
+	}
+	var deadline = time.Now().Add(5 * time.Second)
+	for b.Stats().Get(StatPacketsRecv) < 50 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := b.Stats().Get(StatPacketsDropped); n < 40 {
+		t.Fatalf("dropped %d pings", n)
+	}
+	time.Sleep(100 * time.Millisecond) // 等待pong写出
+	if n := b.Stats().Get(StatPacketsSent); n > 10 {
+		t.Fatalf("replied %d pongs", n)
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+)
+
+// 会话恢复握手
+//
+// 连接建立后、开启读写之前，客户端发送：
+//
+//	token(16字节) | acked(8字节)
+//
+// token全0表示新会话，acked是这个会话累计收到的消息数量。
+// 服务端给会话发送的每个消息按顺序编号（从1开始），补发编号大于acked的消息。
+// 服务端回复：
+//
+//	status(1字节) | token(16字节)
+//
+// status为1表示恢复成功，服务端会把新连接绑定到原来的NodeID，并补发客户端没有收到的消息；
+// 为0表示分配了新的会话，客户端需要重新登录。
+
+const (
+	ResumeTokenSize = 16
+
+	resumeStatusNew     = 0
+	resumeStatusResumed = 1
+)
+
+var (
+	ResumeHandshakeTimeout = 10  // 握手超时，10s
+	ResumeSessionTTL       = 120 // 断线后会话保留的时间，120s
+	ResumeRingSize         = 256 // 每个会话保留的最近发送的消息数量
+	ResumeReapInterval     = 10  // 清理过期会话的间隔，10s
+
+	ErrResumeBadHandshake = errors.New("resume handshake: malformed message")
+	ErrConnResumed        = errors.New("connection resumed by another connection")
+)
+
+type ResumeToken [ResumeTokenSize]byte
+
+func (t ResumeToken) IsZero() bool {
+	return t == ResumeToken{}
+}
+
+// 记录的消息和它在会话中的编号
+type resumeRecord struct {
+	n   uint64
+	pkt fatchoy.IPacket
+}
+
+// 服务端的会话
+type resumeSession struct {
+	sync.Mutex
+	token    ResumeToken
+	endpoint *TcpConn       // 当前绑定的连接
+	ring     []resumeRecord // 最近发送的消息
+	sent     uint64         // 已发送消息的编号
+	closedAt time.Time      // 连接断开的时间
+}
+
+// 调用方需要持有锁
+func (s *resumeSession) record(pkt fatchoy.IPacket) {
+	if len(s.ring) >= ResumeRingSize {
+		copy(s.ring, s.ring[1:])
+		s.ring = s.ring[:len(s.ring)-1]
+	}
+	s.sent++
+	s.ring = append(s.ring, resumeRecord{n: s.sent, pkt: pkt})
+}
+
+// 连接断开，会话保留到过期为止，期间可以恢复
+func (s *resumeSession) detach(endpoint *TcpConn) {
+	s.Lock()
+	if s.endpoint == endpoint {
+		s.closedAt = time.Now()
+	}
+	s.Unlock()
+}
+
+// 找出编号大于acked的消息，没有收到的消息已经被丢弃说明无法恢复
+func (s *resumeSession) missed(acked uint64) ([]fatchoy.IPacket, bool) {
+	if acked > s.sent {
+		return nil, false
+	}
+	if len(s.ring) > 0 && s.ring[0].n > acked+1 {
+		return nil, false
+	}
+	var i = 0
+	for i < len(s.ring) && s.ring[i].n <= acked {
+		i++
+	}
+	s.ring = s.ring[i:] // 已经确认的不再保留，没有确认的保留原来的编号
+	var missed = make([]fatchoy.IPacket, 0, len(s.ring))
+	for _, r := range s.ring {
+		missed = append(missed, r.pkt)
+	}
+	return missed, true
+}
+
+// 管理服务端的可恢复会话
+// 每个接入的TcpConn在调用Go()之前先调用Accept完成握手，
+// 发送给客户端的消息会被记录下来，用于断线重连后补发。
+// 记录的消息在发送之后不应该再被修改。
+// 调用Go()后会定期清理断线超过ResumeSessionTTL的会话。
+type ResumeManager struct {
+	done     chan struct{}
+	wg       sync.WaitGroup
+	guard    sync.Mutex
+	sessions map[ResumeToken]*resumeSession
+}
+
+func NewResumeManager() *ResumeManager {
+	return &ResumeManager{
+		done:     make(chan struct{}),
+		sessions: make(map[ResumeToken]*resumeSession),
+	}
+}
+
+// 开始定期清理过期的会话
+func (m *ResumeManager) Go() {
+	m.wg.Add(1)
+	go m.reaper()
+}
+
+func (m *ResumeManager) Close() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+func (m *ResumeManager) reaper() {
+	defer m.wg.Done()
+	var ticker = time.NewTicker(time.Duration(ResumeReapInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.purge()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// 会话数量
+func (m *ResumeManager) Len() int {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	return len(m.sessions)
+}
+
+// 完成握手并绑定会话，恢复成功时返回true，新连接的NodeID和UserData会沿用原来的连接。
+// 需要补发的消息会直接放入endpoint的发送队列，在Go()之后发出
+func (m *ResumeManager) Accept(endpoint *TcpConn) (bool, error) {
+	var conn = endpoint.RawConn()
+	var deadline = time.Now().Add(time.Duration(ResumeHandshakeTimeout) * time.Second)
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	data, err := codec.ReadLenData(conn)
+	if err != nil {
+		return false, err
+	}
+	if len(data) != ResumeTokenSize+8 {
+		return false, ErrResumeBadHandshake
+	}
+	var token ResumeToken
+	copy(token[:], data)
+	var acked = binary.BigEndian.Uint64(data[ResumeTokenSize:])
+
+	m.purge()
+	var session *resumeSession
+	var missed []fatchoy.IPacket
+	if !token.IsZero() {
+		session, missed = m.rebind(token, acked, endpoint)
+	}
+	var status byte = resumeStatusResumed
+	if session == nil {
+		status = resumeStatusNew
+		session = m.newSession(endpoint)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(status)
+	buf.Write(session.token[:])
+	if err := writeLenData(conn, buf.Bytes()); err != nil {
+		session.detach(endpoint)
+		return false, err
+	}
+	// 补发的消息已经在ring里，不再记录，持有锁保证排在新消息前面
+	session.Lock()
+	defer session.Unlock()
+	for _, pkt := range missed {
+		select {
+		case endpoint.outbound <- pkt:
+		default:
+			if session.endpoint == endpoint {
+				session.closedAt = time.Now()
+			}
+			return false, ErrConnOutboundOverflow
+		}
+	}
+	return status == resumeStatusResumed, nil
+}
+
+func (m *ResumeManager) newSession(endpoint *TcpConn) *resumeSession {
+	var session = &resumeSession{}
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for {
+		if _, err := rand.Read(session.token[:]); err != nil {
+			panic(err)
+		}
+		if _, found := m.sessions[session.token]; !found && !session.token.IsZero() {
+			break
+		}
+	}
+	m.sessions[session.token] = session
+	m.bind(session, endpoint)
+	return session
+}
+
+// 把会话绑定到新的连接，返回需要补发的消息
+func (m *ResumeManager) rebind(token ResumeToken, acked uint64, endpoint *TcpConn) (*resumeSession, []fatchoy.IPacket) {
+	m.guard.Lock()
+	var session = m.sessions[token]
+	if session == nil {
+		m.guard.Unlock()
+		return nil, nil
+	}
+	session.Lock()
+	missed, ok := session.missed(acked)
+	var old = session.endpoint
+	if !ok {
+		delete(m.sessions, token)
+		session.endpoint = nil
+	} else {
+		endpoint.SetNodeID(old.NodeID())
+		endpoint.SetUserData(old.UserData())
+		m.bind(session, endpoint)
+	}
+	session.Unlock()
+	m.guard.Unlock()
+
+	if old.IsRunning() {
+		old.ForceClose(ErrConnResumed) // 旧连接可能还没有检测到断线
+	}
+	if !ok {
+		return nil, nil
+	}
+	return session, missed
+}
+
+func (m *ResumeManager) bind(session *resumeSession, endpoint *TcpConn) {
+	session.endpoint = endpoint
+	session.closedAt = time.Time{}
+	// SendPacket持有session的锁调用onSend，消息的编号和在发送队列里的顺序一致
+	endpoint.sendLock = session
+	endpoint.onSend = func(pkt fatchoy.IPacket) {
+		if session.endpoint == endpoint {
+			session.record(pkt)
+		}
+	}
+	endpoint.onClose = append(endpoint.onClose, func(fatchoy.Endpoint) {
+		session.detach(endpoint)
+	})
+}
+
+// 删除endpoint绑定的会话，比如玩家主动登出
+func (m *ResumeManager) Remove(endpoint *TcpConn) {
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for token, session := range m.sessions {
+		session.Lock()
+		var found = session.endpoint == endpoint
+		session.Unlock()
+		if found {
+			delete(m.sessions, token)
+			return
+		}
+	}
+}
+
+// 清理过期的会话
+func (m *ResumeManager) purge() {
+	var ttl = time.Duration(ResumeSessionTTL) * time.Second
+	var now = time.Now()
+	m.guard.Lock()
+	defer m.guard.Unlock()
+	for token, session := range m.sessions {
+		session.Lock()
+		var expired = !session.closedAt.IsZero() && now.Sub(session.closedAt) > ttl
+		session.Unlock()
+		if expired {
+			delete(m.sessions, token)
+		}
+	}
+}
+
+func writeLenData(conn net.Conn, data []byte) error {
+	var buf bytes.Buffer
+	if _, err := codec.WriteLenData(&buf, data); err != nil {
+		return err
+	}
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+// 客户端的可恢复会话，Handshake可以作为TcpClient的握手函数
+type ResumeSession struct {
+	guard   sync.Mutex
+	token   ResumeToken
+	acked   uint64 // 确认收到的消息数量
+	resumed bool   // 最近一次握手是否恢复成功
+}
+
+func NewResumeSession() *ResumeSession {
+	return &ResumeSession{}
+}
+
+func (s *ResumeSession) Token() ResumeToken {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return s.token
+}
+
+// 最近一次握手是否恢复了原来的会话
+func (s *ResumeSession) Resumed() bool {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return s.resumed
+}
+
+// 确认收到了服务端的消息，按收到的顺序对每个消息调用一次
+func (s *ResumeSession) Ack(pkt fatchoy.IPacket) {
+	s.guard.Lock()
+	s.acked++
+	s.guard.Unlock()
+}
+
+func (s *ResumeSession) Handshake(endpoint fatchoy.Endpoint) error {
+	var conn = endpoint.RawConn()
+	var deadline = time.Now().Add(time.Duration(ResumeHandshakeTimeout) * time.Second)
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	s.guard.Lock()
+	var req = make([]byte, ResumeTokenSize+8)
+	copy(req, s.token[:])
+	binary.BigEndian.PutUint64(req[ResumeTokenSize:], s.acked)
+	s.guard.Unlock()
+
+	if err := writeLenData(conn, req); err != nil {
+		return err
+	}
+	resp, err := codec.ReadLenData(conn)
+	if err != nil {
+		return err
+	}
+	if len(resp) != ResumeTokenSize+1 {
+		return ErrResumeBadHandshake
+	}
+
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	s.resumed = resp[0] == resumeStatusResumed
+	copy(s.token[:], resp[1:])
+	if !s.resumed {
+		s.acked = 0
+	}
+	return nil
+}
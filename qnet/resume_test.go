@@ -0,0 +1,255 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/packet"
+)
+
+const (
+	cmdTestLogin = 1
+	cmdTestPush  = 2
+)
+
+// 新会话绑定NodeID，收到push后推送seq为s和s+1的两条消息，s为push的seq
+func serveResume(t *testing.T, server *TcpServer, mgr *ResumeManager, incoming chan fatchoy.IPacket,
+	nodes chan fatchoy.NodeID, done, stopped chan struct{}) {
+	var endpoints []fatchoy.Endpoint
+	defer func() {
+		for _, endpoint := range endpoints {
+			endpoint.Close()
+		}
+		close(stopped)
+	}()
+	for {
+		select {
+		case endpoint := <-server.BacklogChan():
+			resumed, err := mgr.Accept(endpoint.(*TcpConn))
+			if err != nil {
+				t.Errorf("Accept: %v", err)
+				endpoint.RawConn().Close()
+				continue
+			}
+			if !resumed {
+				endpoint.SetNodeID(1234)
+			}
+			nodes <- endpoint.NodeID()
+			endpoint.Go(fatchoy.EndpointReadWriter)
+			endpoints = append(endpoints, endpoint)
+
+		case <-server.ErrorChan():
+
+		case pkt := <-incoming:
+			switch pkt.Command() {
+			case cmdTestLogin:
+				pkt.ReplyWith(cmdTestLogin, "ok")
+			case cmdTestPush:
+				var seq = pkt.Seq()
+				pkt.Endpoint().SendPacket(packet.New(cmdTestPush, seq, 0, "hi"))
+				pkt.Endpoint().SendPacket(packet.New(cmdTestPush, seq+1, 0, "hi"))
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+func recvPacket(t *testing.T, inbound chan fatchoy.IPacket) fatchoy.IPacket {
+	select {
+	case pkt := <-inbound:
+		return pkt
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting packet")
+	}
+	return nil
+}
+
+func TestResumeSession(t *testing.T) {
+	var addr = "localhost:10010"
+	var enc = codec.NewV2Encoder(0)
+	var incoming = make(chan fatchoy.IPacket, 100)
+	var server = NewTcpServer(enc, incoming, 100)
+	if err := server.Listen(addr); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	var mgr = NewResumeManager()
+	var nodes = make(chan fatchoy.NodeID, 10)
+	var done = make(chan struct{})
+	var stopped = make(chan struct{})
+	go serveResume(t, server, mgr, incoming, nodes, done, stopped)
+	defer func() {
+		close(done)
+		<-stopped
+		server.Close()
+	}()
+
+	var session = NewResumeSession()
+	var inbound = make(chan fatchoy.IPacket, 100)
+	var client = NewTcpClient(addr, enc, inbound, 100)
+	client.SetBackoff(10*time.Millisecond, 100*time.Millisecond)
+	client.SetHandshake(session.Handshake)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+	<-nodes
+	if session.Resumed() || session.Token().IsZero() {
+		t.Fatalf("expect new session")
+	}
+
+	client.SendPacket(packet.New(cmdTestLogin, 1, 0, "hi"))
+	session.Ack(recvPacket(t, inbound))
+
+	client.SendPacket(packet.New(cmdTestPush, 2, 0, "hi"))
+	session.Ack(recvPacket(t, inbound)) // seq 2
+	session.Ack(recvPacket(t, inbound)) // seq 3
+
+	// seq 4和5在客户端确认之前断线
+	client.SendPacket(packet.New(cmdTestPush, 4, 0, "hi"))
+	recvPacket(t, inbound)
+	recvPacket(t, inbound)
+	client.Conn().RawConn().Close()
+
+	if node := <-nodes; node != 1234 {
+		t.Fatalf("resumed node %v != 1234", node)
+	}
+	for _, seq := range []uint16{4, 5} {
+		var pkt = recvPacket(t, inbound)
+		if pkt.Seq() != seq {
+			t.Fatalf("replayed seq %d != %d", pkt.Seq(), seq)
+		}
+		session.Ack(pkt)
+	}
+	if !session.Resumed() {
+		t.Fatalf("session should be resumed")
+	}
+	if n := mgr.Len(); n != 1 {
+		t.Fatalf("session count %d != 1", n)
+	}
+}
+
+// 序列号重复时也按编号补发
+func TestResumeSessionMissed(t *testing.T) {
+	var session = &resumeSession{}
+	for i := 1; i <= 3; i++ {
+		session.record(packet.New(int32(i), 0, 0, "hi"))
+	}
+	if _, ok := session.missed(4); ok {
+		t.Fatalf("acked more than sent")
+	}
+	missed, ok := session.missed(1)
+	if !ok || len(missed) != 2 || missed[0].Command() != 2 || missed[1].Command() != 3 {
+		t.Fatalf("unexpected missed packets %v", missed)
+	}
+	// 补发的消息再次断线，仍然可以恢复
+	session.record(packet.New(4, 0, 0, "hi"))
+	missed, ok = session.missed(2)
+	if !ok || len(missed) != 2 || missed[0].Command() != 3 || missed[1].Command() != 4 {
+		t.Fatalf("unexpected missed packets %v", missed)
+	}
+
+	var old = ResumeRingSize
+	ResumeRingSize = 2
+	defer func() { ResumeRingSize = old }()
+	session.record(packet.New(5, 0, 0, "hi"))
+	if _, ok := session.missed(2); ok {
+		t.Fatalf("dropped packet should not be resumed")
+	}
+	if missed, ok := session.missed(3); !ok || len(missed) != 2 {
+		t.Fatalf("unexpected missed packets %v", missed)
+	}
+}
+
+func TestResumeManagerReap(t *testing.T) {
+	var old = ResumeReapInterval
+	ResumeReapInterval = 1
+	defer func() { ResumeReapInterval = old }()
+
+	var mgr = NewResumeManager()
+	var token = ResumeToken{1}
+	var ttl = time.Duration(ResumeSessionTTL) * time.Second
+	mgr.sessions[token] = &resumeSession{token: token, closedAt: time.Now().Add(-ttl - time.Second)}
+	mgr.sessions[ResumeToken{2}] = &resumeSession{token: ResumeToken{2}}
+	mgr.Go()
+	defer mgr.Close()
+	for i := 0; i < 30 && mgr.Len() > 1; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := mgr.Len(); n != 1 {
+		t.Fatalf("session count %d != 1", n)
+	}
+}
+
+// 并发发送时，记录的编号顺序和发送队列的顺序一致
+func TestResumeConcurrentSend(t *testing.T) {
+	var conn, peer = net.Pipe()
+	defer peer.Close()
+	var endpoint = NewTcpConn(0, conn, codec.NewV2Encoder(0), nil, nil, ResumeRingSize, nil)
+	endpoint.state.Set(fatchoy.StateRunning)
+	var mgr = NewResumeManager()
+	var session = mgr.newSession(endpoint)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < ResumeRingSize/4; j++ {
+				endpoint.SendPacket(packet.New(int32(i), uint16(j), 0, nil))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	session.Lock()
+	defer session.Unlock()
+	if len(session.ring) != ResumeRingSize {
+		t.Fatalf("recorded %d != %d", len(session.ring), ResumeRingSize)
+	}
+	for i, r := range session.ring {
+		var pkt = <-endpoint.outbound
+		if r.n != uint64(i+1) || r.pkt != pkt {
+			t.Fatalf("record #%d mismatch: %d %v != %v", i, r.n, r.pkt, pkt)
+		}
+	}
+}
+
+// 握手失败不删除恢复的会话
+func TestResumeAcceptFailed(t *testing.T) {
+	var mgr = NewResumeManager()
+	var conn, peer = net.Pipe()
+	var old = NewTcpConn(1234, conn, codec.NewV2Encoder(0), nil, nil, 10, nil)
+	var session = mgr.newSession(old)
+	session.closedAt = time.Now()
+	peer.Close()
+
+	conn, peer = net.Pipe()
+	var endpoint = NewTcpConn(0, conn, codec.NewV2Encoder(0), nil, nil, 10, nil)
+	go func() {
+		var req = make([]byte, ResumeTokenSize+8)
+		copy(req, session.token[:])
+		writeLenData(peer, req)
+		peer.Close() // 不读取回复
+	}()
+	if _, err := mgr.Accept(endpoint); err == nil {
+		t.Fatalf("Accept should fail")
+	}
+	if n := mgr.Len(); n != 1 {
+		t.Fatalf("session count %d != 1", n)
+	}
+	session.Lock()
+	defer session.Unlock()
+	if session.endpoint != endpoint || session.closedAt.IsZero() {
+		t.Fatalf("session should be detached")
+	}
+}
@@ -6,6 +6,7 @@ package qnet
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -20,14 +21,39 @@ import (
 
 type RpcHandler func(proto.Message, int32) error
 
+var (
+	RpcCallTimeout = 60 // 默认的RPC超时，60s
+
+	ErrRpcIDCollision  = errors.New("rpc correlation id collision")
+	ErrRpcAmbiguousSeq = errors.New("rpc seq matches more than one pending call")
+)
+
+// RPC调用选项
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	timeout time.Duration
+}
+
+// 设置单次调用的超时
+func WithTimeout(d time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = d
+	}
+}
+
 // RPC上下文
 type RpcContext struct {
-	dest     fatchoy.NodeID   // 目标节点
-	req      proto.Message    // 请求消息
-	ack      fatchoy.IPacket  // 响应packet
-	deadline time.Time        // 超时
-	cb       RpcHandler       // 异步回调
-	done     chan *RpcContext // Strobes when RPC is completed
+	dest     fatchoy.NodeID    // 目标节点
+	req      proto.Message     // 请求消息
+	ack      fatchoy.IPacket   // 响应packet
+	id       uint32            // 关联ID
+	deadline time.Time         // 超时
+	errno    codes.Code        // 超时或者取消时的错误码
+	md       map[string]string // 请求元数据
+	cb       RpcHandler        // 异步回调
+	done     chan *RpcContext  // Strobes when RPC is completed
+	finished chan struct{}     // 调用结束时关闭
 }
 
 func NewRpcContext(node fatchoy.NodeID, req proto.Message, cb RpcHandler) *RpcContext {
@@ -38,6 +64,39 @@ func NewRpcContext(node fatchoy.NodeID, req proto.Message, cb RpcHandler) *RpcCo
 	}
 }
 
+func (r *RpcContext) Node() fatchoy.NodeID {
+	return r.dest
+}
+
+func (r *RpcContext) Request() proto.Message {
+	return r.req
+}
+
+// 响应packet，调用完成之前为nil
+func (r *RpcContext) Ack() fatchoy.IPacket {
+	return r.ack
+}
+
+// 响应的错误码
+func (r *RpcContext) Errno() codes.Code {
+	if r.ack == nil {
+		return r.errno
+	}
+	return codes.Code(r.ack.Errno())
+}
+
+// 设置请求元数据，通过packet扩展字段明文发送，不会被加密
+func (r *RpcContext) SetMetadata(key, value string) {
+	if r.md == nil {
+		r.md = make(map[string]string)
+	}
+	r.md[key] = value
+}
+
+func (r *RpcContext) Metadata() map[string]string {
+	return r.md
+}
+
 func (r *RpcContext) DecodeAck() (proto.Message, error) {
 	var pkt = r.ack
 	if ec := pkt.Errno(); ec > 0 {
@@ -65,17 +124,22 @@ func (r *RpcContext) notify() {
 }
 
 func (r *RpcContext) run(pkt fatchoy.IPacket) error {
+	var cb = r.cb // notify之后调用方可能修改r
 	r.ack = pkt
+	if r.finished != nil {
+		close(r.finished)
+		r.finished = nil
+	}
 	r.notify()
-	if r.cb != nil {
+	if cb != nil {
 		if ec := pkt.Errno(); ec > 0 {
-			return r.cb(nil, ec)
+			return cb(nil, ec)
 		}
 		if ack, err := r.DecodeAck(); err != nil {
 			log.Errorf("decode rpc %d response %v", pkt.Command(), err)
-			return r.cb(nil, int32(codes.InternalError))
+			return cb(nil, int32(codes.InternalError))
 		} else {
-			return r.cb(ack, 0)
+			return cb(ack, 0)
 		}
 	}
 	return nil
@@ -86,10 +150,12 @@ type RpcClient struct {
 	ctx          context.Context        //
 	wg           sync.WaitGroup         //
 	guard        sync.Mutex             // 多线程guard
-	pendingCtx   map[uint16]*RpcContext // 待响应的RPC
+	pendingCtx   map[uint32]*RpcContext // 待响应的RPC
+	streams      map[uint32]*RpcStream  // 进行中的流
 	pendingQueue chan fatchoy.IPacket   // 待发送消息队列
-	expired      []*RpcContext          // 超时的
-	counter      uint16                 // 序列号生成
+	expired      []*RpcContext          // 超时、取消或者经过拦截器完成的，在主线程回调
+	counter      uint32                 // 关联ID生成
+	interceptors []UnaryClientInterceptor
 }
 
 func NewRpcClient(ctx context.Context, queueSize int) *RpcClient {
@@ -97,7 +163,8 @@ func NewRpcClient(ctx context.Context, queueSize int) *RpcClient {
 		ctx:          ctx,
 		expired:      make([]*RpcContext, 0, 8),
 		pendingQueue: make(chan fatchoy.IPacket, queueSize),
-		pendingCtx:   make(map[uint16]*RpcContext),
+		pendingCtx:   make(map[uint32]*RpcContext),
+		streams:      make(map[uint32]*RpcStream),
 	}
 }
 
@@ -105,55 +172,232 @@ func (c *RpcClient) PendingQueue() <-chan fatchoy.IPacket {
 	return c.pendingQueue
 }
 
+// 添加拦截器，在Go()之前调用，先添加的在外层
+func (c *RpcClient) Use(interceptors ...UnaryClientInterceptor) {
+	c.interceptors = append(c.interceptors, interceptors...)
+}
+
 func (c *RpcClient) Go() {
 	c.wg.Add(1)
 	go c.reaper()
 }
 
 func (c *RpcClient) AsyncCall(node fatchoy.NodeID, req proto.Message, cb RpcHandler) error {
+	return c.AsyncCallContext(context.Background(), node, req, cb)
+}
+
+func (c *RpcClient) Call(node fatchoy.NodeID, req proto.Message) *RpcContext {
+	rpc, _ := c.CallContext(context.Background(), node, req)
+	return rpc
+}
+
+// 异步调用，ctx取消或者超时后立即移除待响应的RPC，回调在ReapTimeout里以Canceled或者DeadlineExceeded执行。
+// 有拦截器时整个调用链在单独的goroutine执行，完成后回调也在ReapTimeout里执行
+func (c *RpcClient) AsyncCallContext(ctx context.Context, node fatchoy.NodeID, req proto.Message, cb RpcHandler, opts ...CallOption) error {
+	ctx, cancel := applyCallOptions(ctx, opts)
+	if len(c.interceptors) > 0 {
+		var rpc = NewRpcContext(node, req, nil)
+		go func() {
+			defer cancel()
+			if err := c.intercept(ctx, rpc); err != nil {
+				rpc.ack = nil
+				rpc.errno = errorToCode(err)
+			}
+			rpc.cb = cb
+			c.complete(rpc)
+		}()
+		return nil
+	}
+
 	var rpc = NewRpcContext(node, req, cb)
-	c.makeCall(rpc)
+	if err := c.makeCall(ctx, rpc); err != nil {
+		cancel()
+		return err
+	}
+	if ctx.Done() == nil {
+		return nil
+	}
+	var finished = rpc.finished
+	go func() {
+		defer cancel()
+		select {
+		case <-ctx.Done():
+			c.cancelCall(rpc, ctx.Err())
+		case <-finished:
+		case <-c.ctx.Done():
+		}
+	}()
 	return nil
 }
 
-func (c *RpcClient) Call(node fatchoy.NodeID, req proto.Message) *RpcContext {
+// 同步调用，ctx取消或者超时后立即返回ctx.Err()
+func (c *RpcClient) CallContext(ctx context.Context, node fatchoy.NodeID, req proto.Message, opts ...CallOption) (*RpcContext, error) {
+	ctx, cancel := applyCallOptions(ctx, opts)
+	defer cancel()
 	var rpc = NewRpcContext(node, req, nil)
+	if err := c.intercept(ctx, rpc); err != nil {
+		return nil, err
+	}
+	return rpc, nil
+}
+
+// 同步调用并把响应解码到ack，响应的错误码以codes.Code返回
+func (c *RpcClient) Invoke(ctx context.Context, node fatchoy.NodeID, req, ack proto.Message, opts ...CallOption) error {
+	rpc, err := c.CallContext(ctx, node, req, opts...)
+	if err != nil {
+		return err
+	}
+	if errno := rpc.Errno(); errno != 0 {
+		return errno
+	}
+	return rpc.Ack().DecodeTo(ack)
+}
+
+// 经过拦截器执行调用
+func (c *RpcClient) intercept(ctx context.Context, rpc *RpcContext) error {
+	if len(c.interceptors) == 0 {
+		return c.invoke(ctx, rpc)
+	}
+	return ChainUnaryClient(c.interceptors...)(ctx, rpc, c.invoke)
+}
+
+// 发送请求并等待响应，可以被拦截器多次调用
+func (c *RpcClient) invoke(ctx context.Context, rpc *RpcContext) error {
+	rpc.ack = nil
 	rpc.done = make(chan *RpcContext, 1)
-	rpc = <-c.makeCall(rpc).done
-	return rpc
+	if err := c.makeCall(ctx, rpc); err != nil {
+		return err
+	}
+	select {
+	case <-rpc.done:
+		return nil
+	case <-ctx.Done():
+		if c.removePending(rpc) {
+			return ctx.Err()
+		}
+		// 已经被响应或者被reaper收走，等待结果
+		<-rpc.done
+		return nil
+	}
 }
 
-func (c *RpcClient) makeCall(ctx *RpcContext) *RpcContext {
-	c.guard.Lock()
-	defer c.guard.Unlock()
+func applyCallOptions(ctx context.Context, opts []CallOption) (context.Context, context.CancelFunc) {
+	var o callOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.timeout > 0 {
+		return context.WithTimeout(ctx, o.timeout)
+	}
+	return ctx, func() {}
+}
 
-	ctx.deadline = time.Now().Add(time.Minute) // 1分钟ttl
+func (c *RpcClient) makeCall(ctx context.Context, rpc *RpcContext) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rpc.finished = make(chan struct{})
+	rpc.deadline = time.Now().Add(time.Duration(RpcCallTimeout) * time.Second)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(rpc.deadline) {
+		rpc.deadline = deadline
+	}
+
+	c.guard.Lock()
 	c.counter++
 	if c.counter == 0 {
 		c.counter++
 	}
-	var seq = c.counter
-	c.pendingCtx[seq] = ctx
+	if _, found := c.pendingCtx[c.counter]; found {
+		c.guard.Unlock()
+		return ErrRpcIDCollision
+	}
+	rpc.id = c.counter
+	c.pendingCtx[rpc.id] = rpc
+	c.guard.Unlock()
 
-	var reqMsgID = packet.GetMessageIDOf(ctx.req)
-	var pkt = packet.New(reqMsgID, seq, fatchoy.PFlagRpc, ctx.req)
+	// seq保留关联ID的低16位，兼容不支持扩展字段的对端
+	var reqMsgID = packet.GetMessageIDOf(rpc.req)
+	var pkt = packet.New(reqMsgID, uint16(rpc.id), fatchoy.PFlagRpc, rpc.req)
+	pkt.SetExtension(&fatchoy.PacketExt{CorrelationID: rpc.id, Metadata: rpc.md})
 	pkt.SetType(fatchoy.PTypePacket)
-	pkt.SetNode(ctx.dest)
-	c.pendingQueue <- pkt // this may block
+	pkt.SetNode(rpc.dest)
+	select {
+	case c.pendingQueue <- pkt: // this may block
+		return nil
+	case <-ctx.Done():
+		c.removePending(rpc)
+		return ctx.Err()
+	}
+}
 
-	return ctx
+// 从待响应列表移除，返回false表示已经被移除
+func (c *RpcClient) removePending(rpc *RpcContext) bool {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	if c.pendingCtx[rpc.id] != rpc {
+		return false
+	}
+	delete(c.pendingCtx, rpc.id)
+	return true
+}
+
+// 取消异步调用，回调放到超时列表里在主线程执行
+func (c *RpcClient) cancelCall(rpc *RpcContext, err error) {
+	if !c.removePending(rpc) {
+		return
+	}
+	rpc.errno = codes.Canceled
+	if err == context.DeadlineExceeded {
+		rpc.errno = codes.DeadlineExceeded
+	}
+	c.complete(rpc)
+}
+
+// 放到超时列表里在主线程回调
+func (c *RpcClient) complete(rpc *RpcContext) {
+	c.guard.Lock()
+	c.expired = append(c.expired, rpc)
+	c.guard.Unlock()
+}
+
+// 待响应的RPC数量
+func (c *RpcClient) PendingCount() int {
+	c.guard.Lock()
+	var n = len(c.pendingCtx)
+	c.guard.Unlock()
+	return n
 }
 
-func (c *RpcClient) stripRpcContext(seq uint16) *RpcContext {
+func (c *RpcClient) stripRpcContext(id uint32) *RpcContext {
 	c.guard.Lock()
-	ctx, found := c.pendingCtx[seq]
+	ctx, found := c.pendingCtx[id]
 	if found {
-		delete(c.pendingCtx, seq)
+		delete(c.pendingCtx, id)
 	}
 	c.guard.Unlock()
 	return ctx
 }
 
+// 对端不支持扩展字段时只有seq，按关联ID的低16位查找，匹配多个调用时无法区分
+func (c *RpcClient) stripRpcContextBySeq(seq uint16) (*RpcContext, error) {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	var found *RpcContext
+	for id, ctx := range c.pendingCtx {
+		if uint16(id) != seq {
+			continue
+		}
+		if found != nil {
+			return nil, ErrRpcAmbiguousSeq
+		}
+		found = ctx
+	}
+	if found != nil {
+		delete(c.pendingCtx, found.id)
+	}
+	return found, nil
+}
+
 func (c *RpcClient) stripExpired() []*RpcContext {
 	c.guard.Lock()
 	var expired = c.expired
@@ -166,14 +410,16 @@ func (c *RpcClient) ReapTimeout() int {
 	var expired = c.stripExpired()
 	var n = len(expired)
 	for _, ctx := range expired {
-		var reqMsgID = packet.GetMessageIDOf(ctx.req)
-		var ackMsgID = packet.GetPairingAckID(reqMsgID)
-		var pkt = packet.Make()
-		packet.New(ackMsgID, 0, fatchoy.PFlagRpc, ctx.req)
-		pkt.SetType(fatchoy.PTypePacket)
-		pkt.SetErrno(int32(codes.RequestTimeout))
+		var pkt = ctx.ack
+		if pkt == nil {
+			var reqMsgID = packet.GetMessageIDOf(ctx.req)
+			var ackMsgID = packet.GetPairingAckID(reqMsgID)
+			pkt = packet.New(ackMsgID, uint16(ctx.id), fatchoy.PFlagRpc, nil)
+			pkt.SetExtension(&fatchoy.PacketExt{CorrelationID: ctx.id})
+			pkt.SetErrno(int32(ctx.errno))
+		}
 		if err := ctx.run(pkt); err != nil {
-			log.Errorf("rpc %d timed-out done: %v", ackMsgID, err)
+			log.Errorf("rpc %d timed-out done: %v", pkt.Command(), err)
 		}
 	}
 	return n
@@ -181,20 +427,35 @@ func (c *RpcClient) ReapTimeout() int {
 
 // 在主线程运行
 func (c *RpcClient) Dispatch(pkt fatchoy.IPacket) error {
-	var ctx = c.stripRpcContext(pkt.Seq())
+	var ext = pkt.Extension()
+	if !ext.IsEmpty() && ext.StreamID != 0 {
+		return c.dispatchStream(pkt)
+	}
+	var id = uint32(pkt.Seq())
+	var ctx *RpcContext
+	if !ext.IsEmpty() && ext.CorrelationID != 0 {
+		id = ext.CorrelationID
+		ctx = c.stripRpcContext(id)
+	} else {
+		var err error
+		if ctx, err = c.stripRpcContextBySeq(pkt.Seq()); err != nil {
+			return fmt.Errorf("rpc %d message %d: %w", id, pkt.Command(), err)
+		}
+	}
 	if ctx != nil {
 		return ctx.run(pkt)
 	}
-	return fmt.Errorf("session %d message %d rpc context not found ", pkt.Seq(), pkt.Command())
+	return fmt.Errorf("rpc %d message %d context not found", id, pkt.Command())
 }
 
 func (c *RpcClient) reapTimeout(now time.Time) {
 	c.guard.Lock()
 	defer c.guard.Unlock()
-	for seq, ctx := range c.pendingCtx {
+	for id, ctx := range c.pendingCtx {
 		if now.After(ctx.deadline) {
+			ctx.errno = codes.RequestTimeout
 			c.expired = append(c.expired, ctx)
-			delete(c.pendingCtx, seq)
+			delete(c.pendingCtx, id)
 		}
 	}
 }
@@ -202,7 +463,7 @@ func (c *RpcClient) reapTimeout(now time.Time) {
 // 处理超时
 func (c *RpcClient) reaper() {
 	defer c.wg.Done()
-	ticker := time.NewTicker(time.Second * 3)
+	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	for {
 		select {
@@ -0,0 +1,235 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+)
+
+// 熔断器状态
+type BreakerState int32
+
+const (
+	BreakerClosed   BreakerState = 0 // 正常放行
+	BreakerOpen     BreakerState = 1 // 熔断，直接返回codes.Unavailable
+	BreakerHalfOpen BreakerState = 2 // 放行少量探测请求
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "???"
+}
+
+var (
+	BreakerWindow         = 10   // 统计窗口，10s
+	BreakerMinRequests    = 20   // 窗口内请求数达到这个值才会熔断
+	BreakerErrorRate      = 0.5  // 错误率阈值
+	BreakerSlowCallRate   = 0.5  // 慢调用比例阈值
+	BreakerSlowCallMillis = 2000 // 超过这个耗时算慢调用，2s
+	BreakerOpenTimeout    = 5    // 熔断后多久进入半开，5s
+	BreakerHalfOpenProbes = 3    // 半开状态下连续成功这么多次后恢复
+)
+
+// 以秒为单位的统计桶
+type breakerBucket struct {
+	sec      int64
+	total    int
+	failures int
+	slow     int
+}
+
+// 单个节点的熔断器，按错误率和慢调用比例熔断
+type CircuitBreaker struct {
+	guard    sync.Mutex
+	state    BreakerState
+	buckets  []breakerBucket
+	openedAt time.Time
+	probes   int // 半开状态下已放行的探测请求
+	passed   int // 半开状态下成功的探测请求
+	now      func() time.Time
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		buckets: make([]breakerBucket, BreakerWindow),
+		now:     time.Now,
+	}
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.guard.Lock()
+	defer b.guard.Unlock()
+	b.tryHalfOpen()
+	return b.state
+}
+
+func (b *CircuitBreaker) tryHalfOpen() {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= time.Duration(BreakerOpenTimeout)*time.Second {
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.passed = 0
+	}
+}
+
+// 是否放行一个请求，放行后必须调用Record
+func (b *CircuitBreaker) Allow() bool {
+	b.guard.Lock()
+	defer b.guard.Unlock()
+	b.tryHalfOpen()
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probes >= BreakerHalfOpenProbes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// 记录一次调用的结果
+func (b *CircuitBreaker) Record(failed bool, elapsed time.Duration) {
+	b.guard.Lock()
+	defer b.guard.Unlock()
+	var slow = elapsed >= time.Duration(BreakerSlowCallMillis)*time.Millisecond
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed || slow {
+			b.open()
+			return
+		}
+		b.passed++
+		if b.passed >= BreakerHalfOpenProbes {
+			b.state = BreakerClosed
+			b.reset()
+		}
+	case BreakerClosed:
+		var bucket = b.bucket()
+		bucket.total++
+		if failed {
+			bucket.failures++
+		}
+		if slow {
+			bucket.slow++
+		}
+		b.check()
+	}
+}
+
+func (b *CircuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.now()
+}
+
+func (b *CircuitBreaker) reset() {
+	for i := range b.buckets {
+		b.buckets[i] = breakerBucket{}
+	}
+}
+
+// 当前秒的统计桶
+func (b *CircuitBreaker) bucket() *breakerBucket {
+	var sec = b.now().Unix()
+	var bucket = &b.buckets[sec%int64(len(b.buckets))]
+	if bucket.sec != sec {
+		*bucket = breakerBucket{sec: sec}
+	}
+	return bucket
+}
+
+func (b *CircuitBreaker) check() {
+	var sec = b.now().Unix()
+	var total, failures, slow int
+	for _, bucket := range b.buckets {
+		if sec-bucket.sec < int64(len(b.buckets)) {
+			total += bucket.total
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+	if total < BreakerMinRequests {
+		return
+	}
+	if float64(failures)/float64(total) >= BreakerErrorRate || float64(slow)/float64(total) >= BreakerSlowCallRate {
+		b.open()
+	}
+}
+
+// 表示后端不健康的错误码
+func isBackendFailure(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.RequestTimeout, codes.DeadlineExceeded, codes.InternalError,
+		codes.TransportFailure, codes.ServiceMaintenance:
+		return true
+	}
+	return false
+}
+
+// 按目标节点区分的熔断器
+type BreakerGroup struct {
+	guard    sync.Mutex
+	breakers map[fatchoy.NodeID]*CircuitBreaker
+}
+
+func NewBreakerGroup() *BreakerGroup {
+	return &BreakerGroup{
+		breakers: make(map[fatchoy.NodeID]*CircuitBreaker),
+	}
+}
+
+func (g *BreakerGroup) Get(node fatchoy.NodeID) *CircuitBreaker {
+	g.guard.Lock()
+	defer g.guard.Unlock()
+	var breaker = g.breakers[node]
+	if breaker == nil {
+		breaker = NewCircuitBreaker()
+		g.breakers[node] = breaker
+	}
+	return breaker
+}
+
+// 节点的熔断状态
+func (g *BreakerGroup) State(node fatchoy.NodeID) BreakerState {
+	g.guard.Lock()
+	var breaker = g.breakers[node]
+	g.guard.Unlock()
+	if breaker == nil {
+		return BreakerClosed
+	}
+	return breaker.State()
+}
+
+// 客户端拦截器，熔断的节点直接返回codes.Unavailable
+func (g *BreakerGroup) Interceptor() UnaryClientInterceptor {
+	return func(ctx context.Context, rpc *RpcContext, invoker RpcInvoker) error {
+		var breaker = g.Get(rpc.Node())
+		if !breaker.Allow() {
+			return codes.Unavailable
+		}
+		var start = time.Now()
+		var err = invoker(ctx, rpc)
+		var failed bool
+		if err != nil {
+			failed = isBackendFailure(errorToCode(err))
+		} else {
+			failed = isBackendFailure(rpc.Errno())
+		}
+		breaker.Record(failed, time.Since(start))
+		return err
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/discovery"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var now = time.Now()
+	var breaker = NewCircuitBreaker()
+	breaker.now = func() time.Time { return now }
+
+	for i := 0; i < BreakerMinRequests; i++ {
+		if !breaker.Allow() {
+			t.Fatalf("closed breaker should allow requests")
+		}
+		breaker.Record(i%2 == 0, time.Millisecond)
+	}
+	if s := breaker.State(); s != BreakerOpen {
+		t.Fatalf("unexpected state %v", s)
+	}
+	if breaker.Allow() {
+		t.Fatalf("open breaker should reject requests")
+	}
+
+	// 超时后半开，只放行有限的探测请求
+	now = now.Add(time.Duration(BreakerOpenTimeout) * time.Second)
+	for i := 0; i < BreakerHalfOpenProbes; i++ {
+		if !breaker.Allow() {
+			t.Fatalf("half-open breaker should allow probe %d", i)
+		}
+	}
+	if breaker.Allow() {
+		t.Fatalf("half-open breaker should limit probes")
+	}
+	for i := 0; i < BreakerHalfOpenProbes; i++ {
+		breaker.Record(false, time.Millisecond)
+	}
+	if s := breaker.State(); s != BreakerClosed {
+		t.Fatalf("unexpected state %v", s)
+	}
+
+	// 慢调用也会熔断，半开时探测失败重新熔断
+	for i := 0; i < BreakerMinRequests; i++ {
+		breaker.Allow()
+		breaker.Record(false, time.Duration(BreakerSlowCallMillis)*time.Millisecond)
+	}
+	if s := breaker.State(); s != BreakerOpen {
+		t.Fatalf("unexpected state %v", s)
+	}
+	now = now.Add(time.Duration(BreakerOpenTimeout) * time.Second)
+	breaker.Allow()
+	breaker.Record(true, time.Millisecond)
+	if s := breaker.State(); s != BreakerOpen {
+		t.Fatalf("unexpected state %v", s)
+	}
+}
+
+func TestBreakerInterceptor(t *testing.T) {
+	var client = NewRpcClient(context.Background(), 10)
+	var breakers = NewBreakerGroup()
+	client.Use(breakers.Interceptor())
+	var node = fatchoy.MakeNodeID(1, 1)
+	breakers.Get(node).open()
+
+	var start = time.Now()
+	_, err := client.CallContext(context.Background(), node, wrapperspb.String("ping"))
+	if err != codes.Unavailable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("open breaker should fail fast, took %v", elapsed)
+	}
+	if n := client.PendingCount(); n != 0 {
+		t.Fatalf("%d calls pending", n)
+	}
+}
+
+func TestNodeSelector(t *testing.T) {
+	var nodes = discovery.NewNodeMap()
+	for i := 1; i <= 3; i++ {
+		nodes.InsertNode(discovery.NewNode("game", uint16(i)))
+	}
+	var node1, node2, node3 = fatchoy.MakeNodeID(2, 1), fatchoy.MakeNodeID(2, 2), fatchoy.MakeNodeID(2, 3)
+
+	var selector = NewNodeSelector(nodes, "game", 2, SelectLeastPending)
+	selector.addPending(node1, 3)
+	selector.addPending(node2, 1)
+	selector.addPending(node3, 2)
+	for i := 0; i < 10; i++ {
+		if node, err := selector.Select(); err != nil || node != node2 {
+			t.Fatalf("least pending: %v, %v", node, err)
+		}
+	}
+
+	// 两个节点时p2c总是选负载低的
+	nodes.DeleteNode("game", 3)
+	selector = NewNodeSelector(nodes, "game", 2, SelectP2C)
+	selector.addPending(node1, 5)
+	for i := 0; i < 10; i++ {
+		if node, err := selector.Select(); err != nil || node != node2 {
+			t.Fatalf("p2c: %v, %v", node, err)
+		}
+	}
+
+	// 跳过熔断的节点，都熔断时快速失败
+	var breakers = NewBreakerGroup()
+	selector.SetBreakers(breakers)
+	breakers.Get(node2).open()
+	if node, err := selector.Select(); err != nil || node != node1 {
+		t.Fatalf("breaker: %v, %v", node, err)
+	}
+	breakers.Get(node1).open()
+	if _, err := selector.Select(); err != codes.Unavailable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+)
+
+// 一个节点的调用结果
+type RpcResult struct {
+	Node fatchoy.NodeID
+	Rpc  *RpcContext // 收到响应时不为nil
+	Err  error       // 调用失败，或者响应的错误码(codes.Code)
+}
+
+// 广播调用的结果
+type GatherResult struct {
+	Acks   map[fatchoy.NodeID]*RpcContext // 成功响应的节点
+	Errors map[fatchoy.NodeID]error       // 失败的节点
+}
+
+// 有节点失败时返回*GatherError
+func (r *GatherResult) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return &GatherError{Total: len(r.Acks) + len(r.Errors), Errors: r.Errors}
+}
+
+type GatherError struct {
+	Total  int
+	Errors map[fatchoy.NodeID]error
+}
+
+func (e *GatherError) Error() string {
+	return fmt.Sprintf("rpc gather: %d of %d nodes failed", len(e.Errors), e.Total)
+}
+
+// 从nodes里选出匹配target的节点，target可以使用SERVICE_ALL/INSTANCE_ALL
+func ExpandNodes(target fatchoy.NodeID, nodes []fatchoy.NodeID) []fatchoy.NodeID {
+	var list = make([]fatchoy.NodeID, 0, len(nodes))
+	for _, node := range nodes {
+		if target.Match(node) {
+			list = append(list, node)
+		}
+	}
+	return list
+}
+
+func (c *RpcClient) callNode(ctx context.Context, node fatchoy.NodeID, req proto.Message, opts []CallOption) *RpcResult {
+	rpc, err := c.CallContext(ctx, node, req, opts...)
+	if err == nil {
+		if errno := rpc.Errno(); errno != 0 {
+			err = errno
+		}
+	}
+	return &RpcResult{Node: node, Rpc: rpc, Err: err}
+}
+
+// 对冲调用，先发给nodes[0]，每过delay没有结果或者节点不可用时发给下一个节点，
+// 返回第一个不是后端故障的响应并取消其余调用，所有节点都失败时返回最后的响应和错误
+func (c *RpcClient) Hedge(ctx context.Context, nodes []fatchoy.NodeID, delay time.Duration, req proto.Message, opts ...CallOption) (*RpcContext, error) {
+	if len(nodes) == 0 {
+		return nil, codes.Unavailable
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var results = make(chan *RpcResult, len(nodes))
+	var sent, received int
+	var send = func() {
+		var node = nodes[sent]
+		sent++
+		go func() {
+			results <- c.callNode(ctx, node, req, opts)
+		}()
+	}
+	send()
+	var timer = time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-results:
+			received++
+			var code codes.Code
+			if r.Err == nil || (errors.As(r.Err, &code) && !isBackendFailure(code)) {
+				if r.Rpc == nil {
+					return nil, r.Err // 没有收到响应，比如被拦截器拒绝
+				}
+				return r.Rpc, nil
+			}
+			if received == len(nodes) {
+				return r.Rpc, r.Err
+			}
+			if sent == received {
+				send()
+			}
+		case <-timer.C:
+			if sent < len(nodes) {
+				send()
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 把请求发给所有节点，每个节点的结果发送到返回的channel，全部完成后channel被关闭
+func (c *RpcClient) Broadcast(ctx context.Context, nodes []fatchoy.NodeID, req proto.Message, opts ...CallOption) <-chan *RpcResult {
+	var results = make(chan *RpcResult, len(nodes))
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node fatchoy.NodeID) {
+			defer wg.Done()
+			results <- c.callNode(ctx, node, req, opts)
+		}(node)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// 广播并等待所有节点的结果
+func (c *RpcClient) Gather(ctx context.Context, nodes []fatchoy.NodeID, req proto.Message, opts ...CallOption) *GatherResult {
+	var result = &GatherResult{
+		Acks:   make(map[fatchoy.NodeID]*RpcContext),
+		Errors: make(map[fatchoy.NodeID]error),
+	}
+	for r := range c.Broadcast(ctx, nodes, req, opts...) {
+		if r.Err != nil {
+			result.Errors[r.Node] = r.Err
+		} else {
+			result.Acks[r.Node] = r.Rpc
+		}
+	}
+	return result
+}
@@ -0,0 +1,127 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/internal/testpb"
+)
+
+// 实例1不响应，实例2返回codes.Unavailable，实例3返回codes.NotFound，其余正常响应
+type groupService struct{}
+
+func (s *groupService) Echo(ctx context.Context, req *testpb.EchoReq) (*testpb.EchoAck, error) {
+	var node = PacketFromContext(ctx).Node()
+	switch node.Instance() {
+	case 2:
+		return nil, codes.Unavailable
+	case 3:
+		return nil, codes.NotFound
+	}
+	return &testpb.EchoAck{Text: node.String()}, nil
+}
+
+func startGroupServer(t *testing.T) (*RpcClient, func()) {
+	registerTestMessages()
+	var server = NewRpcServer()
+	if err := server.RegisterService(&groupService{}); err != nil {
+		t.Fatalf("RegisterService: %v", err)
+	}
+	return startRpcPairFilter(t, server, func(pkt fatchoy.IPacket) bool {
+		return pkt.Node().Instance() == 1
+	})
+}
+
+func TestRpcHedge(t *testing.T) {
+	client, stop := startGroupServer(t)
+	defer stop()
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var node1, node2, node3, node4 = fatchoy.MakeNodeID(1, 1), fatchoy.MakeNodeID(1, 2), fatchoy.MakeNodeID(1, 3), fatchoy.MakeNodeID(1, 4)
+	var req = &testpb.EchoReq{Text: "hedge"}
+
+	// 实例1卡住，delay后发给实例2，不可用时立即发给实例4
+	rpc, err := client.Hedge(ctx, []fatchoy.NodeID{node1, node2, node4}, 50*time.Millisecond, req)
+	if err != nil || rpc.Errno() != 0 || rpc.Node() != node4 {
+		t.Fatalf("Hedge: %v, %v", rpc, err)
+	}
+	// 业务错误码直接返回
+	rpc, err = client.Hedge(ctx, []fatchoy.NodeID{node3, node4}, time.Second, req)
+	if err != nil || rpc.Errno() != codes.NotFound {
+		t.Fatalf("Hedge: %v, %v", rpc, err)
+	}
+	// 所有节点都失败时返回最后的结果和错误
+	rpc, err = client.Hedge(ctx, []fatchoy.NodeID{node2}, time.Second, req)
+	if err != codes.Unavailable || rpc == nil || rpc.Errno() != codes.Unavailable {
+		t.Fatalf("Hedge: %v, %v", rpc, err)
+	}
+	var shortCtx, shortCancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer shortCancel()
+	if _, err = client.Hedge(shortCtx, []fatchoy.NodeID{node1}, time.Second, req); err != context.DeadlineExceeded {
+		t.Fatalf("Hedge: unexpected error %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := client.PendingCount(); n != 0 {
+		t.Fatalf("%d calls pending", n)
+	}
+}
+
+func TestRpcGather(t *testing.T) {
+	client, stop := startGroupServer(t)
+	defer stop()
+	var ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	var known []fatchoy.NodeID
+	for i := uint16(1); i <= 5; i++ {
+		known = append(known, fatchoy.MakeNodeID(1, i), fatchoy.MakeNodeID(2, i))
+	}
+	var nodes = ExpandNodes(fatchoy.MakeNodeID(1, fatchoy.INSTANCE_ALL), known)
+	if len(nodes) != 5 {
+		t.Fatalf("unexpected nodes %v", nodes)
+	}
+	var result = client.Gather(ctx, nodes, &testpb.EchoReq{Text: "gather"})
+	if len(result.Acks) != 2 || len(result.Errors) != 3 {
+		t.Fatalf("unexpected result %v", result)
+	}
+	for _, i := range []uint16{4, 5} {
+		var node = fatchoy.MakeNodeID(1, i)
+		ack, err := result.Acks[node].DecodeAck()
+		if err != nil || ack.(*testpb.EchoAck).Text != node.String() {
+			t.Fatalf("node %v: %v, %v", node, ack, err)
+		}
+	}
+	var expected = map[uint16]error{1: context.DeadlineExceeded, 2: codes.Unavailable, 3: codes.NotFound}
+	for i, err := range expected {
+		if e := result.Errors[fatchoy.MakeNodeID(1, i)]; e != err {
+			t.Fatalf("node %d: expect error %v, got %v", i, err, e)
+		}
+	}
+	gerr, ok := result.Err().(*GatherError)
+	if !ok || gerr.Total != 5 || len(gerr.Errors) != 3 {
+		t.Fatalf("unexpected error %v", result.Err())
+	}
+}
+
+// 拦截器拒绝的调用没有响应，返回拦截器的错误
+func TestRpcHedgeInterceptor(t *testing.T) {
+	client, stop := startGroupServer(t)
+	defer stop()
+	client.Use(func(ctx context.Context, rpc *RpcContext, invoker RpcInvoker) error {
+		return codes.PermissionDenied
+	})
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var nodes = []fatchoy.NodeID{fatchoy.MakeNodeID(1, 4), fatchoy.MakeNodeID(1, 5)}
+	rpc, err := client.Hedge(ctx, nodes, time.Second, &testpb.EchoReq{Text: "hedge"})
+	if err != codes.PermissionDenied || rpc != nil {
+		t.Fatalf("Hedge: %v, %v", rpc, err)
+	}
+}
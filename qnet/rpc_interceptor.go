@@ -0,0 +1,96 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+)
+
+// 执行一次RPC调用，返回nil时rpc.Ack()为响应
+type RpcInvoker func(ctx context.Context, rpc *RpcContext) error
+
+// 客户端拦截器，可以在调用invoker前后做处理，也可以多次调用invoker实现重试
+type UnaryClientInterceptor func(ctx context.Context, rpc *RpcContext, invoker RpcInvoker) error
+
+// 把多个客户端拦截器组合为一个，第一个在最外层
+func ChainUnaryClient(interceptors ...UnaryClientInterceptor) UnaryClientInterceptor {
+	return func(ctx context.Context, rpc *RpcContext, invoker RpcInvoker) error {
+		return chainClientInvoker(interceptors, 0, invoker)(ctx, rpc)
+	}
+}
+
+func chainClientInvoker(interceptors []UnaryClientInterceptor, i int, invoker RpcInvoker) RpcInvoker {
+	if i == len(interceptors) {
+		return invoker
+	}
+	return func(ctx context.Context, rpc *RpcContext) error {
+		return interceptors[i](ctx, rpc, chainClientInvoker(interceptors, i+1, invoker))
+	}
+}
+
+// 服务端handler
+type UnaryHandler func(ctx context.Context, req proto.Message) (proto.Message, error)
+
+// 服务端调用信息
+type RpcServerInfo struct {
+	Method string          // 请求消息名称
+	Packet fatchoy.IPacket // 请求packet
+}
+
+// 服务端拦截器
+type UnaryServerInterceptor func(ctx context.Context, req proto.Message, info *RpcServerInfo, handler UnaryHandler) (proto.Message, error)
+
+// 把多个服务端拦截器组合为一个，第一个在最外层
+func ChainUnaryServer(interceptors ...UnaryServerInterceptor) UnaryServerInterceptor {
+	return func(ctx context.Context, req proto.Message, info *RpcServerInfo, handler UnaryHandler) (proto.Message, error) {
+		return chainServerHandler(interceptors, 0, info, handler)(ctx, req)
+	}
+}
+
+func chainServerHandler(interceptors []UnaryServerInterceptor, i int, info *RpcServerInfo, handler UnaryHandler) UnaryHandler {
+	if i == len(interceptors) {
+		return handler
+	}
+	return func(ctx context.Context, req proto.Message) (proto.Message, error) {
+		return interceptors[i](ctx, req, info, chainServerHandler(interceptors, i+1, info, handler))
+	}
+}
+
+// 给每个请求添加元数据
+func MetadataInterceptor(md map[string]string) UnaryClientInterceptor {
+	return func(ctx context.Context, rpc *RpcContext, invoker RpcInvoker) error {
+		for k, v := range md {
+			rpc.SetMetadata(k, v)
+		}
+		return invoker(ctx, rpc)
+	}
+}
+
+// 响应错误码为codes.Unavailable时重试，最多重试maxRetry次，每次间隔backoff
+func RetryInterceptor(maxRetry int, backoff time.Duration) UnaryClientInterceptor {
+	return func(ctx context.Context, rpc *RpcContext, invoker RpcInvoker) error {
+		for i := 0; ; i++ {
+			if err := invoker(ctx, rpc); err != nil {
+				return err
+			}
+			if rpc.Errno() != codes.Unavailable || i >= maxRetry {
+				return nil
+			}
+			var timer = time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/internal/testpb"
+)
+
+func TestRpcInterceptors(t *testing.T) {
+	registerTestMessages()
+
+	var guard sync.Mutex
+	var trace []string
+	var record = func(s string) {
+		guard.Lock()
+		trace = append(trace, s)
+		guard.Unlock()
+	}
+
+	// 前两次请求返回Unavailable
+	var attempts int
+	var server = NewRpcServer()
+	server.Register(func(ctx context.Context, req *testpb.EchoReq) (*testpb.EchoAck, error) {
+		attempts++
+		if attempts <= 2 {
+			return nil, codes.Unavailable
+		}
+		return &testpb.EchoAck{Text: MetadataFromContext(ctx)["token"]}, nil
+	})
+	server.Use(func(ctx context.Context, req proto.Message, info *RpcServerInfo, handler UnaryHandler) (proto.Message, error) {
+		record("server:" + info.Method)
+		if MetadataFromContext(ctx)["token"] == "" {
+			return nil, codes.Unauthenticated
+		}
+		return handler(ctx, req)
+	})
+
+	client, stop := startRpcPair(t, server)
+	defer stop()
+	client.Use(
+		func(ctx context.Context, rpc *RpcContext, invoker RpcInvoker) error {
+			record("client:begin")
+			var err = invoker(ctx, rpc)
+			record("client:end")
+			return err
+		},
+		RetryInterceptor(3, time.Millisecond),
+		MetadataInterceptor(map[string]string{"token": "abc"}),
+	)
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rpc, err := client.CallContext(ctx, 2, &testpb.EchoReq{Text: "hello"})
+	if err != nil {
+		t.Fatalf("CallContext: %v", err)
+	}
+	ack, err := rpc.DecodeAck()
+	if err != nil {
+		t.Fatalf("DecodeAck: %v", err)
+	}
+	if s := ack.(*testpb.EchoAck).Text; s != "abc" {
+		t.Fatalf("unexpected ack %q", s)
+	}
+	var expected = "client:begin,server:testpb.EchoReq,server:testpb.EchoReq,server:testpb.EchoReq,client:end"
+	if s := strings.Join(trace, ","); s != expected {
+		t.Fatalf("unexpected trace %s", s)
+	}
+
+	// 异步调用经过拦截器后在ReapTimeout里回调
+	attempts = 0
+	var result = make(chan int32, 1)
+	err = client.AsyncCallContext(ctx, 2, &testpb.EchoReq{Text: "hello"}, func(ack proto.Message, ec int32) error {
+		result <- ec
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("AsyncCallContext: %v", err)
+	}
+	for client.ReapTimeout() == 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("async call not completed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if ec := <-result; ec != 0 {
+		t.Fatalf("unexpected errno %v", codes.Code(ec))
+	}
+}
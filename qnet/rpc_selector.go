@@ -0,0 +1,136 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/discovery"
+)
+
+// 节点选择策略
+type SelectPolicy int
+
+const (
+	SelectLeastPending SelectPolicy = 0 // 待响应请求最少的节点
+	SelectP2C          SelectPolicy = 1 // 随机选两个，取待响应请求少的
+)
+
+// 从discovery.NodeMap里某一类型的服务实例中选择节点
+type NodeSelector struct {
+	guard    sync.Mutex
+	nodes    *discovery.NodeMap
+	nodeType string                 // 服务类型
+	service  uint8                  // 服务类型对应的NodeID服务号
+	policy   SelectPolicy           //
+	breakers *BreakerGroup          // 跳过熔断的节点
+	pending  map[fatchoy.NodeID]int // 每个节点待响应的请求数
+	rand     *rand.Rand             //
+}
+
+func NewNodeSelector(nodes *discovery.NodeMap, nodeType string, service uint8, policy SelectPolicy) *NodeSelector {
+	return &NodeSelector{
+		nodes:    nodes,
+		nodeType: nodeType,
+		service:  service,
+		policy:   policy,
+		pending:  make(map[fatchoy.NodeID]int),
+		rand:     rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// 设置熔断器，熔断的节点不会被选中
+func (s *NodeSelector) SetBreakers(breakers *BreakerGroup) {
+	s.breakers = breakers
+}
+
+// 可用的节点
+func (s *NodeSelector) candidates() []fatchoy.NodeID {
+	var nodes = s.nodes.GetNodes(s.nodeType)
+	var list = make([]fatchoy.NodeID, 0, len(nodes))
+	for _, node := range nodes {
+		var id = fatchoy.MakeNodeID(s.service, node.ID())
+		if s.breakers != nil && s.breakers.State(id) == BreakerOpen {
+			continue
+		}
+		list = append(list, id)
+	}
+	return list
+}
+
+// 所有可用的节点，用于广播
+func (s *NodeSelector) Nodes() []fatchoy.NodeID {
+	return s.candidates()
+}
+
+// 选择一个节点，没有可用节点时返回codes.Unavailable
+func (s *NodeSelector) Select() (fatchoy.NodeID, error) {
+	var list = s.candidates()
+	if len(list) == 0 {
+		return 0, codes.Unavailable
+	}
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	switch s.policy {
+	case SelectP2C:
+		if len(list) == 1 {
+			return list[0], nil
+		}
+		var i = s.rand.Intn(len(list))
+		var j = s.rand.Intn(len(list) - 1)
+		if j >= i {
+			j++
+		}
+		if s.pending[list[j]] < s.pending[list[i]] {
+			return list[j], nil
+		}
+		return list[i], nil
+
+	default:
+		// 从随机位置开始找，负载相同时分散到不同节点
+		var start = s.rand.Intn(len(list))
+		var best = list[start]
+		for k := 1; k < len(list); k++ {
+			var node = list[(start+k)%len(list)]
+			if s.pending[node] < s.pending[best] {
+				best = node
+			}
+		}
+		return best, nil
+	}
+}
+
+// 节点待响应的请求数
+func (s *NodeSelector) Pending(node fatchoy.NodeID) int {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return s.pending[node]
+}
+
+func (s *NodeSelector) addPending(node fatchoy.NodeID, delta int) {
+	s.guard.Lock()
+	s.pending[node] += delta
+	if s.pending[node] <= 0 {
+		delete(s.pending, node)
+	}
+	s.guard.Unlock()
+}
+
+// 选择节点并同步调用
+func (s *NodeSelector) CallContext(ctx context.Context, client *RpcClient, req proto.Message, opts ...CallOption) (*RpcContext, error) {
+	node, err := s.Select()
+	if err != nil {
+		return nil, err
+	}
+	s.addPending(node, 1)
+	defer s.addPending(node, -1)
+	return client.CallContext(ctx, node, req, opts...)
+}
@@ -0,0 +1,232 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/debug"
+	"qchen.fun/fatchoy/log"
+	"qchen.fun/fatchoy/packet"
+)
+
+var (
+	ErrRpcHandlerNotFound = errors.New("rpc handler not found")
+
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
+)
+
+type rpcPacketKey struct{}
+
+// 获取handler正在处理的请求packet
+func PacketFromContext(ctx context.Context) fatchoy.IPacket {
+	pkt, _ := ctx.Value(rpcPacketKey{}).(fatchoy.IPacket)
+	return pkt
+}
+
+// 获取请求携带的元数据
+func MetadataFromContext(ctx context.Context) map[string]string {
+	if pkt := PacketFromContext(ctx); pkt != nil {
+		if ext := pkt.Extension(); ext != nil {
+			return ext.Metadata
+		}
+	}
+	return nil
+}
+
+// 一个注册的RPC方法
+type rpcMethod struct {
+	name    string        // 请求消息名称
+	fn      reflect.Value // func(context.Context, *FooReq) (*FooAck, error)
+	reqType reflect.Type  // *FooReq
+	ackType reflect.Type  // *FooAck
+}
+
+func (m *rpcMethod) call(ctx context.Context, req proto.Message) (proto.Message, error) {
+	var out = m.fn.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(req)})
+	var err, _ = out[1].Interface().(error)
+	if err != nil {
+		return nil, err
+	}
+	if out[0].IsNil() {
+		return reflect.New(m.ackType.Elem()).Interface().(proto.Message), nil
+	}
+	return out[0].Interface().(proto.Message), nil
+}
+
+// RPC服务端，按请求消息ID分发到注册的handler
+type RpcServer struct {
+	methods       map[int32]*rpcMethod
+	streamMethods map[int32]*rpcStreamMethod
+	interceptors  []UnaryServerInterceptor
+	guard         sync.Mutex
+	streams       map[rpcStreamKey]*RpcStream      // 进行中的流
+	watched       map[fatchoy.MessageEndpoint]bool // 已经监听关闭的endpoint
+}
+
+func NewRpcServer() *RpcServer {
+	return &RpcServer{
+		methods:       make(map[int32]*rpcMethod),
+		streamMethods: make(map[int32]*rpcStreamMethod),
+		streams:       make(map[rpcStreamKey]*RpcStream),
+		watched:       make(map[fatchoy.MessageEndpoint]bool),
+	}
+}
+
+// 添加拦截器，先添加的在外层
+func (s *RpcServer) Use(interceptors ...UnaryServerInterceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+// 注册一个handler，形如func(context.Context, *FooReq) (*FooAck, error)，
+// FooReq和FooAck需要通过packet.RegisterMsgID注册消息ID
+func (s *RpcServer) Register(handler interface{}) error {
+	var fn = reflect.ValueOf(handler)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return fmt.Errorf("rpc handler %T is not a function", handler)
+	}
+	var ft = fn.Type()
+	if ft.NumIn() != 2 || ft.NumOut() != 2 || ft.In(0) != typeOfContext || ft.Out(1) != typeOfError {
+		return fmt.Errorf("rpc handler %v has invalid signature", ft)
+	}
+	var reqType, ackType = ft.In(1), ft.Out(0)
+	if reqType.Kind() != reflect.Ptr || !reqType.Implements(typeOfMessage) ||
+		ackType.Kind() != reflect.Ptr || !ackType.Implements(typeOfMessage) {
+		return fmt.Errorf("rpc handler %v has invalid signature", ft)
+	}
+	var reqName = reqType.Elem().String()
+	var ackName = ackType.Elem().String()
+	if !strings.HasSuffix(reqName, "Req") || packet.GetPairingAckName(reqName) != ackName {
+		return fmt.Errorf("rpc handler %s -> %s not match Req/Ack naming", reqName, ackName)
+	}
+	var msgId = packet.GetMessageIDByName(reqName)
+	if msgId == 0 {
+		return fmt.Errorf("rpc request %s not registered", reqName)
+	}
+	if packet.GetMessageIDByName(ackName) == 0 {
+		return fmt.Errorf("rpc response %s not registered", ackName)
+	}
+	if _, found := s.methods[msgId]; found {
+		return fmt.Errorf("duplicate rpc handler of %s", reqName)
+	}
+	s.methods[msgId] = &rpcMethod{
+		name:    reqName,
+		fn:      fn,
+		reqType: reqType,
+		ackType: ackType,
+	}
+	return nil
+}
+
+// 注册service对象所有符合handler签名的导出方法
+func (s *RpcServer) RegisterService(service interface{}) error {
+	var rv = reflect.ValueOf(service)
+	var n int
+	for i := 0; i < rv.NumMethod(); i++ {
+		var method = rv.Method(i)
+		var ft = method.Type()
+		if ft.NumIn() != 2 || ft.NumOut() != 2 || ft.In(0) != typeOfContext || ft.Out(1) != typeOfError {
+			continue
+		}
+		if err := s.Register(method.Interface()); err != nil {
+			return err
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("%T has no rpc handler", service)
+	}
+	return nil
+}
+
+// 是否有pkt对应的handler
+func (s *RpcServer) HasHandler(pkt fatchoy.IPacket) bool {
+	if ext := pkt.Extension(); ext != nil && ext.StreamID != 0 {
+		return true
+	}
+	_, found := s.methods[pkt.Command()]
+	return found
+}
+
+// 在主线程运行，解码请求并调用handler，把结果或者错误码回复给请求方。
+// 没有对应的handler时返回ErrRpcHandlerNotFound，由调用方继续处理
+func (s *RpcServer) Dispatch(ctx context.Context, pkt fatchoy.IPacket) error {
+	if ext := pkt.Extension(); ext != nil && ext.StreamID != 0 {
+		return s.dispatchStream(ctx, pkt)
+	}
+	var method, found = s.methods[pkt.Command()]
+	if !found {
+		return ErrRpcHandlerNotFound
+	}
+	var req, ok = pkt.Body().(proto.Message)
+	if !ok || reflect.TypeOf(req) != method.reqType {
+		req = reflect.New(method.reqType.Elem()).Interface().(proto.Message)
+		if err := pkt.DecodeTo(req); err != nil {
+			log.Errorf("decode rpc %s: %v", method.name, err)
+			return pkt.Refuse(int32(codes.BadRequest))
+		}
+	}
+	var info = &RpcServerInfo{Method: method.name, Packet: pkt}
+	ack, err := s.invoke(context.WithValue(ctx, rpcPacketKey{}, pkt), info, method, req)
+	if err != nil {
+		return pkt.Refuse(int32(handlerErrorToCode(method.name, err)))
+	}
+	return pkt.Reply(ack)
+}
+
+// 经过拦截器调用handler，panic转为codes.InternalError
+func (s *RpcServer) invoke(ctx context.Context, info *RpcServerInfo, method *rpcMethod, req proto.Message) (ack proto.Message, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			var sb strings.Builder
+			debug.Backtrace(v, &sb)
+			log.Errorf("rpc %s panic: %s", method.name, sb.String())
+			ack, err = nil, codes.InternalError
+		}
+	}()
+	if len(s.interceptors) == 0 {
+		return method.call(ctx, req)
+	}
+	ack, err = ChainUnaryServer(s.interceptors...)(ctx, req, info, method.call)
+	if err == nil && ack == nil {
+		ack = reflect.New(method.ackType.Elem()).Interface().(proto.Message)
+	}
+	return ack, err
+}
+
+// 错误转为错误码，非codes.Code的错误视为codes.InternalError，不记录日志，客户端也可以使用
+func errorToCode(err error) codes.Code {
+	var code codes.Code
+	if errors.As(err, &code) {
+		return code
+	}
+	switch err {
+	case context.Canceled:
+		return codes.Canceled
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	}
+	return codes.InternalError
+}
+
+// handler返回的错误转为错误码，非预期的错误记录日志
+func handlerErrorToCode(method string, err error) codes.Code {
+	var code = errorToCode(err)
+	if code == codes.InternalError && !errors.Is(err, codes.InternalError) {
+		log.Errorf("rpc handler %s: %v", method, err)
+	}
+	return code
+}
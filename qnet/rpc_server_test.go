@@ -0,0 +1,152 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/internal/testpb"
+	"qchen.fun/fatchoy/packet"
+)
+
+var registerOnce sync.Once
+
+func registerTestMessages() {
+	registerOnce.Do(func() {
+		packet.RegisterMsgID("testpb.msg_id")
+	})
+}
+
+type echoService struct{}
+
+func (s *echoService) Echo(ctx context.Context, req *testpb.EchoReq) (*testpb.EchoAck, error) {
+	switch req.Text {
+	case "missing":
+		return nil, codes.NotFound
+	case "panic":
+		panic("echo panic")
+	}
+	var pkt = PacketFromContext(ctx)
+	if pkt == nil {
+		return nil, codes.BadRequest
+	}
+	return &testpb.EchoAck{Text: req.Text}, nil
+}
+
+// 在一对连接上运行RpcClient和RpcServer
+func startRpcPair(t *testing.T, server *RpcServer) (*RpcClient, func()) {
+	return startRpcPairFilter(t, server, nil)
+}
+
+// drop返回true的请求不会被服务端处理
+func startRpcPairFilter(t *testing.T, server *RpcServer, drop func(pkt fatchoy.IPacket) bool) (*RpcClient, func()) {
+	var inbound = make(chan fatchoy.IPacket, 10)
+	a, b := makeTcpConnPair(t, nil, inbound)
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	var client = NewRpcClient(ctx, 10)
+	client.Go()
+	go func() {
+		for {
+			select {
+			case pkt := <-client.PendingQueue():
+				a.SendPacket(pkt)
+			case pkt := <-inbound:
+				if pkt.Endpoint() == b {
+					if drop == nil || !drop(pkt) {
+						server.Dispatch(ctx, pkt)
+					}
+				} else {
+					client.Dispatch(pkt)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return client, func() {
+		cancel()
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestRpcServerDispatch(t *testing.T) {
+	registerTestMessages()
+	var server = NewRpcServer()
+	if err := server.RegisterService(&echoService{}); err != nil {
+		t.Fatalf("RegisterService: %v", err)
+	}
+	client, stop := startRpcPair(t, server)
+	defer stop()
+
+	tests := []struct {
+		text  string
+		errno codes.Code
+	}{
+		{"hello", codes.OK},
+		{"missing", codes.NotFound},
+		{"panic", codes.InternalError},
+	}
+	for _, tc := range tests {
+		var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		rpc, err := client.CallContext(ctx, 2, &testpb.EchoReq{Text: tc.text})
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.text, err)
+		}
+		if ec := codes.Code(rpc.ack.Errno()); ec != tc.errno {
+			t.Fatalf("%s: unexpected errno %v", tc.text, ec)
+		}
+		if tc.errno != codes.OK {
+			continue
+		}
+		ack, err := rpc.DecodeAck()
+		if err != nil {
+			t.Fatalf("%s: DecodeAck: %v", tc.text, err)
+		}
+		if s := ack.(*testpb.EchoAck).Text; s != tc.text {
+			t.Fatalf("unexpected ack %q", s)
+		}
+	}
+}
+
+func TestRpcServerRegister(t *testing.T) {
+	registerTestMessages()
+	var server = NewRpcServer()
+	var echo = func(ctx context.Context, req *testpb.EchoReq) (*testpb.EchoAck, error) {
+		return nil, nil
+	}
+	if err := server.Register(echo); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := server.Register(echo); err == nil {
+		t.Fatalf("duplicate handler should be rejected")
+	}
+	var mismatch = func(ctx context.Context, req *testpb.EchoAck) (*testpb.EchoReq, error) {
+		return nil, nil
+	}
+	if err := server.Register(mismatch); err == nil {
+		t.Fatalf("handler not match Req/Ack naming should be rejected")
+	}
+	if err := server.Register(func(req *testpb.EchoReq) *testpb.EchoAck { return nil }); err == nil {
+		t.Fatalf("handler with invalid signature should be rejected")
+	}
+	var pkt = packet.New(packet.GetMessageIDOf(&testpb.EchoReq{}), 1, fatchoy.PFlagRpc, &testpb.EchoReq{})
+	if !server.HasHandler(pkt) {
+		t.Fatalf("handler not found")
+	}
+	pkt.SetCommand(1)
+	if err := server.Dispatch(context.Background(), pkt); err != ErrRpcHandlerNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
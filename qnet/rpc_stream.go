@@ -0,0 +1,566 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/debug"
+	"qchen.fun/fatchoy/log"
+	"qchen.fun/fatchoy/packet"
+)
+
+// 流式RPC，每一帧是一个带PFlagRpc的packet，扩展字段里有StreamID和StreamFlag：
+//
+//	open帧：客户端发起，body为请求消息
+//	数据帧：StreamFlag为0，body为任意注册过的消息，占用对端的一个窗口
+//	end帧：发送方不再发送数据
+//	window帧：body为4字节的窗口增量，接收方每消费半个窗口发送一次
+//	错误帧：PFlagError，body为错误码，流立即结束
+//
+// 两端的初始窗口都是RpcStreamWindow，服务端handler返回或者任意一方发送错误帧时流结束
+const (
+	StreamFlagOpen   = 0x01 // 打开流
+	StreamFlagEnd    = 0x02 // 结束发送
+	StreamFlagWindow = 0x04 // 窗口更新
+)
+
+var (
+	RpcStreamWindow = 32 // 流控窗口，消息个数
+
+	ErrStreamClosed          = errors.New("rpc stream closed")
+	ErrStreamSendClosed      = errors.New("rpc stream send closed")
+	ErrStreamMsgUnregistered = errors.New("rpc stream message not registered")
+	ErrStreamUnexpectedMsg   = errors.New("rpc stream unexpected message")
+)
+
+// 发送一帧
+type streamSender func(ctx context.Context, pkt fatchoy.IPacket) error
+
+// 流式RPC的一端
+type RpcStream struct {
+	ctx      context.Context
+	id       uint32
+	node     fatchoy.NodeID
+	sender   streamSender
+	recvq    chan fatchoy.IPacket // 收到的数据、end和错误帧
+	windowCh chan struct{}        // 窗口更新通知
+	done     chan struct{}        // 流结束时关闭
+	onFinish func()               // 流结束时调用
+	isClient bool                 // 客户端收到end帧时流结束
+
+	guard      sync.Mutex
+	credits    int   // 发送窗口
+	consumed   int   // 已消费但未通知对端的数据帧
+	sendClosed bool  // 已发送end
+	recvErr    error // 收到end或者错误帧后Recv返回的错误
+	err        error // 流结束的原因
+	ch         chan proto.Message
+}
+
+func newRpcStream(ctx context.Context, id uint32, node fatchoy.NodeID, sender streamSender) *RpcStream {
+	return &RpcStream{
+		ctx:      ctx,
+		id:       id,
+		node:     node,
+		sender:   sender,
+		recvq:    make(chan fatchoy.IPacket, RpcStreamWindow+2),
+		windowCh: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		credits:  RpcStreamWindow,
+	}
+}
+
+func (s *RpcStream) ID() uint32 {
+	return s.id
+}
+
+func (s *RpcStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *RpcStream) newFrame(command int32, flag uint8, body interface{}) *packet.Packet {
+	var pkt = packet.New(command, uint16(s.id), fatchoy.PFlagRpc, body)
+	pkt.SetNode(s.node)
+	pkt.SetExtension(&fatchoy.PacketExt{StreamID: s.id, StreamFlag: flag})
+	return pkt
+}
+
+// 发送一条消息，对端窗口用完时阻塞
+func (s *RpcStream) Send(msg proto.Message) error {
+	var command = packet.GetMessageIDOf(msg)
+	if command == 0 {
+		return fmt.Errorf("%w: %T", ErrStreamMsgUnregistered, msg)
+	}
+	for {
+		s.guard.Lock()
+		if s.err != nil {
+			s.guard.Unlock()
+			return s.sendError()
+		}
+		if s.sendClosed {
+			s.guard.Unlock()
+			return ErrStreamSendClosed
+		}
+		if s.credits > 0 {
+			s.credits--
+			s.guard.Unlock()
+			break
+		}
+		s.guard.Unlock()
+		select {
+		case <-s.windowCh:
+		case <-s.done:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	return s.sender(s.ctx, s.newFrame(command, 0, msg))
+}
+
+func (s *RpcStream) sendError() error {
+	if s.err == io.EOF {
+		return ErrStreamClosed
+	}
+	return s.err
+}
+
+// 结束发送，对端Recv返回io.EOF
+func (s *RpcStream) CloseSend() error {
+	s.guard.Lock()
+	if s.sendClosed || s.err != nil {
+		s.guard.Unlock()
+		return nil
+	}
+	s.sendClosed = true
+	s.guard.Unlock()
+	return s.sender(s.ctx, s.newFrame(0, StreamFlagEnd, []byte(nil)))
+}
+
+// 发送错误帧并结束流
+func (s *RpcStream) CloseWithError(code codes.Code) {
+	s.guard.Lock()
+	var closed = s.err != nil
+	s.guard.Unlock()
+	if closed {
+		return
+	}
+	var pkt = s.newFrame(0, 0, nil)
+	pkt.SetErrno(int32(code))
+	if err := s.sender(context.Background(), pkt); err != nil {
+		log.Errorf("stream %d send error frame: %v", s.id, err)
+	}
+	s.finish(code)
+}
+
+// 接收一条消息，对端结束时返回io.EOF，对端出错时返回codes.Code
+func (s *RpcStream) Recv() (proto.Message, error) {
+	s.guard.Lock()
+	var recvErr = s.recvErr
+	s.guard.Unlock()
+	if recvErr != nil {
+		return nil, recvErr
+	}
+	var pkt fatchoy.IPacket
+	select {
+	case pkt = <-s.recvq:
+	default:
+		select {
+		case pkt = <-s.recvq:
+		case <-s.done:
+			select {
+			case pkt = <-s.recvq:
+			default:
+				return nil, s.recvError()
+			}
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		}
+	}
+	return s.handleFrame(pkt)
+}
+
+func (s *RpcStream) recvError() error {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if s.recvErr == nil {
+		s.recvErr = s.err
+	}
+	return s.recvErr
+}
+
+func (s *RpcStream) handleFrame(pkt fatchoy.IPacket) (proto.Message, error) {
+	if ec := pkt.Errno(); ec > 0 {
+		s.guard.Lock()
+		s.recvErr = codes.Code(ec)
+		s.guard.Unlock()
+		return nil, codes.Code(ec)
+	}
+	if pkt.Extension().StreamFlag&StreamFlagEnd != 0 {
+		s.guard.Lock()
+		s.recvErr = io.EOF
+		s.guard.Unlock()
+		return nil, io.EOF
+	}
+	s.ackWindow()
+	if err := pkt.Decode(); err != nil {
+		return nil, err
+	}
+	return pkt.Body().(proto.Message), nil
+}
+
+// 每消费半个窗口通知对端
+func (s *RpcStream) ackWindow() {
+	s.guard.Lock()
+	s.consumed++
+	var n = s.consumed
+	if n < (RpcStreamWindow+1)/2 || s.err != nil {
+		s.guard.Unlock()
+		return
+	}
+	s.consumed = 0
+	s.guard.Unlock()
+	var buf = make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(n))
+	if err := s.sender(s.ctx, s.newFrame(0, StreamFlagWindow, buf)); err != nil {
+		log.Errorf("stream %d send window update: %v", s.id, err)
+	}
+}
+
+// 以channel的方式接收，流结束后channel被关闭，结束原因由Err()返回
+func (s *RpcStream) C() <-chan proto.Message {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan proto.Message)
+		go s.recvLoop(s.ch)
+	}
+	return s.ch
+}
+
+func (s *RpcStream) recvLoop(ch chan proto.Message) {
+	defer close(ch)
+	for {
+		msg, err := s.Recv()
+		if err != nil {
+			return
+		}
+		select {
+		case ch <- msg:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// 接收结束的原因，正常结束为nil
+func (s *RpcStream) Err() error {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	if s.recvErr == io.EOF {
+		return nil
+	}
+	if s.recvErr == nil && s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	return s.recvErr
+}
+
+// 处理对端发来的一帧，在主线程调用
+func (s *RpcStream) deliver(pkt fatchoy.IPacket) {
+	var ext = pkt.Extension()
+	if ext.StreamFlag&StreamFlagWindow != 0 && pkt.Errno() == 0 {
+		s.guard.Lock()
+		s.credits += int(pkt.BodyToInt())
+		s.guard.Unlock()
+		select {
+		case s.windowCh <- struct{}{}:
+		default:
+		}
+		return
+	}
+	select {
+	case s.recvq <- pkt:
+	default:
+		log.Errorf("stream %d recv window overflow", s.id)
+		s.CloseWithError(codes.ResourceExhausted)
+		return
+	}
+	if pkt.Errno() > 0 {
+		s.finish(codes.Code(pkt.Errno()))
+	} else if s.isClient && ext.StreamFlag&StreamFlagEnd != 0 {
+		s.finish(io.EOF)
+	}
+}
+
+// 结束流，只有第一次调用生效
+func (s *RpcStream) finish(err error) {
+	s.guard.Lock()
+	if s.err != nil {
+		s.guard.Unlock()
+		return
+	}
+	s.err = err
+	s.guard.Unlock()
+	if s.onFinish != nil {
+		s.onFinish()
+	}
+	close(s.done)
+}
+
+// 打开双向流，请求消息在open帧里发送
+func (c *RpcClient) OpenStream(ctx context.Context, node fatchoy.NodeID, req proto.Message, opts ...CallOption) (*RpcStream, error) {
+	return c.openStream(ctx, node, req, StreamFlagOpen, opts)
+}
+
+// 打开服务端流，客户端只发送请求消息
+func (c *RpcClient) OpenServerStream(ctx context.Context, node fatchoy.NodeID, req proto.Message, opts ...CallOption) (*RpcStream, error) {
+	return c.openStream(ctx, node, req, StreamFlagOpen|StreamFlagEnd, opts)
+}
+
+func (c *RpcClient) openStream(ctx context.Context, node fatchoy.NodeID, req proto.Message, flag uint8, opts []CallOption) (*RpcStream, error) {
+	var command = packet.GetMessageIDOf(req)
+	if command == 0 {
+		return nil, fmt.Errorf("%w: %T", ErrStreamMsgUnregistered, req)
+	}
+	ctx, cancel := applyCallOptions(ctx, opts)
+	if err := ctx.Err(); err != nil {
+		cancel()
+		return nil, err
+	}
+	var stream = newRpcStream(ctx, 0, node, c.sendStreamFrame)
+	stream.isClient = true
+	stream.sendClosed = flag&StreamFlagEnd != 0
+
+	c.guard.Lock()
+	c.counter++
+	if c.counter == 0 {
+		c.counter++
+	}
+	var id = c.counter
+	if _, found := c.streams[id]; found {
+		c.guard.Unlock()
+		cancel()
+		return nil, ErrRpcIDCollision
+	}
+	stream.id = id
+	c.streams[id] = stream
+	c.guard.Unlock()
+
+	stream.onFinish = func() {
+		c.guard.Lock()
+		delete(c.streams, id)
+		c.guard.Unlock()
+		cancel()
+	}
+	if err := c.sendStreamFrame(ctx, stream.newFrame(command, flag, req)); err != nil {
+		stream.finish(err)
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			var code = codes.Canceled
+			if ctx.Err() == context.DeadlineExceeded {
+				code = codes.DeadlineExceeded
+			}
+			stream.CloseWithError(code)
+		case <-stream.done:
+		}
+	}()
+	return stream, nil
+}
+
+func (c *RpcClient) sendStreamFrame(ctx context.Context, pkt fatchoy.IPacket) error {
+	select {
+	case c.pendingQueue <- pkt:
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *RpcClient) dispatchStream(pkt fatchoy.IPacket) error {
+	var id = pkt.Extension().StreamID
+	c.guard.Lock()
+	var stream = c.streams[id]
+	c.guard.Unlock()
+	if stream == nil {
+		return fmt.Errorf("rpc stream %d not found", id)
+	}
+	stream.deliver(pkt)
+	return nil
+}
+
+// 一个注册的流式RPC方法
+type rpcStreamMethod struct {
+	name    string        // 请求消息名称
+	fn      reflect.Value // func(context.Context, *FooReq, *RpcStream) error
+	reqType reflect.Type  // *FooReq
+}
+
+var typeOfStream = reflect.TypeOf((*RpcStream)(nil))
+
+type rpcStreamKey struct {
+	endpoint fatchoy.MessageEndpoint
+	id       uint32
+}
+
+// 注册流式handler，形如func(context.Context, *FooReq, *RpcStream) error，
+// handler返回nil时发送end帧，返回错误时发送错误帧
+func (s *RpcServer) RegisterStream(handler interface{}) error {
+	var fn = reflect.ValueOf(handler)
+	if fn.Kind() != reflect.Func || fn.IsNil() {
+		return fmt.Errorf("rpc stream handler %T is not a function", handler)
+	}
+	var ft = fn.Type()
+	if ft.NumIn() != 3 || ft.NumOut() != 1 || ft.In(0) != typeOfContext || ft.In(2) != typeOfStream || ft.Out(0) != typeOfError {
+		return fmt.Errorf("rpc stream handler %v has invalid signature", ft)
+	}
+	var reqType = ft.In(1)
+	if reqType.Kind() != reflect.Ptr || !reqType.Implements(typeOfMessage) {
+		return fmt.Errorf("rpc stream handler %v has invalid signature", ft)
+	}
+	var reqName = reqType.Elem().String()
+	var msgId = packet.GetMessageIDByName(reqName)
+	if msgId == 0 {
+		return fmt.Errorf("rpc request %s not registered", reqName)
+	}
+	if _, found := s.streamMethods[msgId]; found {
+		return fmt.Errorf("duplicate rpc stream handler of %s", reqName)
+	}
+	s.streamMethods[msgId] = &rpcStreamMethod{
+		name:    reqName,
+		fn:      fn,
+		reqType: reqType,
+	}
+	return nil
+}
+
+func (s *RpcServer) dispatchStream(ctx context.Context, pkt fatchoy.IPacket) error {
+	var ext = pkt.Extension()
+	var key = rpcStreamKey{endpoint: pkt.Endpoint(), id: ext.StreamID}
+	if ext.StreamFlag&StreamFlagOpen != 0 {
+		return s.openStream(ctx, key, pkt)
+	}
+	s.guard.Lock()
+	var stream = s.streams[key]
+	s.guard.Unlock()
+	if stream == nil {
+		return fmt.Errorf("rpc stream %d not found", key.id)
+	}
+	stream.deliver(pkt)
+	return nil
+}
+
+func (s *RpcServer) openStream(ctx context.Context, key rpcStreamKey, pkt fatchoy.IPacket) error {
+	var endpoint = pkt.Endpoint()
+	var sender = func(ctx context.Context, frame fatchoy.IPacket) error {
+		return endpoint.SendPacket(frame)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, rpcPacketKey{}, pkt))
+	var stream = newRpcStream(ctx, key.id, pkt.Node(), sender)
+	if pkt.Extension().StreamFlag&StreamFlagEnd != 0 {
+		stream.recvErr = io.EOF
+	}
+
+	var method, found = s.streamMethods[pkt.Command()]
+	if !found {
+		cancel()
+		stream.CloseWithError(codes.NotImplemented)
+		return nil
+	}
+	var req, ok = pkt.Body().(proto.Message)
+	if !ok || reflect.TypeOf(req) != method.reqType {
+		req = reflect.New(method.reqType.Elem()).Interface().(proto.Message)
+		if err := pkt.DecodeTo(req); err != nil {
+			log.Errorf("decode rpc stream %s: %v", method.name, err)
+			cancel()
+			stream.CloseWithError(codes.BadRequest)
+			return nil
+		}
+	}
+
+	s.guard.Lock()
+	if _, found := s.streams[key]; found {
+		s.guard.Unlock()
+		cancel()
+		return fmt.Errorf("duplicate rpc stream %d", key.id)
+	}
+	s.streams[key] = stream
+	stream.onFinish = func() {
+		s.guard.Lock()
+		delete(s.streams, key)
+		s.guard.Unlock()
+		cancel()
+	}
+	var hooker, watch = endpoint.(endpointCloseHooker)
+	watch = watch && !s.watched[endpoint]
+	if watch {
+		s.watched[endpoint] = true
+	}
+	s.guard.Unlock()
+	if watch {
+		hooker.AddCloseHook(func(fatchoy.Endpoint) { s.CloseEndpoint(endpoint) })
+	}
+	go s.serveStream(stream, method, req)
+	return nil
+}
+
+// 支持连接终止回调的endpoint，如TcpConn
+type endpointCloseHooker interface {
+	AddCloseHook(func(fatchoy.Endpoint))
+}
+
+// 结束endpoint上所有进行中的流并取消handler的ctx，阻塞在Send或者Recv的handler会立即返回。
+// TcpConn终止时会自动调用，其它endpoint需要在连接断开后调用
+func (s *RpcServer) CloseEndpoint(endpoint fatchoy.MessageEndpoint) {
+	var streams []*RpcStream
+	s.guard.Lock()
+	for key, stream := range s.streams {
+		if key.endpoint == endpoint {
+			streams = append(streams, stream)
+		}
+	}
+	delete(s.watched, endpoint)
+	s.guard.Unlock()
+	for _, stream := range streams {
+		stream.finish(ErrStreamClosed)
+	}
+}
+
+// 在单独的goroutine运行handler
+func (s *RpcServer) serveStream(stream *RpcStream, method *rpcStreamMethod, req proto.Message) {
+	defer func() {
+		if v := recover(); v != nil {
+			var sb strings.Builder
+			debug.Backtrace(v, &sb)
+			log.Errorf("rpc stream %s panic: %s", method.name, sb.String())
+			stream.CloseWithError(codes.InternalError)
+		}
+	}()
+	var out = method.fn.Call([]reflect.Value{reflect.ValueOf(stream.ctx), reflect.ValueOf(req), reflect.ValueOf(stream)})
+	if err, _ := out[0].Interface().(error); err != nil {
+		stream.CloseWithError(handlerErrorToCode(method.name, err))
+		return
+	}
+	if err := stream.CloseSend(); err != nil {
+		log.Errorf("rpc stream %s close: %v", method.name, err)
+	}
+	stream.finish(io.EOF)
+}
@@ -0,0 +1,244 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/internal/testpb"
+)
+
+const testStreamItems = 100 // 大于窗口，需要流控
+
+func startStreamServer(t *testing.T, canceled chan error) (*RpcClient, func()) {
+	registerTestMessages()
+	var server = NewRpcServer()
+	var err = server.RegisterStream(func(ctx context.Context, req *testpb.EchoReq, stream *RpcStream) error {
+		switch req.Text {
+		case "list":
+			for i := 0; i < testStreamItems; i++ {
+				if err := stream.Send(&testpb.EchoAck{Text: fmt.Sprintf("%d", i)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		case "echo":
+			for {
+				msg, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := stream.Send(&testpb.EchoAck{Text: msg.(*testpb.EchoReq).Text}); err != nil {
+					return err
+				}
+			}
+		case "fail":
+			stream.Send(&testpb.EchoAck{Text: "first"})
+			return codes.NotFound
+		case "wait":
+			stream.Send(&testpb.EchoAck{Text: "first"})
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return ctx.Err()
+		}
+		return codes.BadRequest
+	})
+	if err != nil {
+		t.Fatalf("RegisterStream: %v", err)
+	}
+	return startRpcPair(t, server)
+}
+
+func TestRpcServerStream(t *testing.T) {
+	client, stop := startStreamServer(t, nil)
+	defer stop()
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.OpenServerStream(ctx, 2, &testpb.EchoReq{Text: "list"})
+	if err != nil {
+		t.Fatalf("OpenServerStream: %v", err)
+	}
+	var n = 0
+	for msg := range stream.C() {
+		if s := msg.(*testpb.EchoAck).Text; s != fmt.Sprintf("%d", n) {
+			t.Fatalf("unexpected item %s at %d", s, n)
+		}
+		n++
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatalf("stream error: %v", err)
+	}
+	if n != testStreamItems {
+		t.Fatalf("expect %d items, got %d", testStreamItems, n)
+	}
+
+	// handler返回错误
+	stream, err = client.OpenServerStream(ctx, 2, &testpb.EchoReq{Text: "fail"})
+	if err != nil {
+		t.Fatalf("OpenServerStream: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if _, err := stream.Recv(); err != codes.NotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRpcBidiStream(t *testing.T) {
+	client, stop := startStreamServer(t, nil)
+	defer stop()
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.OpenStream(ctx, 2, &testpb.EchoReq{Text: "echo"})
+	if err != nil {
+		t.Fatalf("OpenStream: %v", err)
+	}
+	var sendErr = make(chan error, 1)
+	go func() {
+		for i := 0; i < testStreamItems; i++ {
+			if err := stream.Send(&testpb.EchoReq{Text: fmt.Sprintf("%d", i)}); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- stream.CloseSend()
+	}()
+	for i := 0; ; i++ {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			if i != testStreamItems {
+				t.Fatalf("expect %d items, got %d", testStreamItems, i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if s := msg.(*testpb.EchoAck).Text; s != fmt.Sprintf("%d", i) {
+			t.Fatalf("unexpected item %s at %d", s, i)
+		}
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := stream.Send(&testpb.EchoReq{}); err != ErrStreamClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRpcStreamCancel(t *testing.T) {
+	var canceled = make(chan error, 1)
+	client, stop := startStreamServer(t, canceled)
+	defer stop()
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	stream, err := client.OpenServerStream(ctx, 2, &testpb.EchoReq{Text: "wait"})
+	if err != nil {
+		t.Fatalf("OpenServerStream: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	cancel()
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server handler not canceled")
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Fatalf("canceled stream should fail")
+	}
+	select {
+	case <-stream.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("canceled stream not finished")
+	}
+	client.guard.Lock()
+	var n = len(client.streams)
+	client.guard.Unlock()
+	if n != 0 {
+		t.Fatalf("%d streams not removed", n)
+	}
+}
+
+// 客户端连接断开时，阻塞在Send的handler应该返回，流被移除
+func TestRpcStreamEndpointClosed(t *testing.T) {
+	registerTestMessages()
+	var result = make(chan error, 1)
+	var server = NewRpcServer()
+	var err = server.RegisterStream(func(ctx context.Context, req *testpb.EchoReq, stream *RpcStream) error {
+		for {
+			if err := stream.Send(&testpb.EchoAck{Text: req.Text}); err != nil {
+				result <- err
+				return err
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("RegisterStream: %v", err)
+	}
+
+	var inbound = make(chan fatchoy.IPacket, 10)
+	a, b := makeTcpConnPair(t, nil, inbound)
+	a.Go(fatchoy.EndpointReadWriter)
+	b.Go(fatchoy.EndpointReadWriter)
+	defer b.Close()
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var client = NewRpcClient(ctx, 10)
+	go func() {
+		for {
+			select {
+			case pkt := <-client.PendingQueue():
+				a.SendPacket(pkt)
+			case pkt := <-inbound:
+				if pkt.Endpoint() == b {
+					server.Dispatch(ctx, pkt)
+				} // 客户端不读取，服务端用完窗口后阻塞在Send
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if _, err := client.OpenServerStream(ctx, 2, &testpb.EchoReq{Text: "flood"}); err != nil {
+		t.Fatalf("OpenServerStream: %v", err)
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("handler returned before close: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	a.Close()
+	select {
+	case err := <-result:
+		if err != ErrStreamClosed && err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("handler still blocked after endpoint closed")
+	}
+	server.guard.Lock()
+	var n, w = len(server.streams), len(server.watched)
+	server.guard.Unlock()
+	if n != 0 || w != 0 {
+		t.Fatalf("%d streams and %d endpoints not removed", n, w)
+	}
+}
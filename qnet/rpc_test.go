@@ -0,0 +1,201 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codes"
+	"qchen.fun/fatchoy/packet"
+)
+
+func TestRpcCallContext(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var client = NewRpcClient(ctx, 10)
+	client.Go()
+
+	// 模拟服务端响应
+	go func() {
+		var req = <-client.PendingQueue()
+		var ack = packet.New(req.Command(), req.Seq(), req.Flag(), "pong")
+		client.Dispatch(ack)
+	}()
+	rpc, err := client.CallContext(ctx, 1, wrapperspb.String("ping"))
+	if err != nil {
+		t.Fatalf("CallContext: %v", err)
+	}
+	if s := rpc.ack.BodyToString(); s != "pong" {
+		t.Fatalf("unexpected ack %q", s)
+	}
+
+	// 没有响应，超时后立即返回，并且移除待响应的RPC
+	var start = time.Now()
+	_, err = client.CallContext(ctx, 1, wrapperspb.String("ping"), WithTimeout(50*time.Millisecond))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("call returned after %v", elapsed)
+	}
+	if n := client.PendingCount(); n != 0 {
+		t.Fatalf("%d calls still pending", n)
+	}
+}
+
+func TestRpcAsyncCallContextCancel(t *testing.T) {
+	var client = NewRpcClient(context.Background(), 10)
+	var ctx, cancel = context.WithCancel(context.Background())
+	var result = make(chan int32, 1)
+	var cb = func(ack proto.Message, ec int32) error {
+		result <- ec
+		return nil
+	}
+	if err := client.AsyncCallContext(ctx, 1, wrapperspb.String("ping"), cb); err != nil {
+		t.Fatalf("AsyncCallContext: %v", err)
+	}
+	if n := client.PendingCount(); n != 1 {
+		t.Fatalf("expect 1 pending call, got %d", n)
+	}
+	cancel()
+	var deadline = time.Now().Add(5 * time.Second)
+	for client.ReapTimeout() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("canceled call not reaped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if ec := <-result; ec != int32(codes.Canceled) {
+		t.Fatalf("unexpected errno %v", codes.Code(ec))
+	}
+	if n := client.PendingCount(); n != 0 {
+		t.Fatalf("%d calls still pending", n)
+	}
+
+	// 已取消的ctx不会发起调用
+	if err := client.AsyncCallContext(ctx, 1, wrapperspb.String("ping"), cb); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case pkt := <-client.PendingQueue():
+		if pkt.Errno() != 0 {
+			t.Fatalf("unexpected packet %v", pkt)
+		}
+	default:
+		t.Fatalf("first request not queued")
+	}
+	select {
+	case pkt := <-client.PendingQueue():
+		t.Fatalf("canceled request should not be queued: %v", pkt)
+	default:
+	}
+}
+
+func TestRpcReapTimeout(t *testing.T) {
+	var client = NewRpcClient(context.Background(), 10)
+	var result = make(chan int32, 1)
+	var cb = func(ack proto.Message, ec int32) error {
+		result <- ec
+		return nil
+	}
+	client.AsyncCall(1, wrapperspb.String("ping"), cb)
+	client.reapTimeout(time.Now().Add(time.Duration(RpcCallTimeout+1) * time.Second))
+	if n := client.ReapTimeout(); n != 1 {
+		t.Fatalf("expect 1 timed-out call, got %d", n)
+	}
+	if ec := <-result; ec != int32(codes.RequestTimeout) {
+		t.Fatalf("unexpected errno %v", codes.Code(ec))
+	}
+}
+
+func TestRpcIDCollision(t *testing.T) {
+	var client = NewRpcClient(context.Background(), 10)
+	var cb = func(ack proto.Message, ec int32) error { return nil }
+	if err := client.AsyncCall(1, wrapperspb.String("ping"), cb); err != nil {
+		t.Fatalf("AsyncCall: %v", err)
+	}
+	var req = <-client.PendingQueue()
+	if ext := req.Extension(); ext == nil || ext.CorrelationID != 1 {
+		t.Fatalf("unexpected extension %+v", ext)
+	}
+
+	// 回绕后与未完成的RPC冲突，不能覆盖
+	client.counter = math.MaxUint32
+	if err := client.AsyncCall(1, wrapperspb.String("ping"), cb); err != ErrRpcIDCollision {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := client.PendingCount(); n != 1 {
+		t.Fatalf("expect 1 pending call, got %d", n)
+	}
+
+	// 大于65535的关联ID通过扩展字段匹配
+	client.counter = 1 << 20
+	if err := client.AsyncCall(1, wrapperspb.String("ping"), cb); err != nil {
+		t.Fatalf("AsyncCall: %v", err)
+	}
+	req = <-client.PendingQueue()
+	var ack = packet.New(req.Command(), req.Seq(), req.Flag(), "pong")
+	ack.SetExtension(req.Extension())
+	if err := client.Dispatch(ack); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if n := client.PendingCount(); n != 1 {
+		t.Fatalf("expect 1 pending call, got %d", n)
+	}
+}
+
+// 响应的扩展里只有metadata，没有关联ID时按seq匹配
+func TestRpcDispatchWithoutCorrelationID(t *testing.T) {
+	var client = NewRpcClient(context.Background(), 10)
+	var cb = func(ack proto.Message, ec int32) error { return nil }
+	if err := client.AsyncCall(1, wrapperspb.String("ping"), cb); err != nil {
+		t.Fatalf("AsyncCall: %v", err)
+	}
+	var req = <-client.PendingQueue()
+	var ack = packet.New(req.Command(), req.Seq(), req.Flag(), "pong")
+	ack.SetExtension(&fatchoy.PacketExt{Metadata: map[string]string{"k": "v"}})
+	if err := client.Dispatch(ack); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if n := client.PendingCount(); n != 0 {
+		t.Fatalf("expect no pending call, got %d", n)
+	}
+
+	// 关联ID超过16位时按低16位匹配
+	client.counter = 0xFFFF
+	if err := client.AsyncCall(1, wrapperspb.String("ping"), cb); err != nil {
+		t.Fatalf("AsyncCall: %v", err)
+	}
+	req = <-client.PendingQueue()
+	if req.Seq() != 0 || req.Extension().CorrelationID != 0x10000 {
+		t.Fatalf("unexpected seq %d, id %d", req.Seq(), req.Extension().CorrelationID)
+	}
+	if err := client.Dispatch(packet.New(req.Command(), req.Seq(), req.Flag(), "pong")); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+
+	// 低16位相同的调用无法区分
+	for _, counter := range []uint32{0x10001, 0x20001} {
+		client.counter = counter
+		if err := client.AsyncCall(1, wrapperspb.String("ping"), cb); err != nil {
+			t.Fatalf("AsyncCall: %v", err)
+		}
+		req = <-client.PendingQueue()
+	}
+	if err := client.Dispatch(packet.New(req.Command(), req.Seq(), req.Flag(), "pong")); !errors.Is(err, ErrRpcAmbiguousSeq) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := client.PendingCount(); n != 2 {
+		t.Fatalf("expect 2 pending calls, got %d", n)
+	}
+}
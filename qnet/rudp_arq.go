@@ -0,0 +1,483 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 一个简化的KCP风格ARQ实现，参考 https://github.com/skywind3000/kcp
+//
+// 和KCP的主要区别：
+//  1, 没有拥塞控制，发送窗口只受本端sndWnd和对端通告窗口限制
+//  2, 对端窗口为0时每次仍然允许发送1个分片作为探测，不使用wask/wins命令
+//  3, 增加FIN命令用于通知对端关闭，RST命令用于通知对端会话不存在
+//
+// 分片头，所有字段均为大端
+//       -------------------------------------------------
+// field | conv | cmd | frg | wnd | ts | sn | una | len |
+//       -------------------------------------------------
+// bytes |   4  |  1  |  1  |  2  |  4 |  4 |  4  |  2  |
+
+const (
+	rudpCmdPush = 81 // 数据分片
+	rudpCmdAck  = 82 // 确认
+	rudpCmdFin  = 83 // 关闭
+	rudpCmdRst  = 84 // 会话不存在
+
+	rudpHeaderSize = 22
+	rudpMTU        = 1400
+	rudpMSS        = rudpMTU - rudpHeaderSize
+	rudpMaxFrag    = 255 // 一条消息最多的分片数
+	rudpWndSize    = 256 // 默认收发窗口，需要大于最大分片数
+	rudpRtoMin     = 30  // ms
+	rudpRtoDefault = 200 // ms
+	rudpRtoMax     = 60000
+	rudpDeadLink   = 20 // 一个分片重传超过此次数认为连接已断开
+	rudpFastResend = 2  // 被跳过确认此次数后快速重传
+)
+
+var (
+	ErrRudpMessageTooLarge = errors.New("rudp message too large")
+	ErrRudpConvMismatch    = errors.New("rudp conversation mismatch")
+	ErrRudpBadSegment      = errors.New("rudp malformed segment")
+)
+
+type rudpSegment struct {
+	conv     uint32
+	cmd      uint8
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	resendts uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+	data     []byte
+}
+
+// 编码分片头，返回剩余的buffer
+func (s *rudpSegment) encode(buf []byte) []byte {
+	binary.BigEndian.PutUint32(buf, s.conv)
+	buf[4] = s.cmd
+	buf[5] = s.frg
+	binary.BigEndian.PutUint16(buf[6:], s.wnd)
+	binary.BigEndian.PutUint32(buf[8:], s.ts)
+	binary.BigEndian.PutUint32(buf[12:], s.sn)
+	binary.BigEndian.PutUint32(buf[16:], s.una)
+	binary.BigEndian.PutUint16(buf[20:], uint16(len(s.data)))
+	return buf[rudpHeaderSize:]
+}
+
+func timediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+// ARQ状态机，非线程安全，也不包含任何I/O和定时器
+type rudpARQ struct {
+	conv         uint32
+	state        int32 // -1表示连接已断开
+	remoteClosed bool  // 收到对端的FIN
+	established  bool  // 收到过对端的数据或确认
+	reset        bool  // 已建立的会话收到对端的RST
+	current      uint32
+	sndUna       uint32
+	sndNxt       uint32
+	rcvNxt       uint32
+	sndWnd       uint32
+	rcvWnd       uint32
+	rmtWnd       uint32
+	rxSrtt       int32
+	rxRttvar     int32
+	rxRto        int32
+	sndQueue     []*rudpSegment // 等待进入发送窗口
+	sndBuf       []*rudpSegment // 已发送待确认
+	rcvQueue     []*rudpSegment // 已按序接收待读取
+	rcvBuf       []*rudpSegment // 乱序到达的分片
+	acklist      []uint32       // 待发送的确认, sn和ts成对存放
+	buffer       []byte         // 输出缓冲
+	output       func([]byte)   // 输出一个datagram
+}
+
+func newRudpARQ(conv uint32, output func([]byte)) *rudpARQ {
+	return &rudpARQ{
+		conv:   conv,
+		sndWnd: rudpWndSize,
+		rcvWnd: rudpWndSize,
+		rmtWnd: rudpWndSize,
+		rxRto:  rudpRtoDefault,
+		buffer: make([]byte, rudpMTU),
+		output: output,
+	}
+}
+
+// 下一条完整消息的大小，没有则返回-1
+func (k *rudpARQ) peekSize() int {
+	if len(k.rcvQueue) == 0 {
+		return -1
+	}
+	var seg = k.rcvQueue[0]
+	if seg.frg == 0 {
+		return len(seg.data)
+	}
+	if len(k.rcvQueue) < int(seg.frg)+1 {
+		return -1
+	}
+	var length = 0
+	for _, seg := range k.rcvQueue {
+		length += len(seg.data)
+		if seg.frg == 0 {
+			break
+		}
+	}
+	return length
+}
+
+// 读取一条完整的消息，没有则返回nil
+func (k *rudpARQ) recv() []byte {
+	var size = k.peekSize()
+	if size < 0 {
+		return nil
+	}
+	var buf = make([]byte, 0, size)
+	var count = 0
+	for _, seg := range k.rcvQueue {
+		buf = append(buf, seg.data...)
+		count++
+		if seg.frg == 0 {
+			break
+		}
+	}
+	k.rcvQueue = removeFront(k.rcvQueue, count)
+	k.moveRcvBuf()
+	return buf
+}
+
+// 把一条消息分片后放入发送队列
+func (k *rudpARQ) send(data []byte) error {
+	var count = (len(data) + rudpMSS - 1) / rudpMSS
+	if count == 0 {
+		count = 1
+	}
+	if count > rudpMaxFrag {
+		return ErrRudpMessageTooLarge
+	}
+	for i := 0; i < count; i++ {
+		var size = len(data)
+		if size > rudpMSS {
+			size = rudpMSS
+		}
+		var seg = &rudpSegment{
+			frg:  uint8(count - i - 1),
+			data: append([]byte(nil), data[:size]...),
+		}
+		k.sndQueue = append(k.sndQueue, seg)
+		data = data[size:]
+	}
+	return nil
+}
+
+// 待发送和待确认的分片数量
+func (k *rudpARQ) waitSnd() int {
+	return len(k.sndBuf) + len(k.sndQueue)
+}
+
+func (k *rudpARQ) updateAck(rtt int32) {
+	if k.rxSrtt == 0 {
+		k.rxSrtt = rtt
+		k.rxRttvar = rtt / 2
+	} else {
+		var delta = rtt - k.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		k.rxRttvar = (3*k.rxRttvar + delta) / 4
+		k.rxSrtt = (7*k.rxSrtt + rtt) / 8
+		if k.rxSrtt < 1 {
+			k.rxSrtt = 1
+		}
+	}
+	var rto = k.rxSrtt + 4*k.rxRttvar
+	if rto < rudpRtoMin {
+		rto = rudpRtoMin
+	} else if rto > rudpRtoMax {
+		rto = rudpRtoMax
+	}
+	k.rxRto = rto
+}
+
+func (k *rudpARQ) shrinkBuf() {
+	if len(k.sndBuf) > 0 {
+		k.sndUna = k.sndBuf[0].sn
+	} else {
+		k.sndUna = k.sndNxt
+	}
+}
+
+func (k *rudpARQ) parseAck(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for i, seg := range k.sndBuf {
+		if seg.sn == sn {
+			copy(k.sndBuf[i:], k.sndBuf[i+1:])
+			k.sndBuf[len(k.sndBuf)-1] = nil
+			k.sndBuf = k.sndBuf[:len(k.sndBuf)-1]
+			break
+		}
+		if timediff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+}
+
+func (k *rudpARQ) parseUna(una uint32) {
+	var count = 0
+	for _, seg := range k.sndBuf {
+		if timediff(una, seg.sn) > 0 {
+			count++
+		} else {
+			break
+		}
+	}
+	if count > 0 {
+		k.sndBuf = removeFront(k.sndBuf, count)
+	}
+}
+
+func (k *rudpARQ) parseFastack(sn uint32) {
+	if timediff(sn, k.sndUna) < 0 || timediff(sn, k.sndNxt) >= 0 {
+		return
+	}
+	for _, seg := range k.sndBuf {
+		if timediff(sn, seg.sn) < 0 {
+			break
+		} else if sn != seg.sn {
+			seg.fastack++
+		}
+	}
+}
+
+func (k *rudpARQ) parseData(newseg *rudpSegment) {
+	var sn = newseg.sn
+	if timediff(sn, k.rcvNxt+k.rcvWnd) >= 0 || timediff(sn, k.rcvNxt) < 0 {
+		return
+	}
+	var insertIdx = 0
+	var repeat = false
+	for i := len(k.rcvBuf) - 1; i >= 0; i-- {
+		var seg = k.rcvBuf[i]
+		if seg.sn == sn {
+			repeat = true
+			break
+		}
+		if timediff(sn, seg.sn) > 0 {
+			insertIdx = i + 1
+			break
+		}
+	}
+	if !repeat {
+		k.rcvBuf = append(k.rcvBuf, nil)
+		copy(k.rcvBuf[insertIdx+1:], k.rcvBuf[insertIdx:])
+		k.rcvBuf[insertIdx] = newseg
+	}
+	k.moveRcvBuf()
+}
+
+// 把rcvBuf里连续的分片移到rcvQueue
+func (k *rudpARQ) moveRcvBuf() {
+	var count = 0
+	for _, seg := range k.rcvBuf {
+		if seg.sn == k.rcvNxt && uint32(len(k.rcvQueue)+count) < k.rcvWnd {
+			k.rcvNxt++
+			count++
+		} else {
+			break
+		}
+	}
+	if count > 0 {
+		k.rcvQueue = append(k.rcvQueue, k.rcvBuf[:count]...)
+		k.rcvBuf = removeFront(k.rcvBuf, count)
+	}
+}
+
+// 处理收到的一个datagram
+func (k *rudpARQ) input(data []byte) error {
+	var maxack uint32
+	var hasAck = false
+	for len(data) >= rudpHeaderSize {
+		var seg rudpSegment
+		seg.conv = binary.BigEndian.Uint32(data)
+		seg.cmd = data[4]
+		seg.frg = data[5]
+		seg.wnd = binary.BigEndian.Uint16(data[6:])
+		seg.ts = binary.BigEndian.Uint32(data[8:])
+		seg.sn = binary.BigEndian.Uint32(data[12:])
+		seg.una = binary.BigEndian.Uint32(data[16:])
+		var length = int(binary.BigEndian.Uint16(data[20:]))
+		data = data[rudpHeaderSize:]
+		if len(data) < length {
+			return ErrRudpBadSegment
+		}
+		if seg.conv != k.conv {
+			return ErrRudpConvMismatch
+		}
+		if seg.cmd < rudpCmdPush || seg.cmd > rudpCmdRst {
+			return ErrRudpBadSegment
+		}
+		k.rmtWnd = uint32(seg.wnd)
+		k.parseUna(seg.una)
+		k.shrinkBuf()
+
+		switch seg.cmd {
+		case rudpCmdAck:
+			if rtt := timediff(k.current, seg.ts); rtt >= 0 {
+				k.updateAck(rtt)
+			}
+			k.parseAck(seg.sn)
+			k.shrinkBuf()
+			k.established = true
+			if !hasAck || timediff(seg.sn, maxack) > 0 {
+				hasAck = true
+				maxack = seg.sn
+			}
+
+		case rudpCmdPush:
+			k.established = true
+			if timediff(seg.sn, k.rcvNxt+k.rcvWnd) < 0 {
+				k.acklist = append(k.acklist, seg.sn, seg.ts)
+				if timediff(seg.sn, k.rcvNxt) >= 0 {
+					seg.data = append([]byte(nil), data[:length]...)
+					k.parseData(&seg)
+				}
+			}
+
+		case rudpCmdFin:
+			k.remoteClosed = true
+
+		case rudpCmdRst:
+			// 新会话的第一个分片丢失时，对端会重置后续分片，此时忽略等待重传
+			if k.established {
+				k.reset = true
+			}
+		}
+		data = data[length:]
+	}
+	if hasAck {
+		k.parseFastack(maxack)
+	}
+	return nil
+}
+
+func (k *rudpARQ) wndUnused() uint16 {
+	if n := uint32(len(k.rcvQueue)); n < k.rcvWnd {
+		return uint16(k.rcvWnd - n)
+	}
+	return 0
+}
+
+// 输出一个没有数据的控制分片
+func (k *rudpARQ) sendControl(cmd uint8) {
+	var seg = rudpSegment{
+		conv: k.conv,
+		cmd:  cmd,
+		wnd:  k.wndUnused(),
+		una:  k.rcvNxt,
+		ts:   k.current,
+	}
+	seg.encode(k.buffer)
+	k.output(k.buffer[:rudpHeaderSize])
+}
+
+// 发送确认、新分片和需要重传的分片
+func (k *rudpARQ) flush() {
+	var buffer = k.buffer
+	var ptr = 0
+	var emit = func(need int) {
+		if ptr+need > rudpMTU {
+			k.output(buffer[:ptr])
+			ptr = 0
+		}
+	}
+
+	var seg = rudpSegment{
+		conv: k.conv,
+		cmd:  rudpCmdAck,
+		wnd:  k.wndUnused(),
+		una:  k.rcvNxt,
+	}
+	for i := 0; i+1 < len(k.acklist); i += 2 {
+		emit(rudpHeaderSize)
+		seg.sn, seg.ts = k.acklist[i], k.acklist[i+1]
+		seg.encode(buffer[ptr:])
+		ptr += rudpHeaderSize
+	}
+	k.acklist = k.acklist[:0]
+
+	var cwnd = k.sndWnd
+	if k.rmtWnd < cwnd {
+		cwnd = k.rmtWnd
+	}
+	if cwnd == 0 {
+		cwnd = 1 // 对端窗口为0时仍然发送一个分片作为探测
+	}
+	for len(k.sndQueue) > 0 && timediff(k.sndNxt, k.sndUna+cwnd) < 0 {
+		var newseg = k.sndQueue[0]
+		k.sndQueue = removeFront(k.sndQueue, 1)
+		newseg.conv = k.conv
+		newseg.cmd = rudpCmdPush
+		newseg.sn = k.sndNxt
+		k.sndNxt++
+		k.sndBuf = append(k.sndBuf, newseg)
+	}
+
+	for _, segment := range k.sndBuf {
+		var needsend = false
+		if segment.xmit == 0 {
+			needsend = true
+			segment.rto = uint32(k.rxRto)
+			segment.resendts = k.current + segment.rto
+		} else if timediff(k.current, segment.resendts) >= 0 {
+			needsend = true
+			segment.rto += segment.rto / 2
+			if segment.rto > rudpRtoMax {
+				segment.rto = rudpRtoMax
+			}
+			segment.resendts = k.current + segment.rto
+		} else if segment.fastack >= rudpFastResend {
+			needsend = true
+			segment.fastack = 0
+			segment.resendts = k.current + segment.rto
+		}
+		if needsend {
+			segment.xmit++
+			segment.ts = k.current
+			segment.wnd = seg.wnd
+			segment.una = k.rcvNxt
+			emit(rudpHeaderSize + len(segment.data))
+			var rest = segment.encode(buffer[ptr:])
+			copy(rest, segment.data)
+			ptr += rudpHeaderSize + len(segment.data)
+			if segment.xmit >= rudpDeadLink {
+				k.state = -1
+			}
+		}
+	}
+	if ptr > 0 {
+		k.output(buffer[:ptr])
+	}
+}
+
+// 删除前n个元素，并且不保留引用
+func removeFront(q []*rudpSegment, n int) []*rudpSegment {
+	var remain = copy(q, q[n:])
+	for i := remain; i < len(q); i++ {
+		q[i] = nil
+	}
+	return q[:remain]
+}
@@ -0,0 +1,225 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/log"
+	"qchen.fun/fatchoy/packet"
+	"qchen.fun/fatchoy/x/bufpool"
+	"qchen.fun/fatchoy/x/stats"
+)
+
+// 可靠UDP connection，每个packet编码为一条ARQ消息
+type RudpConn struct {
+	StreamConn
+	conn *RudpSession // reliable UDP session
+	wbuf bytes.Buffer // write buffer
+}
+
+func NewRudpConn(node fatchoy.NodeID, conn *RudpSession, enc codec.Encoder, errChan chan error,
+	incoming chan<- fatchoy.IPacket, outsize int, stats *stats.Stats) *RudpConn {
+	rconn := &RudpConn{
+		conn: conn,
+	}
+	rconn.StreamConn.Init(node, enc, incoming, outsize, errChan, stats)
+	rconn.addr = conn.RemoteAddr().String()
+	return rconn
+}
+
+func (t *RudpConn) RawConn() net.Conn {
+	return t.conn
+}
+
+func (t *RudpConn) OutboundQueue() chan fatchoy.IPacket {
+	return t.outbound
+}
+
+func (t *RudpConn) Go(flag fatchoy.EndpointFlag) {
+	if !t.state.CAS(fatchoy.StateInit, fatchoy.StateRunning) {
+		panic("RudpConn: invalid state")
+	}
+	if (flag & fatchoy.EndpointWriter) > 0 {
+		t.wg.Add(1)
+		go t.writePump()
+		t.startHeartbeat()
+	}
+	if (flag & fatchoy.EndpointReader) > 0 {
+		t.wg.Add(1)
+		go t.readPump()
+	}
+}
+
+func (t *RudpConn) SendPacket(pkt fatchoy.IPacket) error {
+	if !t.IsRunning() {
+		return ErrConnIsClosing
+	}
+	select {
+	case t.outbound <- pkt:
+		return nil
+	default:
+		return ErrConnOutboundOverflow
+	}
+}
+
+func (t *RudpConn) Close() error {
+	if !t.state.CAS(fatchoy.StateRunning, fatchoy.StateShutdown) {
+		return nil
+	}
+	t.conn.SetReadDeadline(time.Now()) // 让reader立即返回
+	close(t.done)
+	t.notifyErr(NewError(ErrConnForceClose, t))
+	t.finally() // 阻塞等待投递剩余的消息
+	return nil
+}
+
+func (t *RudpConn) ForceClose(err error) {
+	if !t.state.CAS(fatchoy.StateRunning, fatchoy.StateShutdown) {
+		return
+	}
+	t.conn.SetReadDeadline(time.Now())
+	close(t.done)
+	t.notifyErr(NewError(err, t))
+	go t.finally() // 不阻塞等待
+}
+
+func (t *RudpConn) finally() {
+	t.wg.Wait()
+	t.conn.Close() // 会等待已发送的消息被确认
+	t.state.Set(fatchoy.StateTerminated)
+	close(t.outbound)
+	t.outbound = nil
+	t.inbound = nil
+	t.errChan = nil
+}
+
+func (t *RudpConn) flush() {
+	for {
+		select {
+		case pkt, ok := <-t.outbound:
+			if !ok {
+				return
+			}
+			if err := t.write(pkt); err != nil {
+				log.Errorf("%v marshal message %v: %v", t.node, pkt.Command(), err)
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+func (t *RudpConn) write(pkt fatchoy.IPacket) error {
+	t.wbuf.Reset()
+	nbytes, err := t.enc.WritePacket(&t.wbuf, t.encrypt, pkt)
+	if err != nil {
+		return err
+	}
+	if err := t.conn.WriteMessage(t.wbuf.Bytes()); err != nil {
+		return err
+	}
+	t.stats.Add(StatPacketsSent, 1)
+	t.stats.Add(StatBytesSent, int64(nbytes))
+	return nil
+}
+
+func (t *RudpConn) writePump() {
+	defer func() {
+		t.flush()
+		t.wg.Done()
+		log.Debugf("RudpConn: node %v writer stopped", t.node)
+	}()
+
+	log.Debugf("RudpConn: node %v(%v) writer started", t.node, t.addr)
+
+	for {
+		select {
+		case pkt, ok := <-t.outbound:
+			if !ok {
+				return
+			}
+			if err := t.write(pkt); err != nil {
+				log.Errorf("%v write message %v: %v", t.node, pkt.Command(), err)
+			}
+
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *RudpConn) readPacket() (fatchoy.IPacket, int, error) {
+	t.conn.SetReadDeadline(t.readDeadline())
+	msg, err := t.conn.ReadMessage()
+	if err != nil {
+		return nil, 0, err
+	}
+	head, body, err := t.enc.ReadHeadBody(bytes.NewReader(msg))
+	if err != nil {
+		return nil, 0, err
+	}
+	var nbytes = len(head) + len(body)
+	var pkt = packet.Make()
+	if err := t.enc.UnmarshalPacket(head, body, t.decrypt, pkt); err != nil {
+		bufpool.Put(head)
+		pkt.Release()
+		return nil, 0, err
+	}
+	// body可能引用读取的缓冲区，由packet负责归还
+	pkt.SetBuffer(head)
+	t.stats.Add(StatPacketsRecv, 1)
+	t.stats.Add(StatBytesRecv, int64(nbytes))
+	pkt.SetEndpoint(t)
+	return pkt, nbytes, nil
+}
+
+func (t *RudpConn) readPump() {
+	defer func() {
+		t.wg.Done()
+		log.Debugf("RudpConn: node %v reader stopped", t.node)
+	}()
+
+	log.Debugf("RudpConn: node %v(%v) reader started", t.node, t.addr)
+	for {
+		pkt, nbytes, err := t.readPacket()
+		if err != nil {
+			if t.testShouldExit() {
+				return // 主动关闭导致的读超时
+			}
+			if err != io.EOF {
+				log.Errorf("%v read packet %v", t.node, err)
+			}
+			t.ForceClose(idleError(err)) // I/O超时或者发生错误，强制关闭连接
+			return
+		}
+		// 心跳也计入限速，避免ping洪水放大成pong
+		if !t.throttle(t, pkt, nbytes) {
+			pkt.Release()
+			if t.testShouldExit() {
+				return
+			}
+			continue
+		}
+		if t.handleHeartbeat(pkt) {
+			pkt.Release()
+			continue
+		}
+		if !t.deliver(t, pkt) {
+			return
+		}
+
+		// test if we should exit
+		if t.testShouldExit() {
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"sync"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/log"
+	"qchen.fun/fatchoy/x/stats"
+)
+
+type RudpServer struct {
+	done    chan struct{}
+	wg      sync.WaitGroup        // wait group
+	backlog chan fatchoy.Endpoint // queue of incoming connections
+	errors  chan error            // error queue
+	lns     []*RudpListener       // listener list
+	enc     codec.Encoder         // message encode/decode
+	inbound chan fatchoy.IPacket  // incoming message buffer queue
+	outsize int                   // size of outbound message queue
+}
+
+func NewRudpServer(enc codec.Encoder, inbound chan fatchoy.IPacket, outsize int) *RudpServer {
+	return &RudpServer{
+		enc:     enc,
+		inbound: inbound,
+		outsize: outsize,
+		done:    make(chan struct{}),
+		backlog: make(chan fatchoy.Endpoint, 128),
+		errors:  make(chan error, 16),
+	}
+}
+
+func (s *RudpServer) BacklogChan() chan fatchoy.Endpoint {
+	return s.backlog
+}
+
+func (s *RudpServer) ErrorChan() chan error {
+	return s.errors
+}
+
+func (s *RudpServer) Listen(addr string) error {
+	ln, err := ListenRudp(addr)
+	if err != nil {
+		return err
+	}
+	s.lns = append(s.lns, ln)
+	s.wg.Add(1)
+	go s.serve(ln)
+	return nil
+}
+
+func (s *RudpServer) testShouldExit() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *RudpServer) serve(ln *RudpListener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.AcceptRudp()
+		if err != nil {
+			if !s.testShouldExit() {
+				log.Errorf("accept error: %v", err)
+			}
+			return
+		}
+
+		// check if we should exit
+		if s.testShouldExit() {
+			return
+		}
+
+		s.accept(conn)
+	}
+}
+
+func (s *RudpServer) accept(conn *RudpSession) {
+	var endpoint = NewRudpConn(0, conn, s.enc, s.errors, s.inbound, s.outsize, stats.New(NumStat))
+	endpoint.inQueue = s.inbound
+	select {
+	case s.backlog <- endpoint: // this may block current goroutine
+	case <-s.done:
+		conn.closeWithError(ErrRudpClosed)
+	}
+}
+
+func (s *RudpServer) Close() {
+	close(s.done)
+	for i, ln := range s.lns {
+		ln.Close()
+		s.lns[i] = nil
+	}
+	s.wg.Wait()
+	close(s.backlog)
+	close(s.errors)
+	s.backlog = nil
+	s.errors = nil
+	s.lns = nil
+	s.inbound = nil
+}
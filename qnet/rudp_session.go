@@ -0,0 +1,478 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	RudpInterval = 10 * time.Millisecond // 状态机刷新间隔
+	RudpLinger   = 2 * time.Second       // 关闭时等待数据被确认的最长时间
+)
+
+var (
+	ErrRudpDeadLink = errors.New("rudp dead link")
+	ErrRudpClosed   = errors.New("rudp session closed")
+	ErrRudpReset    = errors.New("rudp session reset by peer")
+)
+
+var rudpEpoch = time.Now()
+
+func rudpClock() uint32 {
+	return uint32(time.Since(rudpEpoch) / time.Millisecond)
+}
+
+// 实现net.Error
+type rudpTimeoutError struct{}
+
+func (rudpTimeoutError) Error() string   { return "rudp i/o timeout" }
+func (rudpTimeoutError) Timeout() bool   { return true }
+func (rudpTimeoutError) Temporary() bool { return true }
+
+// 一个可靠UDP会话，实现了net.Conn
+// 每次Write对应对端的一次ReadMessage，Read则把消息当作字节流读取
+type RudpSession struct {
+	guard    sync.Mutex
+	arq      *rudpARQ
+	conn     net.PacketConn
+	remote   net.Addr
+	listener *RudpListener // 服务端会话所属的listener，客户端为nil
+	die      chan struct{}
+	dieOnce  sync.Once
+	err      error         // 关闭原因
+	readable chan struct{} // 有数据可读的通知
+	writable chan struct{} // 发送窗口可用的通知
+	rd       time.Time     // read deadline
+	wd       time.Time     // write deadline
+	leftover []byte        // Read未读完的数据
+}
+
+func newRudpSession(conv uint32, conn net.PacketConn, remote net.Addr, listener *RudpListener) *RudpSession {
+	var s = &RudpSession{
+		conn:     conn,
+		remote:   remote,
+		listener: listener,
+		die:      make(chan struct{}),
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+	s.arq = newRudpARQ(conv, s.output)
+	return s
+}
+
+// 连接到`addr`
+func DialRudp(addr string) (*RudpSession, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	var s = newRudpSession(rand.Uint32(), conn, raddr, nil)
+	go s.updater()
+	go s.readLoop()
+	return s, nil
+}
+
+// 会话ID
+func (s *RudpSession) Conv() uint32 {
+	return s.arq.conv
+}
+
+// 当前的平滑RTT(毫秒)
+func (s *RudpSession) SRTT() int32 {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return s.arq.rxSrtt
+}
+
+func (s *RudpSession) output(data []byte) {
+	s.conn.WriteTo(data, s.remote)
+}
+
+func notifyChan(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *RudpSession) input(data []byte) error {
+	s.guard.Lock()
+	s.arq.current = rudpClock()
+	var err = s.arq.input(data)
+	if len(s.arq.acklist) > 0 {
+		s.arq.flush() // 立即回复确认
+	}
+	var readable = s.arq.peekSize() >= 0 || s.arq.remoteClosed
+	var writable = s.arq.waitSnd() < int(s.arq.sndWnd)
+	var reset = s.arq.reset
+	s.guard.Unlock()
+	if reset {
+		s.closeWithError(ErrRudpReset)
+		return err
+	}
+	if readable {
+		notifyChan(s.readable)
+	}
+	if writable {
+		notifyChan(s.writable)
+	}
+	return err
+}
+
+func (s *RudpSession) updater() {
+	var ticker = time.NewTicker(RudpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.guard.Lock()
+			s.arq.current = rudpClock()
+			s.arq.flush()
+			var dead = s.arq.state < 0
+			var writable = s.arq.waitSnd() < int(s.arq.sndWnd)
+			s.guard.Unlock()
+			if writable {
+				notifyChan(s.writable)
+			}
+			if dead {
+				s.closeWithError(ErrRudpDeadLink)
+				return
+			}
+
+		case <-s.die:
+			return
+		}
+	}
+}
+
+// 客户端会话独占socket，需要自己读取
+func (s *RudpSession) readLoop() {
+	var buf = make([]byte, 64*1024)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if from.String() != s.remote.String() {
+			continue
+		}
+		if n >= rudpHeaderSize {
+			s.input(buf[:n])
+		}
+	}
+}
+
+func deadlineTimer(deadline time.Time) (*time.Timer, <-chan time.Time) {
+	if deadline.IsZero() {
+		return nil, nil
+	}
+	var timer = time.NewTimer(time.Until(deadline))
+	return timer, timer.C
+}
+
+// 读取一条完整的消息
+func (s *RudpSession) ReadMessage() ([]byte, error) {
+	for {
+		s.guard.Lock()
+		if msg := s.arq.recv(); msg != nil {
+			s.guard.Unlock()
+			return msg, nil
+		}
+		if s.arq.remoteClosed {
+			s.guard.Unlock()
+			return nil, io.EOF
+		}
+		var deadline = s.rd
+		s.guard.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, rudpTimeoutError{}
+		}
+		var timer, expired = deadlineTimer(deadline)
+		select {
+		case <-s.readable:
+		case <-expired:
+		case <-s.die:
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil, s.closeErr()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// 写入一条消息，对端会作为一个整体读取
+func (s *RudpSession) WriteMessage(data []byte) error {
+	for {
+		select {
+		case <-s.die:
+			return s.closeErr()
+		default:
+		}
+		s.guard.Lock()
+		if s.arq.waitSnd() < int(s.arq.sndWnd)*2 {
+			var err = s.arq.send(data)
+			if err == nil {
+				s.arq.current = rudpClock()
+				s.arq.flush()
+			}
+			s.guard.Unlock()
+			return err
+		}
+		var deadline = s.wd
+		s.guard.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return rudpTimeoutError{}
+		}
+		var timer, expired = deadlineTimer(deadline)
+		select {
+		case <-s.writable:
+		case <-expired:
+		case <-s.die:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *RudpSession) Read(b []byte) (int, error) {
+	if len(s.leftover) == 0 {
+		msg, err := s.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		s.leftover = msg
+	}
+	var n = copy(b, s.leftover)
+	s.leftover = s.leftover[n:]
+	return n, nil
+}
+
+func (s *RudpSession) Write(b []byte) (int, error) {
+	if err := s.WriteMessage(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// 等待已发送的数据被确认后通知对端关闭
+func (s *RudpSession) Close() error {
+	var deadline = time.Now().Add(RudpLinger)
+	for time.Now().Before(deadline) {
+		s.guard.Lock()
+		var done = s.arq.waitSnd() == 0 || s.arq.remoteClosed || s.arq.state < 0
+		s.guard.Unlock()
+		if done {
+			break
+		}
+		select {
+		case <-s.writable:
+		case <-s.die:
+			return nil
+		case <-time.After(RudpInterval):
+		}
+	}
+	s.guard.Lock()
+	s.arq.current = rudpClock()
+	s.arq.sendControl(rudpCmdFin)
+	s.guard.Unlock()
+	s.closeWithError(ErrRudpClosed)
+	return nil
+}
+
+func (s *RudpSession) closeWithError(err error) {
+	s.dieOnce.Do(func() {
+		s.guard.Lock()
+		s.err = err
+		s.guard.Unlock()
+		close(s.die)
+		if s.listener != nil {
+			s.listener.remove(s)
+		} else {
+			s.conn.Close()
+		}
+	})
+}
+
+func (s *RudpSession) closeErr() error {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return s.err
+}
+
+func (s *RudpSession) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *RudpSession) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *RudpSession) SetDeadline(t time.Time) error {
+	s.guard.Lock()
+	s.rd = t
+	s.wd = t
+	s.guard.Unlock()
+	notifyChan(s.readable)
+	notifyChan(s.writable)
+	return nil
+}
+
+func (s *RudpSession) SetReadDeadline(t time.Time) error {
+	s.guard.Lock()
+	s.rd = t
+	s.guard.Unlock()
+	notifyChan(s.readable)
+	return nil
+}
+
+func (s *RudpSession) SetWriteDeadline(t time.Time) error {
+	s.guard.Lock()
+	s.wd = t
+	s.guard.Unlock()
+	notifyChan(s.writable)
+	return nil
+}
+
+// 可靠UDP的监听端，实现了net.Listener
+// 所有会话共享一个socket，按对端地址区分
+type RudpListener struct {
+	conn     net.PacketConn
+	guard    sync.Mutex
+	sessions map[string]*RudpSession
+	backlog  chan *RudpSession
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+func ListenRudp(addr string) (*RudpListener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var l = &RudpListener{
+		conn:     conn,
+		sessions: make(map[string]*RudpSession),
+		backlog:  make(chan *RudpSession, 128),
+		die:      make(chan struct{}),
+	}
+	go l.monitor()
+	return l, nil
+}
+
+func (l *RudpListener) monitor() {
+	var buf = make([]byte, 64*1024)
+	for {
+		n, from, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.closeAll()
+			return
+		}
+		if n < rudpHeaderSize {
+			continue
+		}
+		var data = buf[:n]
+		var conv = binary.BigEndian.Uint32(data)
+		var key = from.String()
+		l.guard.Lock()
+		var s = l.sessions[key]
+		if s == nil || s.arq.conv != conv {
+			// 只有第一个数据分片才能创建会话，会话关闭后迟到的分片回复RST
+			if cmd, sn := data[4], binary.BigEndian.Uint32(data[12:]); cmd != rudpCmdPush || sn != 0 {
+				l.guard.Unlock()
+				if cmd != rudpCmdRst && cmd != rudpCmdFin {
+					l.sendReset(conv, from)
+				}
+				continue
+			}
+			if s != nil {
+				delete(l.sessions, key)
+				go s.closeWithError(ErrRudpConvMismatch) // 对端重新建立了会话
+			}
+			s = newRudpSession(conv, l.conn, from, l)
+			select {
+			case l.backlog <- s:
+				l.sessions[key] = s
+				go s.updater()
+			default:
+				l.guard.Unlock()
+				continue // backlog已满，丢弃
+			}
+		}
+		l.guard.Unlock()
+		s.input(data)
+	}
+}
+
+func (l *RudpListener) sendReset(conv uint32, to net.Addr) {
+	var buf [rudpHeaderSize]byte
+	var seg = rudpSegment{conv: conv, cmd: rudpCmdRst}
+	seg.encode(buf[:])
+	l.conn.WriteTo(buf[:], to)
+}
+
+func (l *RudpListener) remove(s *RudpSession) {
+	var key = s.remote.String()
+	l.guard.Lock()
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+	}
+	l.guard.Unlock()
+}
+
+func (l *RudpListener) closeAll() {
+	l.guard.Lock()
+	var sessions = make([]*RudpSession, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.guard.Unlock()
+	for _, s := range sessions {
+		s.closeWithError(ErrRudpClosed)
+	}
+}
+
+func (l *RudpListener) AcceptRudp() (*RudpSession, error) {
+	select {
+	case s := <-l.backlog:
+		return s, nil
+	case <-l.die:
+		return nil, ErrRudpClosed
+	}
+}
+
+func (l *RudpListener) Accept() (net.Conn, error) {
+	return l.AcceptRudp()
+}
+
+func (l *RudpListener) Close() error {
+	var err error
+	l.dieOnce.Do(func() {
+		close(l.die)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+func (l *RudpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,221 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/packet"
+	"qchen.fun/fatchoy/x/strutil"
+)
+
+// 模拟一条有丢包的链路
+type lossyLink struct {
+	rng   *rand.Rand
+	loss  int // 丢包率百分比
+	queue [][]byte
+}
+
+func (l *lossyLink) output(data []byte) {
+	if l.rng.Intn(100) < l.loss {
+		return
+	}
+	l.queue = append(l.queue, append([]byte(nil), data...))
+}
+
+func (l *lossyLink) deliver(k *rudpARQ) {
+	for _, data := range l.queue {
+		k.input(data)
+	}
+	l.queue = l.queue[:0]
+}
+
+func TestRudpARQLossyLink(t *testing.T) {
+	var ab = &lossyLink{rng: rand.New(rand.NewSource(1)), loss: 30}
+	var ba = &lossyLink{rng: rand.New(rand.NewSource(2)), loss: 30}
+	var a = newRudpARQ(1234, ab.output)
+	var b = newRudpARQ(1234, ba.output)
+
+	const count = 200
+	var sent [][]byte
+	for i := 0; i < count; i++ {
+		var msg = []byte(strutil.RandString(1 + rand.Intn(rudpMSS*3)))
+		if err := a.send(msg); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		sent = append(sent, msg)
+	}
+	var recv [][]byte
+	for now := uint32(0); now < 120000 && len(recv) < count; now += 10 {
+		a.current = now
+		b.current = now
+		a.flush()
+		ab.deliver(b)
+		b.flush()
+		ba.deliver(a)
+		for {
+			var msg = b.recv()
+			if msg == nil {
+				break
+			}
+			recv = append(recv, msg)
+		}
+		if a.state < 0 {
+			t.Fatalf("dead link at %d", now)
+		}
+	}
+	if len(recv) != count {
+		t.Fatalf("received %d/%d messages", len(recv), count)
+	}
+	for i := range sent {
+		if !bytes.Equal(sent[i], recv[i]) {
+			t.Fatalf("message #%d mismatch", i)
+		}
+	}
+}
+
+func serveRudpEcho(server *RudpServer, incoming chan fatchoy.IPacket, done, stopped chan struct{}) {
+	var endpoints []fatchoy.Endpoint
+	defer func() {
+		for _, endpoint := range endpoints {
+			endpoint.Close()
+		}
+		close(stopped)
+	}()
+	for {
+		select {
+		case endpoint := <-server.BacklogChan():
+			endpoint.Go(fatchoy.EndpointReadWriter)
+			endpoints = append(endpoints, endpoint)
+
+		case err := <-server.ErrorChan():
+			var ne = err.(*Error)
+			if ne.Endpoint.IsRunning() {
+				ne.Endpoint.Close()
+			}
+
+		case pkt := <-incoming:
+			pkt.ReplyWith(pkt.Command(), fmt.Sprintf("pong %s", pkt.BodyToString()))
+
+		case <-done:
+			return
+		}
+	}
+}
+
+func TestExampleRudpConn(t *testing.T) {
+	var addr = "localhost:10006"
+	var enc = codec.NewV2Encoder(0)
+	var incoming = make(chan fatchoy.IPacket, 100)
+	var server = NewRudpServer(enc, incoming, 100)
+	if err := server.Listen(addr); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	var done = make(chan struct{})
+	var stopped = make(chan struct{})
+	go serveRudpEcho(server, incoming, done, stopped)
+	defer func() {
+		close(done)
+		<-stopped
+		server.Close()
+	}()
+
+	conn, err := DialRudp(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	var inbound = make(chan fatchoy.IPacket, 100)
+	var errchan = make(chan error, 4)
+	rconn := NewRudpConn(0, conn, enc, errchan, inbound, 100, nil)
+	rconn.Go(fatchoy.EndpointReadWriter)
+	defer rconn.Close()
+
+	const count = 100
+	var bodies = make([]string, count+1)
+	for i := 1; i <= count; i++ {
+		bodies[i] = strutil.RandString(10 + rand.Intn(rudpMSS*4)) // 包含需要分片的消息
+		if err := rconn.SendPacket(packet.New(int32(i), uint16(i), 0, bodies[i])); err != nil {
+			t.Fatalf("SendPacket: %v", err)
+		}
+	}
+	var timer = time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	for i := 1; i <= count; i++ {
+		select {
+		case pkt := <-inbound:
+			if pkt.Seq() != uint16(i) || pkt.BodyToString() != "pong "+bodies[i] {
+				t.Fatalf("unexpected response %v", pkt)
+			}
+		case err := <-errchan:
+			t.Fatalf("connection error: %v", err)
+		case <-timer.C:
+			t.Fatalf("timeout waiting response #%d", i)
+		}
+	}
+}
+
+func TestRudpListenerReset(t *testing.T) {
+	ln, err := ListenRudp("localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+
+	// 没有会话时非初始的分片回复RST，不创建会话
+	raw, err := net.Dial("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer raw.Close()
+	var buf [rudpHeaderSize]byte
+	var seg = rudpSegment{conv: 1234, cmd: rudpCmdPush, sn: 5}
+	seg.encode(buf[:])
+	raw.Write(buf[:])
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply [64]byte
+	if n, err := raw.Read(reply[:]); err != nil || n != rudpHeaderSize || reply[4] != rudpCmdRst ||
+		binary.BigEndian.Uint32(reply[:]) != 1234 {
+		t.Fatalf("expect reset, got %v %v", reply[:n], err)
+	}
+	select {
+	case s := <-ln.backlog:
+		t.Fatalf("unexpected session %v", s.RemoteAddr())
+	default:
+	}
+
+	// 服务端会话已关闭，客户端后续的分片被重置
+	client, err := DialRudp(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+	if err := client.WriteMessage([]byte("hello")); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	session, err := ln.AcceptRudp()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if msg, err := session.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("ReadMessage: %s %v", msg, err)
+	}
+	session.closeWithError(ErrRudpClosed)
+	time.Sleep(5 * RudpInterval) // 等待确认到达客户端
+	if err := client.WriteMessage([]byte("world")); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.ReadMessage(); err != ErrRudpReset {
+		t.Fatalf("expect reset, got %v", err)
+	}
+}
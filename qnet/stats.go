@@ -5,9 +5,16 @@
 package qnet
 
 const (
-	StatBytesRecv   int = iota // bytes received
-	StatBytesSent              // bytes sent
-	StatPacketsRecv            // packets received
-	StatPacketsSent            // packets sent
+	StatBytesRecv         int = iota // bytes received
+	StatBytesSent                    // bytes sent
+	StatPacketsRecv                  // packets received
+	StatPacketsSent                  // packets sent
+	StatRTT                          // 最近一次心跳的RTT，微秒
+	StatPacketsDropped               // 因限速丢弃的消息
+	StatPacketsDelayed               // 因限速延迟读取的消息
+	StatInboundTimeout               // inbound队列满，阻塞超时后丢弃的消息
+	StatInboundDropNewest            // inbound队列满，丢弃的新消息
+	StatInboundDropOldest            // inbound队列满，丢弃的旧消息
+	StatInboundDisconnect            // inbound队列满导致的断线
 	NumStat
 )
@@ -6,6 +6,7 @@ package qnet
 
 import (
 	"sync"
+	"time"
 
 	"qchen.fun/fatchoy"
 	"qchen.fun/fatchoy/codec"
@@ -16,18 +17,31 @@ import (
 // stream connection
 type StreamConn struct {
 	done     chan struct{}
-	wg       sync.WaitGroup         // wait group
-	state    fatchoy.State          //
-	node     fatchoy.NodeID         // node id
-	addr     string                 // remote address
-	userdata interface{}            // user data
-	encrypt  cipher.BlockCryptor    // message encryption
-	decrypt  cipher.BlockCryptor    // message decryption
-	enc      codec.Encoder          // message encode/decode
-	inbound  chan<- fatchoy.IPacket // inbound message queue
-	outbound chan fatchoy.IPacket   // outbound message queue
-	stats    *stats.Stats           // message stats
-	errChan  chan error             // error signal
+	wg       sync.WaitGroup           // wait group
+	state    fatchoy.State            //
+	node     fatchoy.NodeID           // node id
+	addr     string                   // remote address
+	userdata interface{}              // user data
+	encrypt  cipher.BlockCryptor      // message encryption
+	decrypt  cipher.BlockCryptor      // message decryption
+	enc      codec.Encoder            // message encode/decode
+	inbound  chan<- fatchoy.IPacket   // inbound message queue
+	outbound chan fatchoy.IPacket     // outbound message queue
+	stats    *stats.Stats             // message stats
+	errChan  chan error               // error signal
+	onClose  []func(fatchoy.Endpoint) // 连接终止后的回调
+	hookMu   sync.Mutex               // 保护onClose和hookRan
+	hookRan  bool                     // 是否已经执行过onClose
+	onSend   func(fatchoy.IPacket)    // 消息投递到发送队列后的回调
+	sendLock sync.Locker              // 投递和onSend在同一个锁内完成，保证回调的顺序和发送队列一致
+
+	hbInterval  time.Duration // 心跳间隔
+	idleTimeout time.Duration // 空闲超时
+	limiter     *RateLimiter  // 入站限速
+
+	inPolicy  InboundPolicy        // inbound队列满时的处理方式
+	inTimeout time.Duration        // InboundBlockTimeout的超时
+	inQueue   chan fatchoy.IPacket // 可读的inbound，用于InboundDropOldest
 }
 
 func (c *StreamConn) Init(node fatchoy.NodeID, enc codec.Encoder, inbound chan<- fatchoy.IPacket,
@@ -93,6 +107,29 @@ func (c *StreamConn) notifyErr(err *Error) {
 	}
 }
 
+// 连接终止后依次执行回调
+func (c *StreamConn) runCloseHooks(endpoint fatchoy.Endpoint) {
+	c.hookMu.Lock()
+	var hooks = c.onClose
+	c.onClose = nil
+	c.hookRan = true
+	c.hookMu.Unlock()
+	for _, f := range hooks {
+		f(endpoint)
+	}
+}
+
+// 添加连接终止后的回调，返回false表示连接已经终止，回调不会被执行
+func (c *StreamConn) addCloseHook(f func(fatchoy.Endpoint)) bool {
+	c.hookMu.Lock()
+	defer c.hookMu.Unlock()
+	if c.hookRan {
+		return false
+	}
+	c.onClose = append(c.onClose, f)
+	return true
+}
+
 func (c *StreamConn) SetUserData(ud interface{}) {
 	c.userdata = ud
 }
@@ -0,0 +1,329 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/log"
+	"qchen.fun/fatchoy/x/stats"
+)
+
+var (
+	TcpClientDialTimeout = 10 // 连接超时，10s
+)
+
+// 连接建立后，在开启读写之前执行的握手
+type HandshakeFunc func(endpoint fatchoy.Endpoint) error
+
+// TCP客户端，连接断开后自动以指数退避重连，断线期间发送的消息缓存到重连后发送
+type TcpClient struct {
+	done       chan struct{}
+	wg         sync.WaitGroup         // wait group
+	guard      sync.Mutex             // 保护conn和pending
+	state      fatchoy.State          //
+	addr       string                 // remote address
+	node       fatchoy.NodeID         // node id
+	enc        codec.Encoder          // message encode/decode
+	inbound    chan<- fatchoy.IPacket // inbound message queue
+	outsize    int                    // size of outbound message queue
+	stats      *stats.Stats           // message stats
+	conn       *TcpConn               // current connection
+	queue      chan fatchoy.IPacket   // 当前连接的发送队列，断线后从中取回没有发送的消息
+	connErr    chan error             // connection error signal
+	errors     chan error             // error queue
+	pending    []fatchoy.IPacket      // 断线期间缓存的消息
+	maxPending int                    // 最多缓存的消息数量
+	minBackoff time.Duration          // 重连的最小间隔
+	maxBackoff time.Duration          // 重连的最大间隔
+	handshake  HandshakeFunc          // 握手
+	hbInterval time.Duration          // 心跳间隔
+	hbTimeout  time.Duration          // 空闲超时
+	tlsConfig  *tls.Config            // 不为nil时使用TLS连接
+}
+
+func NewTcpClient(addr string, enc codec.Encoder, inbound chan<- fatchoy.IPacket, outsize int) *TcpClient {
+	return &TcpClient{
+		addr:       addr,
+		enc:        enc,
+		inbound:    inbound,
+		outsize:    outsize,
+		maxPending: outsize,
+		minBackoff: 500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		stats:      stats.New(NumStat),
+		done:       make(chan struct{}),
+		connErr:    make(chan error, 1),
+		errors:     make(chan error, 16),
+	}
+}
+
+func (c *TcpClient) NodeID() fatchoy.NodeID {
+	return c.node
+}
+
+// 在Connect之前调用
+func (c *TcpClient) SetNodeID(node fatchoy.NodeID) {
+	c.node = node
+}
+
+func (c *TcpClient) RemoteAddr() string {
+	return c.addr
+}
+
+// 所有连接共享的计数
+func (c *TcpClient) Stats() *stats.Stats {
+	return c.stats
+}
+
+// 连接错误通知，每次断线都会投递一个*Error
+func (c *TcpClient) ErrorChan() chan error {
+	return c.errors
+}
+
+// 设置握手函数，每次连接建立后都会执行
+func (c *TcpClient) SetHandshake(f HandshakeFunc) {
+	c.handshake = f
+}
+
+// 设置重连间隔
+func (c *TcpClient) SetBackoff(min, max time.Duration) {
+	c.minBackoff = min
+	c.maxBackoff = max
+}
+
+// 使用TLS连接，如果服务端证书的CommonName是节点ID，并且没有设置NodeID，会用作连接的NodeID
+func (c *TcpClient) SetTLSConfig(config *tls.Config) {
+	c.tlsConfig = config
+}
+
+// 设置心跳，对之后建立的连接生效
+func (c *TcpClient) SetHeartbeat(interval, timeout time.Duration) {
+	c.hbInterval = interval
+	c.hbTimeout = timeout
+}
+
+// 设置断线期间最多缓存的消息数量
+func (c *TcpClient) SetMaxPending(n int) {
+	c.maxPending = n
+}
+
+func (c *TcpClient) IsRunning() bool {
+	return c.state.IsRunning()
+}
+
+// 当前是否已连接
+func (c *TcpClient) IsConnected() bool {
+	c.guard.Lock()
+	var conn = c.conn
+	c.guard.Unlock()
+	return conn != nil && conn.IsRunning()
+}
+
+// 当前的连接，断线期间为nil
+func (c *TcpClient) Conn() *TcpConn {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	return c.conn
+}
+
+// 缓存中的消息数量
+func (c *TcpClient) PendingCount() int {
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	return len(c.pending)
+}
+
+// 同步建立第一次连接，之后断线会自动重连
+func (c *TcpClient) Connect() error {
+	if !c.state.CAS(fatchoy.StateInit, fatchoy.StateRunning) {
+		panic("TcpClient: invalid state")
+	}
+	if err := c.dial(); err != nil {
+		c.state.Set(fatchoy.StateInit)
+		return err
+	}
+	c.wg.Add(1)
+	go c.serve()
+	return nil
+}
+
+func (c *TcpClient) dial() error {
+	var timeout = time.Duration(TcpClientDialTimeout) * time.Second
+	var conn net.Conn
+	var node = c.node
+	if c.tlsConfig != nil {
+		tconn, err := dialTLS(c.addr, timeout, c.tlsConfig)
+		if err != nil {
+			return err
+		}
+		peer, err := tlsHandshake(tconn)
+		if err != nil {
+			tconn.Close()
+			return err
+		}
+		if node == 0 {
+			node = peer
+		}
+		conn = tconn
+	} else {
+		var err error
+		if conn, err = net.DialTimeout("tcp", c.addr, timeout); err != nil {
+			return err
+		}
+	}
+	// 发送队列预留缓存消息的空间
+	var tconn = NewTcpConn(node, conn, c.enc, c.connErr, c.inbound, c.outsize+c.maxPending, c.stats)
+	tconn.keepUnsent = true
+	var queue = tconn.outbound
+	tconn.SetHeartbeat(c.hbInterval, c.hbTimeout)
+	if c.handshake != nil {
+		if err := c.handshake(tconn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	tconn.Go(fatchoy.EndpointReadWriter)
+
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	c.conn = tconn
+	c.queue = queue
+	if err := c.flushPending(tconn); err != nil {
+		log.Errorf("TcpClient: %v flush %d pending packets: %v", c.addr, len(c.pending), err)
+	}
+	return nil
+}
+
+// 按顺序发送缓存的消息，发送失败的消息留在缓存里
+func (c *TcpClient) flushPending(conn *TcpConn) error {
+	for len(c.pending) > 0 {
+		if err := conn.SendPacket(c.pending[0]); err != nil {
+			return err
+		}
+		c.pending[0] = nil
+		c.pending = c.pending[1:]
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *TcpClient) SendPacket(pkt fatchoy.IPacket) error {
+	if !c.IsRunning() {
+		return ErrConnIsClosing
+	}
+	c.guard.Lock()
+	defer c.guard.Unlock()
+	// 先发送缓存的消息，保证顺序
+	if c.conn != nil && c.conn.IsRunning() && c.flushPending(c.conn) == nil {
+		if err := c.conn.SendPacket(pkt); err != ErrConnIsClosing {
+			return err
+		}
+	}
+	if len(c.pending) >= c.maxPending {
+		return ErrConnOutboundOverflow
+	}
+	c.pending = append(c.pending, pkt)
+	return nil
+}
+
+func (c *TcpClient) notifyErr(err error) {
+	select {
+	case c.errors <- err:
+	default:
+	}
+}
+
+func (c *TcpClient) serve() {
+	defer c.wg.Done()
+	for {
+		select {
+		case err := <-c.connErr:
+			c.guard.Lock()
+			var conn = c.conn
+			if ne, ok := err.(*Error); ok && ne.Endpoint != conn {
+				c.guard.Unlock()
+				continue // 之前连接的错误
+			}
+			var queue = c.queue
+			c.conn = nil
+			c.queue = nil
+			c.guard.Unlock()
+
+			c.requeue(queue)
+			log.Infof("TcpClient: connection to %s lost: %v", c.addr, err)
+			c.notifyErr(err)
+			if !c.reconnect() {
+				return
+			}
+
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// 取回断开的连接发送队列里没有发送的消息，放到缓存的最前面
+func (c *TcpClient) requeue(queue chan fatchoy.IPacket) {
+	var unsent []fatchoy.IPacket
+	for pkt := range queue { // 连接终止后队列会被关闭
+		unsent = append(unsent, pkt)
+	}
+	if len(unsent) == 0 {
+		return
+	}
+	c.guard.Lock()
+	c.pending = append(unsent, c.pending...)
+	c.guard.Unlock()
+}
+
+// 以指数退避的间隔重连，直到成功或者client关闭
+func (c *TcpClient) reconnect() bool {
+	var backoff = c.minBackoff
+	for {
+		var timer = time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return false
+		}
+		if err := c.dial(); err != nil {
+			log.Errorf("TcpClient: reconnect %s: %v", c.addr, err)
+		} else {
+			log.Infof("TcpClient: reconnected to %s", c.addr)
+			return true
+		}
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+func (c *TcpClient) Close() error {
+	if !c.state.CAS(fatchoy.StateRunning, fatchoy.StateShutdown) {
+		return nil
+	}
+	close(c.done)
+	c.wg.Wait()
+
+	c.guard.Lock()
+	var conn = c.conn
+	c.conn = nil
+	c.queue = nil
+	c.pending = nil
+	c.guard.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	c.state.Set(fatchoy.StateTerminated)
+	return nil
+}
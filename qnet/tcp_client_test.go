@@ -0,0 +1,147 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/packet"
+)
+
+// 启动一个echo服务，返回的函数用于关闭服务和所有连接
+func startTcpEcho(t *testing.T, addr string, enc codec.Encoder) func() {
+	var incoming = make(chan fatchoy.IPacket, 100)
+	var server = NewTcpServer(enc, incoming, 100)
+	if err := server.Listen(addr); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	var done = make(chan struct{})
+	var stopped = make(chan struct{})
+	go func() {
+		var endpoints []fatchoy.Endpoint
+		defer func() {
+			for _, endpoint := range endpoints {
+				endpoint.Close()
+			}
+			close(stopped)
+		}()
+		for {
+			select {
+			case endpoint := <-server.BacklogChan():
+				endpoint.Go(fatchoy.EndpointReadWriter)
+				endpoints = append(endpoints, endpoint)
+			case err := <-server.ErrorChan():
+				var ne = err.(*Error)
+				if ne.Endpoint.IsRunning() {
+					ne.Endpoint.Close()
+				}
+			case pkt := <-incoming:
+				pkt.ReplyWith(pkt.Command(), "pong")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		server.Close()
+	}
+}
+
+func expectPong(t *testing.T, inbound chan fatchoy.IPacket, count int) {
+	var timer = time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	for i := 0; i < count; i++ {
+		select {
+		case pkt := <-inbound:
+			if s := pkt.BodyToString(); s != "pong" {
+				t.Fatalf("unexpected response %v: %s", pkt, s)
+			}
+		case <-timer.C:
+			t.Fatalf("timeout waiting response #%d", i)
+		}
+	}
+}
+
+func TestTcpClientReconnect(t *testing.T) {
+	var addr = "localhost:10007"
+	var enc = codec.NewV2Encoder(0)
+	var stop = startTcpEcho(t, addr, enc)
+
+	var handshakes int32
+	var inbound = make(chan fatchoy.IPacket, 100)
+	var client = NewTcpClient(addr, enc, inbound, 100)
+	client.SetBackoff(10*time.Millisecond, 100*time.Millisecond)
+	client.SetHandshake(func(endpoint fatchoy.Endpoint) error {
+		atomic.AddInt32(&handshakes, 1)
+		return nil
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+
+	client.SendPacket(packet.New(1, 1, 0, "ping"))
+	expectPong(t, inbound, 1)
+
+	// 服务端断开后等待client检测到断线
+	stop()
+	for i := 0; i < 100 && client.IsConnected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.IsConnected() {
+		t.Fatalf("client should be disconnected")
+	}
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		if err := client.SendPacket(packet.New(int32(i), uint16(i), 0, "ping")); err != nil {
+			t.Fatalf("SendPacket: %v", err)
+		}
+	}
+	if n := client.PendingCount(); n != count {
+		t.Fatalf("pending count %d != %d", n, count)
+	}
+
+	stop = startTcpEcho(t, addr, enc)
+	defer stop()
+	expectPong(t, inbound, count)
+	if n := atomic.LoadInt32(&handshakes); n != 2 {
+		t.Fatalf("handshake count %d != 2", n)
+	}
+}
+
+// 断线时发送队列里没有写出的消息放回缓存，顺序在断线后缓存的消息之前
+func TestTcpClientRequeue(t *testing.T) {
+	var errChan = make(chan error, 4)
+	a, b := makeTcpConnPair(t, errChan, make(chan fatchoy.IPacket, 10))
+	defer b.Close()
+	a.keepUnsent = true
+	a.Go(fatchoy.EndpointReader) // 没有writer，消息都留在发送队列
+	var queue = a.outbound
+	for i := 1; i <= 3; i++ {
+		if err := a.SendPacket(packet.New(int32(i), 0, 0, "ping")); err != nil {
+			t.Fatalf("SendPacket: %v", err)
+		}
+	}
+
+	var client = NewTcpClient(a.RemoteAddr(), codec.NewV2Encoder(0), nil, 10)
+	client.pending = append(client.pending, packet.New(4, 0, 0, "ping"))
+	a.ForceClose(ErrConnForceClose)
+	client.requeue(queue)
+	if n := client.PendingCount(); n != 4 {
+		t.Fatalf("pending count %d != 4", n)
+	}
+	for i, pkt := range client.pending {
+		if pkt.Command() != int32(i+1) {
+			t.Fatalf("pending #%d: unexpected command %d", i, pkt.Command())
+		}
+	}
+}
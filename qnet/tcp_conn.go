@@ -14,11 +14,13 @@ import (
 	"qchen.fun/fatchoy/codec"
 	"qchen.fun/fatchoy/log"
 	"qchen.fun/fatchoy/packet"
+	"qchen.fun/fatchoy/x/bufpool"
 	"qchen.fun/fatchoy/x/stats"
 )
 
 var (
-	TConnReadTimeout = 200
+	TConnReadTimeout   = 200
+	TConnMaxBatchBytes = 64 * 1024 // 一次flush最多合并的字节数
 )
 
 // TCP connection
@@ -27,14 +29,19 @@ type TcpConn struct {
 	conn   net.Conn      // TCP connection object
 	reader io.Reader     // buffered read
 	writer *bufio.Writer // buffered write
+
+	maxBatch   int  // 一次flush最多合并的字节数
+	keepUnsent bool // 强制关闭时不再写出发送队列里的消息，留给调用方取回
+	aborted    bool // 是否被强制关闭
 }
 
 func NewTcpConn(node fatchoy.NodeID, conn net.Conn, enc codec.Encoder, errChan chan error,
 	incoming chan<- fatchoy.IPacket, outsize int, stats *stats.Stats) *TcpConn {
 	tconn := &TcpConn{
-		conn:   conn,
-		writer: bufio.NewWriter(conn),
-		reader: bufio.NewReader(conn),
+		conn:     conn,
+		writer:   bufio.NewWriter(conn),
+		reader:   bufio.NewReader(conn),
+		maxBatch: TConnMaxBatchBytes,
 	}
 	tconn.StreamConn.Init(node, enc, incoming, outsize, errChan, stats)
 	tconn.addr = conn.RemoteAddr().String()
@@ -49,6 +56,18 @@ func (t *TcpConn) OutboundQueue() chan fatchoy.IPacket {
 	return t.outbound
 }
 
+// 添加连接终止后的回调，连接已经终止时立即调用，可以在任意goroutine调用
+func (t *TcpConn) AddCloseHook(f func(fatchoy.Endpoint)) {
+	if !t.addCloseHook(f) {
+		f(t)
+	}
+}
+
+// 设置一次flush最多合并的字节数，在Go()之前调用，小于等于0表示每个消息都flush
+func (t *TcpConn) SetMaxBatchBytes(n int) {
+	t.maxBatch = n
+}
+
 func (t *TcpConn) Go(flag fatchoy.EndpointFlag) {
 	if !t.state.CAS(fatchoy.StateInit, fatchoy.StateRunning) {
 		panic("TcpConn: invalid state")
@@ -56,6 +75,7 @@ func (t *TcpConn) Go(flag fatchoy.EndpointFlag) {
 	if (flag & fatchoy.EndpointWriter) > 0 {
 		t.wg.Add(1)
 		go t.writePump()
+		t.startHeartbeat()
 	}
 	if (flag & fatchoy.EndpointReader) > 0 {
 		t.wg.Add(1)
@@ -67,8 +87,15 @@ func (t *TcpConn) SendPacket(pkt fatchoy.IPacket) error {
 	if !t.IsRunning() {
 		return ErrConnIsClosing
 	}
+	if t.sendLock != nil {
+		t.sendLock.Lock()
+		defer t.sendLock.Unlock()
+	}
 	select {
 	case t.outbound <- pkt:
+		if t.onSend != nil {
+			t.onSend(pkt)
+		}
 		return nil
 	default:
 		return ErrConnOutboundOverflow
@@ -80,9 +107,7 @@ func (t *TcpConn) Close() error {
 		// log.Errorf("TcpConn: connection %v is already closed", t.node)
 		return nil
 	}
-	if tconn, ok := t.conn.(*net.TCPConn); ok {
-		tconn.CloseRead()
-	}
+	t.closeRead()
 	close(t.done)
 	t.notifyErr(NewError(ErrConnForceClose, t))
 	t.finally() // 阻塞等待投递剩余的消息
@@ -94,14 +119,22 @@ func (t *TcpConn) ForceClose(err error) {
 		// log.Errorf("TcpConn: connection %v is already closed", t.node)
 		return
 	}
-	if tconn, ok := t.conn.(*net.TCPConn); ok {
-		tconn.CloseRead()
-	}
+	t.aborted = true
+	t.closeRead()
 	close(t.done)
 	t.notifyErr(NewError(err, t))
 	go t.finally() // 不阻塞等待
 }
 
+// 让reader立即返回
+func (t *TcpConn) closeRead() {
+	if tconn, ok := t.conn.(*net.TCPConn); ok {
+		tconn.CloseRead()
+	} else {
+		t.conn.SetReadDeadline(time.Now())
+	}
+}
+
 func (t *TcpConn) finally() {
 	t.wg.Wait()
 	if tconn, ok := t.conn.(*net.TCPConn); ok {
@@ -115,14 +148,15 @@ func (t *TcpConn) finally() {
 	t.inbound = nil
 	t.errChan = nil
 	t.conn = nil
+	t.runCloseHooks(t)
 }
 
 func (t *TcpConn) flush() {
-	for i := 0; i < len(t.outbound); i++ {
+	for {
 		select {
 		case pkt, ok := <-t.outbound:
 			if !ok {
-				break
+				return
 			}
 			if err := t.write(pkt); err != nil {
 				log.Errorf("%v marshal message %v: %v", t.node, pkt.Command(), err)
@@ -134,22 +168,45 @@ func (t *TcpConn) flush() {
 	}
 }
 
-func (t *TcpConn) write(pkt fatchoy.IPacket) error {
+func (t *TcpConn) encode(pkt fatchoy.IPacket) (int, error) {
 	nbytes, err := t.enc.WritePacket(t.writer, t.encrypt, pkt)
 	if err != nil {
-		return err
-	}
-	if err := t.writer.Flush(); err != nil {
-		return err
+		return 0, err
 	}
 	t.stats.Add(StatPacketsSent, 1)
 	t.stats.Add(StatBytesSent, int64(nbytes))
-	return nil
+	return nbytes, nil
+}
+
+// 把pkt和发送队列里已有的消息合并到一次flush
+func (t *TcpConn) write(pkt fatchoy.IPacket) error {
+	var size = 0
+	for {
+		nbytes, err := t.encode(pkt)
+		if err != nil {
+			log.Errorf("%v marshal message %v: %v", t.node, pkt.Command(), err)
+		}
+		size += nbytes
+		if size >= t.maxBatch {
+			break
+		}
+		var ok bool
+		select {
+		case pkt, ok = <-t.outbound:
+		default:
+		}
+		if !ok {
+			break
+		}
+	}
+	return t.writer.Flush()
 }
 
 func (t *TcpConn) writePump() {
 	defer func() {
-		t.flush()
+		if !t.keepUnsent || !t.aborted {
+			t.flush()
+		}
 		t.wg.Done()
 		log.Debugf("TcpConn: node %v writer stopped", t.node)
 	}()
@@ -172,22 +229,25 @@ func (t *TcpConn) writePump() {
 	}
 }
 
-func (t *TcpConn) readPacket() (fatchoy.IPacket, error) {
-	var deadline = time.Now().Add(time.Duration(TConnReadTimeout) * time.Second)
-	t.conn.SetReadDeadline(deadline)
+func (t *TcpConn) readPacket() (fatchoy.IPacket, int, error) {
+	t.conn.SetReadDeadline(t.readDeadline())
 	head, body, err := t.enc.ReadHeadBody(t.reader)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	var nbytes = len(head) + len(body)
 	var pkt = packet.Make()
 	if err := t.enc.UnmarshalPacket(head, body, t.decrypt, pkt); err != nil {
-		return nil, err
+		bufpool.Put(head)
+		pkt.Release()
+		return nil, 0, err
 	}
-	var nbytes = len(head) + len(body)
+	// body可能引用读取的缓冲区，由packet负责归还
+	pkt.SetBuffer(head)
 	t.stats.Add(StatPacketsRecv, 1)
 	t.stats.Add(StatBytesRecv, int64(nbytes))
 	pkt.SetEndpoint(t)
-	return pkt, nil
+	return pkt, nbytes, nil
 }
 
 func (t *TcpConn) readPump() {
@@ -198,15 +258,32 @@ func (t *TcpConn) readPump() {
 
 	log.Debugf("TcpConn: node %v(%v) reader started", t.node, t.addr)
 	for {
-		pkt, err := t.readPacket()
+		pkt, nbytes, err := t.readPacket()
 		if err != nil {
+			if t.testShouldExit() {
+				return // 主动关闭
+			}
 			if err != io.EOF {
 				log.Errorf("%v read packet %v", t.node, err)
 			}
-			t.ForceClose(err) // I/O超时或者发生错误，强制关闭连接
+			t.ForceClose(idleError(err)) // I/O超时或者发生错误，强制关闭连接
+			return
+		}
+		// 心跳也计入限速，避免ping洪水放大成pong
+		if !t.throttle(t, pkt, nbytes) {
+			pkt.Release()
+			if t.testShouldExit() {
+				return
+			}
+			continue
+		}
+		if t.handleHeartbeat(pkt) {
+			pkt.Release()
+			continue
+		}
+		if !t.deliver(t, pkt) {
 			return
 		}
-		t.inbound <- pkt // 如果channel满了，这里会阻塞
 
 		// test if we should exit
 		if t.testShouldExit() {
@@ -5,8 +5,11 @@
 package qnet
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"sync"
+	"time"
 
 	"qchen.fun/fatchoy"
 	"qchen.fun/fatchoy/codec"
@@ -14,25 +17,41 @@ import (
 	"qchen.fun/fatchoy/x/stats"
 )
 
+var (
+	TcpBacklogTimeout = 5 // backlog满时等待的时间，5s
+)
+
 type TcpServer struct {
-	done    chan struct{}
-	wg      sync.WaitGroup        // wait group
-	backlog chan fatchoy.Endpoint // queue of incoming connections
-	errors  chan error            // error queue
-	lns     []net.Listener        // listener list
-	enc     codec.Encoder         // message encode/decode
-	inbound chan fatchoy.IPacket  // incoming message buffer queue
-	outsize int                   // size of outbound message queue
+	done       chan struct{}
+	wg         sync.WaitGroup        // wait group
+	stopOnce   sync.Once             // 只停止accept一次
+	backlog    chan fatchoy.Endpoint // queue of incoming connections
+	errors     chan error            // error queue
+	lns        []net.Listener        // listener list
+	enc        codec.Encoder         // message encode/decode
+	inbound    chan fatchoy.IPacket  // incoming message buffer queue
+	outsize    int                   // size of outbound message queue
+	guard      sync.Mutex            // 保护conns、perIP和handshakes
+	conns      map[*TcpConn]net.Conn // 存活的连接
+	handshakes map[net.Conn]bool     // 正在TLS握手的连接
+	perIP      map[string]int        // 每个IP的连接数
+	maxConns   int                   // 最大连接数，0表示不限制
+	maxPerIP   int                   // 单个IP的最大连接数，0表示不限制
+	connClosed chan struct{}         // 有连接终止的通知
 }
 
 func NewTcpServer(enc codec.Encoder, inbound chan fatchoy.IPacket, outsize int) *TcpServer {
 	return &TcpServer{
-		enc:     enc,
-		inbound: inbound,
-		outsize: outsize,
-		done:    make(chan struct{}),
-		backlog: make(chan fatchoy.Endpoint, 128),
-		errors:  make(chan error, 16),
+		enc:        enc,
+		inbound:    inbound,
+		outsize:    outsize,
+		done:       make(chan struct{}),
+		backlog:    make(chan fatchoy.Endpoint, 128),
+		errors:     make(chan error, 16),
+		conns:      make(map[*TcpConn]net.Conn),
+		handshakes: make(map[net.Conn]bool),
+		perIP:      make(map[string]int),
+		connClosed: make(chan struct{}, 1),
 	}
 }
 
@@ -44,6 +63,23 @@ func (s *TcpServer) ErrorChan() chan error {
 	return s.errors
 }
 
+// 设置最大连接数，在Listen之前调用
+func (s *TcpServer) SetMaxConnections(n int) {
+	s.maxConns = n
+}
+
+// 设置单个IP的最大连接数，在Listen之前调用
+func (s *TcpServer) SetMaxConnPerIP(n int) {
+	s.maxPerIP = n
+}
+
+// 当前存活的连接数
+func (s *TcpServer) ConnCount() int {
+	s.guard.Lock()
+	defer s.guard.Unlock()
+	return len(s.conns)
+}
+
 func (s *TcpServer) Listen(addr string) error {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -55,6 +91,18 @@ func (s *TcpServer) Listen(addr string) error {
 	return nil
 }
 
+// 监听TLS连接，如果对端提供了证书，用证书CommonName里的节点ID作为endpoint的NodeID
+func (s *TcpServer) ListenTLS(addr string, config *tls.Config) error {
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	s.lns = append(s.lns, ln)
+	s.wg.Add(1)
+	go s.serve(ln)
+	return nil
+}
+
 func (s *TcpServer) testShouldExit() bool {
 	select {
 	case <-s.done:
@@ -69,34 +117,158 @@ func (s *TcpServer) serve(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Errorf("accept error: %v", err)
 			// check if we should exit
 			if s.testShouldExit() {
 				return
 			}
+			log.Errorf("accept error: %v", err)
 			return
 		}
 
 		// check if we should exit
 		if s.testShouldExit() {
+			conn.Close()
 			return
 		}
 
-		s.accept(conn)
+		if tconn, ok := conn.(*tls.Conn); ok {
+			s.wg.Add(1)
+			go s.acceptTLS(tconn) // 握手不阻塞accept
+			continue
+		}
+		s.accept(conn, 0)
 	}
 }
 
-func (s *TcpServer) accept(conn net.Conn) {
-	var endpoint = NewTcpConn(0, conn, s.enc, s.errors, s.inbound, s.outsize, stats.New(NumStat))
-	s.backlog <- endpoint // this may block current goroutine
+func (s *TcpServer) acceptTLS(conn *tls.Conn) {
+	defer s.wg.Done()
+	// 登记握手中的连接，停止accept时关闭以中断握手
+	s.guard.Lock()
+	if s.testShouldExit() {
+		s.guard.Unlock()
+		conn.Close()
+		return
+	}
+	s.handshakes[conn] = true
+	s.guard.Unlock()
+
+	node, err := tlsHandshake(conn)
+
+	s.guard.Lock()
+	delete(s.handshakes, conn)
+	s.guard.Unlock()
+	if err != nil && err != ErrNoPeerCertificate {
+		if !s.testShouldExit() {
+			log.Errorf("TcpServer: TLS handshake with %s: %v", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	s.accept(conn, node)
 }
 
-func (s *TcpServer) Close() {
-	for i, ln := range s.lns {
-		ln.Close()
-		s.lns[i] = nil
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
 	}
-	close(s.done)
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	return host
+}
+
+func (s *TcpServer) accept(conn net.Conn, node fatchoy.NodeID) {
+	var ip = remoteIP(conn)
+	s.guard.Lock()
+	if s.maxConns > 0 && len(s.conns) >= s.maxConns {
+		s.guard.Unlock()
+		log.Warnf("TcpServer: too many connections(%d), reject %s", s.maxConns, conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if s.maxPerIP > 0 && s.perIP[ip] >= s.maxPerIP {
+		s.guard.Unlock()
+		log.Warnf("TcpServer: too many connections(%d) from %s, reject", s.maxPerIP, ip)
+		conn.Close()
+		return
+	}
+	var endpoint = NewTcpConn(node, conn, s.enc, s.errors, s.inbound, s.outsize, stats.New(NumStat))
+	endpoint.inQueue = s.inbound
+	endpoint.onClose = append(endpoint.onClose, s.onConnClosed)
+	s.conns[endpoint] = conn
+	s.perIP[ip]++
+	s.guard.Unlock()
+
+	var timer = time.NewTimer(time.Duration(TcpBacklogTimeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case s.backlog <- endpoint: // this may block current goroutine
+	case <-timer.C:
+		log.Warnf("TcpServer: backlog is full, reject %s", conn.RemoteAddr())
+		s.discard(endpoint)
+	case <-s.done:
+		s.discard(endpoint)
+	}
+}
+
+// 关闭还没有开始读写的连接
+func (s *TcpServer) discard(endpoint *TcpConn) {
+	s.guard.Lock()
+	var conn, found = s.conns[endpoint]
+	s.guard.Unlock()
+	if found {
+		conn.Close()
+		s.onConnClosed(endpoint)
+	}
+}
+
+func (s *TcpServer) onConnClosed(endpoint fatchoy.Endpoint) {
+	var tconn = endpoint.(*TcpConn)
+	s.guard.Lock()
+	if conn, found := s.conns[tconn]; found {
+		delete(s.conns, tconn)
+		var ip = remoteIP(conn)
+		if s.perIP[ip]--; s.perIP[ip] <= 0 {
+			delete(s.perIP, ip)
+		}
+	}
+	s.guard.Unlock()
+	select {
+	case s.connClosed <- struct{}{}:
+	default:
+	}
+}
+
+// 停止accept新的连接，关闭还在TLS握手的连接，正在投递到backlog的连接也会立即放弃
+func (s *TcpServer) stopAccept() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		for _, ln := range s.lns {
+			ln.Close()
+		}
+		s.guard.Lock()
+		for conn := range s.handshakes {
+			conn.Close()
+		}
+		s.guard.Unlock()
+	})
+}
+
+// 等待accept的goroutine都退出
+func (s *TcpServer) waitAccept(ctx context.Context) error {
+	var done = make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *TcpServer) Close() {
+	s.stopAccept()
 	s.wg.Wait()
 	close(s.backlog)
 	close(s.errors)
@@ -106,6 +278,53 @@ func (s *TcpServer) Close() {
 	s.inbound = nil
 }
 
-func (s *TcpServer) Shutdown() {
+// 停止accept，并关闭所有连接，等待连接投递完发送队列里的消息。
+// 如果ctx在所有连接关闭之前到期，返回ctx.Err()，此时不会关闭backlog和error channel
+func (s *TcpServer) Shutdown(ctx context.Context) error {
+	s.stopAccept()
+	if err := s.waitAccept(ctx); err != nil {
+		return err
+	}
+
+	// backlog里还没有被取走的连接
+	for len(s.backlog) > 0 {
+		select {
+		case endpoint := <-s.backlog:
+			s.discard(endpoint.(*TcpConn))
+		default:
+		}
+	}
+
+	var deadline, hasDeadline = ctx.Deadline()
+	s.guard.Lock()
+	var conns = make(map[*TcpConn]net.Conn, len(s.conns))
+	for endpoint, conn := range s.conns {
+		conns[endpoint] = conn
+	}
+	s.guard.Unlock()
+	for endpoint, conn := range conns {
+		if hasDeadline {
+			conn.SetWriteDeadline(deadline)
+		}
+		if endpoint.IsRunning() {
+			go endpoint.Close()
+		} else if endpoint.state.Get() == fatchoy.StateInit {
+			s.discard(endpoint) // 取走后没有调用Go()
+		}
+	}
+
+	for s.ConnCount() > 0 {
+		select {
+		case <-s.connClosed:
+		case <-ctx.Done():
+			s.guard.Lock()
+			for _, conn := range s.conns {
+				conn.SetDeadline(time.Now()) // 中断阻塞的读写
+			}
+			s.guard.Unlock()
+			return ctx.Err()
+		}
+	}
 	s.Close()
+	return nil
 }
@@ -5,15 +5,18 @@
 package qnet
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"qchen.fun/fatchoy"
 	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/internal/testpb"
 	"qchen.fun/fatchoy/packet"
 )
 
@@ -132,3 +135,122 @@ func TestExampleServerUsage(t *testing.T) {
 	case <-ctx.Done():
 	}
 }
+
+func TestTcpServerConnPerIP(t *testing.T) {
+	var addr = "localhost:10008"
+	var server = NewTcpServer(codec.NewV1Encoder(0), make(chan fatchoy.IPacket, 10), 10)
+	server.SetMaxConnPerIP(1)
+	if err := server.Listen(addr); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer server.Close()
+
+	conn1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn1.Close()
+	var endpoint = <-server.BacklogChan()
+	endpoint.Go(fatchoy.EndpointReadWriter)
+
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn2.Close()
+	conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var buf [1]byte
+	if _, err := conn2.Read(buf[:]); err == nil {
+		t.Fatalf("second connection should be rejected")
+	}
+	if n := server.ConnCount(); n != 1 {
+		t.Fatalf("connection count %d != 1", n)
+	}
+	endpoint.Close()
+	if n := server.ConnCount(); n != 0 {
+		t.Fatalf("connection count %d != 0", n)
+	}
+}
+
+func TestTcpServerShutdown(t *testing.T) {
+	var addr = "localhost:10009"
+	var enc = codec.NewV1Encoder(0)
+	var server = NewTcpServer(enc, make(chan fatchoy.IPacket, 10), 100)
+	if err := server.Listen(addr); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	var endpoint = <-server.BacklogChan()
+	endpoint.Go(fatchoy.EndpointReadWriter)
+
+	const count = 50
+	for i := 1; i <= count; i++ {
+		if err := endpoint.SendPacket(packet.New(int32(i), uint16(i), 0, "hello")); err != nil {
+			t.Fatalf("SendPacket: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatalf("server should stop accepting")
+	}
+
+	// 关闭前发送队列里的消息都应该收到
+	for i := 1; i <= count; i++ {
+		var pkt = packet.Make()
+		if err := enc.ReadPacket(conn, nil, pkt); err != nil {
+			t.Fatalf("ReadPacket #%d: %v", i, err)
+		}
+		if pkt.Seq() != uint16(i) {
+			t.Fatalf("seq mismatch, %d != %d", pkt.Seq(), i)
+		}
+	}
+}
+
+// 用JSON文本协议调试服务
+func TestTcpServerJSON(t *testing.T) {
+	registerTestMessages()
+	var addr = "localhost:10013"
+	var incoming = make(chan fatchoy.IPacket, 10)
+	var server = NewTcpServer(codec.GetEncoder("JSON"), incoming, 10)
+	if err := server.Listen(addr); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	var endpoint = <-server.BacklogChan()
+	endpoint.Go(fatchoy.EndpointReadWriter)
+	defer endpoint.Close()
+
+	if _, err := conn.Write([]byte("{\"cmd\":1001,\"seq\":1,\"body\":{\"text\":\"hello\"}}\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var pkt = <-incoming
+	var req testpb.EchoReq
+	if err := pkt.DecodeTo(&req); err != nil || req.Text != "hello" {
+		t.Fatalf("unexpected request %v: %v", pkt, err)
+	}
+	if err := pkt.Reply(&testpb.EchoAck{Text: req.Text}); err != nil {
+		t.Fatalf("Reply: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("ReadString: %v", err)
+	}
+	if s := strings.ReplaceAll(line, " ", ""); s != "{\"cmd\":1002,\"seq\":1,\"body\":{\"text\":\"hello\"}}\n" {
+		t.Fatalf("unexpected response %s", line)
+	}
+}
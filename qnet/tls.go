@@ -0,0 +1,61 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"qchen.fun/fatchoy"
+)
+
+var (
+	TLSHandshakeTimeout = 10 // TLS握手超时，10s
+
+	ErrNoPeerCertificate = errors.New("no peer certificate")
+)
+
+// 从证书的CommonName解析节点ID，格式同NodeID.String()，即16进制
+func NodeIDFromCert(cert *x509.Certificate) (fatchoy.NodeID, error) {
+	n, err := strconv.ParseUint(cert.Subject.CommonName, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("certificate common name %q is not a node id", cert.Subject.CommonName)
+	}
+	return fatchoy.NodeID(n), nil
+}
+
+// 在deadline内完成TLS握手，如果对端证书的CommonName是节点ID，返回这个节点ID，否则返回0
+func tlsHandshake(conn *tls.Conn) (fatchoy.NodeID, error) {
+	var deadline = time.Now().Add(time.Duration(TLSHandshakeTimeout) * time.Second)
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return 0, err
+	}
+	var certs = conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return 0, ErrNoPeerCertificate
+	}
+	node, err := NodeIDFromCert(certs[0])
+	if err != nil {
+		return 0, nil // CommonName不是节点ID
+	}
+	return node, nil
+}
+
+// 建立TLS连接并完成握手
+func dialTLS(addr string, timeout time.Duration, config *tls.Config) (*tls.Conn, error) {
+	var dialer = &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
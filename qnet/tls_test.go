@@ -0,0 +1,217 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/packet"
+)
+
+// 用ca签发一个证书，ca为nil时生成自签名的CA
+func makeTestCert(t *testing.T, cn string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	var tmpl = &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	var parent = tmpl
+	var signer interface{} = key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		parent = ca.Leaf
+		signer = ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTcpServerMutualTLS(t *testing.T) {
+	var ca = makeTestCert(t, "test CA", nil)
+	var pool = x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	var serverNode = fatchoy.MakeNodeID(0x02, 0x0001)
+	var clientNode = fatchoy.MakeNodeID(0x01, 0x0002)
+	var serverCert = makeTestCert(t, serverNode.String(), &ca)
+	var clientCert = makeTestCert(t, clientNode.String(), &ca)
+
+	var addr = "localhost:10011"
+	var enc = codec.NewV2Encoder(0)
+	var incoming = make(chan fatchoy.IPacket, 10)
+	var server = NewTcpServer(enc, incoming, 10)
+	var serverConfig = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	if err := server.ListenTLS(addr, serverConfig); err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	defer server.Close()
+
+	var inbound = make(chan fatchoy.IPacket, 10)
+	var client = NewTcpClient(addr, enc, inbound, 10)
+	client.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+	if node := client.Conn().NodeID(); node != serverNode {
+		t.Fatalf("server node %v != %v", node, serverNode)
+	}
+
+	var endpoint = <-server.BacklogChan()
+	if node := endpoint.NodeID(); node != clientNode {
+		t.Fatalf("client node %v != %v", node, clientNode)
+	}
+	endpoint.Go(fatchoy.EndpointReadWriter)
+	defer endpoint.Close()
+
+	client.SendPacket(packet.New(1, 1, 0, "ping"))
+	var pkt = <-incoming
+	pkt.ReplyWith(1, "pong")
+	expectPong(t, inbound, 1)
+}
+
+func TestTcpServerTLSRejectUnknownClient(t *testing.T) {
+	var ca = makeTestCert(t, "test CA", nil)
+	var pool = x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	var serverCert = makeTestCert(t, "020001", &ca)
+
+	var addr = "localhost:10012"
+	var server = NewTcpServer(codec.NewV2Encoder(0), make(chan fatchoy.IPacket, 10), 10)
+	if err := server.ListenTLS(addr, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}); err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	defer server.Close()
+
+	var client = NewTcpClient(addr, codec.NewV2Encoder(0), make(chan fatchoy.IPacket, 10), 10)
+	client.SetTLSConfig(&tls.Config{RootCAs: pool, ServerName: "localhost"})
+	client.SetBackoff(time.Hour, time.Hour)
+	// TLS1.3下客户端在首次读取时才会知道证书被拒绝
+	if err := client.Connect(); err == nil {
+		defer client.Close()
+		select {
+		case <-client.ErrorChan():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("client without certificate should be rejected")
+		}
+	}
+	select {
+	case <-server.BacklogChan():
+		t.Fatalf("client without certificate should not be accepted")
+	default:
+	}
+}
+
+// CommonName不是节点ID的证书也可以握手，连接没有节点ID
+func TestTcpServerTLSCommonName(t *testing.T) {
+	var ca = makeTestCert(t, "test CA", nil)
+	var pool = x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	var serverCert = makeTestCert(t, "game server", &ca)
+	var clientCert = makeTestCert(t, "player", &ca)
+
+	var addr = "localhost:10016"
+	var enc = codec.NewV2Encoder(0)
+	var server = NewTcpServer(enc, make(chan fatchoy.IPacket, 10), 10)
+	if err := server.ListenTLS(addr, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}); err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	defer server.Close()
+
+	var client = NewTcpClient(addr, enc, make(chan fatchoy.IPacket, 10), 10)
+	client.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Close()
+	if node := client.Conn().NodeID(); node != 0 {
+		t.Fatalf("unexpected server node %v", node)
+	}
+
+	select {
+	case endpoint := <-server.BacklogChan():
+		if node := endpoint.NodeID(); node != 0 {
+			t.Fatalf("unexpected client node %v", node)
+		}
+		endpoint.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client not accepted")
+	}
+}
+
+// 没有完成握手的连接不应该阻塞Shutdown
+func TestTcpServerTLSShutdown(t *testing.T) {
+	var ca = makeTestCert(t, "test CA", nil)
+	var serverCert = makeTestCert(t, "020001", &ca)
+	var addr = "localhost:10017"
+	var server = NewTcpServer(codec.NewV2Encoder(0), make(chan fatchoy.IPacket, 10), 10)
+	if err := server.ListenTLS(addr, &tls.Config{Certificates: []tls.Certificate{serverCert}}); err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	conn, err := net.Dial("tcp", addr) // 不发送ClientHello
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var start = time.Now()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Shutdown blocked by TLS handshake for %v", d)
+	}
+}
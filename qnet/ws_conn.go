@@ -0,0 +1,239 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/log"
+	"qchen.fun/fatchoy/packet"
+	"qchen.fun/fatchoy/x/bufpool"
+	"qchen.fun/fatchoy/x/stats"
+)
+
+var (
+	WsConnWriteTimeout = 10 // 关闭时发送close帧的超时，10s
+)
+
+// WebSocket connection，每个packet编码为一个binary message
+type WsConn struct {
+	StreamConn
+	conn *websocket.Conn // websocket connection object
+}
+
+func NewWsConn(node fatchoy.NodeID, conn *websocket.Conn, enc codec.Encoder, errChan chan error,
+	incoming chan<- fatchoy.IPacket, outsize int, stats *stats.Stats) *WsConn {
+	wconn := &WsConn{
+		conn: conn,
+	}
+	wconn.StreamConn.Init(node, enc, incoming, outsize, errChan, stats)
+	wconn.addr = conn.RemoteAddr().String()
+	return wconn
+}
+
+func (t *WsConn) RawConn() net.Conn {
+	return t.conn.UnderlyingConn()
+}
+
+func (t *WsConn) OutboundQueue() chan fatchoy.IPacket {
+	return t.outbound
+}
+
+func (t *WsConn) Go(flag fatchoy.EndpointFlag) {
+	if !t.state.CAS(fatchoy.StateInit, fatchoy.StateRunning) {
+		panic("WsConn: invalid state")
+	}
+	if (flag & fatchoy.EndpointWriter) > 0 {
+		t.wg.Add(1)
+		go t.writePump()
+		t.startHeartbeat()
+	}
+	if (flag & fatchoy.EndpointReader) > 0 {
+		t.wg.Add(1)
+		go t.readPump()
+	}
+}
+
+func (t *WsConn) SendPacket(pkt fatchoy.IPacket) error {
+	if !t.IsRunning() {
+		return ErrConnIsClosing
+	}
+	select {
+	case t.outbound <- pkt:
+		return nil
+	default:
+		return ErrConnOutboundOverflow
+	}
+}
+
+func (t *WsConn) Close() error {
+	if !t.state.CAS(fatchoy.StateRunning, fatchoy.StateShutdown) {
+		return nil
+	}
+	t.conn.SetReadDeadline(time.Now()) // websocket不能半关闭，让reader立即返回
+	close(t.done)
+	t.notifyErr(NewError(ErrConnForceClose, t))
+	t.finally() // 阻塞等待投递剩余的消息
+	return nil
+}
+
+func (t *WsConn) ForceClose(err error) {
+	if !t.state.CAS(fatchoy.StateRunning, fatchoy.StateShutdown) {
+		return
+	}
+	t.conn.SetReadDeadline(time.Now())
+	close(t.done)
+	t.notifyErr(NewError(err, t))
+	go t.finally() // 不阻塞等待
+}
+
+func (t *WsConn) finally() {
+	t.wg.Wait()
+	var deadline = time.Now().Add(time.Duration(WsConnWriteTimeout) * time.Second)
+	var msg = websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	t.conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	t.conn.Close()
+	t.state.Set(fatchoy.StateTerminated)
+	close(t.outbound)
+	t.outbound = nil
+	t.inbound = nil
+	t.errChan = nil
+}
+
+func (t *WsConn) flush() {
+	for {
+		select {
+		case pkt, ok := <-t.outbound:
+			if !ok {
+				return
+			}
+			if err := t.write(pkt); err != nil {
+				log.Errorf("%v marshal message %v: %v", t.node, pkt.Command(), err)
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+// 一个packet对应一个binary message
+func (t *WsConn) write(pkt fatchoy.IPacket) error {
+	w, err := t.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	nbytes, err := t.enc.WritePacket(w, t.encrypt, pkt)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	t.stats.Add(StatPacketsSent, 1)
+	t.stats.Add(StatBytesSent, int64(nbytes))
+	return nil
+}
+
+func (t *WsConn) writePump() {
+	defer func() {
+		t.flush()
+		t.wg.Done()
+		log.Debugf("WsConn: node %v writer stopped", t.node)
+	}()
+
+	log.Debugf("WsConn: node %v(%v) writer started", t.node, t.addr)
+
+	for {
+		select {
+		case pkt, ok := <-t.outbound:
+			if !ok {
+				return
+			}
+			if err := t.write(pkt); err != nil {
+				log.Errorf("%v write message %v: %v", t.node, pkt.Command(), err)
+			}
+
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *WsConn) readPacket() (fatchoy.IPacket, int, error) {
+	t.conn.SetReadDeadline(t.readDeadline())
+	msgType, r, err := t.conn.NextReader()
+	if err != nil {
+		return nil, 0, err
+	}
+	if msgType != websocket.BinaryMessage {
+		return nil, 0, ErrWsUnexpectedMessage
+	}
+	head, body, err := t.enc.ReadHeadBody(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	var nbytes = len(head) + len(body)
+	var pkt = packet.Make()
+	if err := t.enc.UnmarshalPacket(head, body, t.decrypt, pkt); err != nil {
+		bufpool.Put(head)
+		pkt.Release()
+		return nil, 0, err
+	}
+	// body可能引用读取的缓冲区，由packet负责归还
+	pkt.SetBuffer(head)
+	t.stats.Add(StatPacketsRecv, 1)
+	t.stats.Add(StatBytesRecv, int64(nbytes))
+	pkt.SetEndpoint(t)
+	return pkt, nbytes, nil
+}
+
+func (t *WsConn) readPump() {
+	defer func() {
+		t.wg.Done()
+		log.Debugf("WsConn: node %v reader stopped", t.node)
+	}()
+
+	log.Debugf("WsConn: node %v(%v) reader started", t.node, t.addr)
+	for {
+		pkt, nbytes, err := t.readPacket()
+		if err != nil {
+			if t.testShouldExit() {
+				return // 主动关闭导致的读超时
+			}
+			if err != io.EOF && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Errorf("%v read packet %v", t.node, err)
+			}
+			t.ForceClose(idleError(err)) // I/O超时或者发生错误，强制关闭连接
+			return
+		}
+		// 心跳也计入限速，避免ping洪水放大成pong
+		if !t.throttle(t, pkt, nbytes) {
+			pkt.Release()
+			if t.testShouldExit() {
+				return
+			}
+			continue
+		}
+		if t.handleHeartbeat(pkt) {
+			pkt.Release()
+			continue
+		}
+		if !t.deliver(t, pkt) {
+			return
+		}
+
+		// test if we should exit
+		if t.testShouldExit() {
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/packet"
+)
+
+func serveWsEcho(server *WsServer, incoming chan fatchoy.IPacket, done, stopped chan struct{}) {
+	var endpoints []fatchoy.Endpoint
+	defer func() {
+		for _, endpoint := range endpoints {
+			endpoint.Close()
+		}
+		close(stopped)
+	}()
+	for {
+		select {
+		case endpoint := <-server.BacklogChan():
+			endpoint.Go(fatchoy.EndpointReadWriter)
+			endpoints = append(endpoints, endpoint)
+
+		case err := <-server.ErrorChan():
+			var ne = err.(*Error)
+			if ne.Endpoint.IsRunning() {
+				ne.Endpoint.Close()
+			}
+
+		case pkt := <-incoming:
+			pkt.ReplyWith(pkt.Command(), "pong")
+
+		case <-done:
+			return
+		}
+	}
+}
+
+func TestExampleWsConn(t *testing.T) {
+	var addr = "localhost:10005"
+	var enc = codec.NewV2Encoder(0)
+	var incoming = make(chan fatchoy.IPacket, 100)
+	var server = NewWsServer(enc, incoming, 100)
+	if err := server.Listen(addr, "/ws"); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	var done = make(chan struct{})
+	var stopped = make(chan struct{})
+	go serveWsEcho(server, incoming, done, stopped)
+	defer func() {
+		close(done)
+		<-stopped
+		server.Close()
+	}()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	var inbound = make(chan fatchoy.IPacket, 100)
+	var errchan = make(chan error, 4)
+	wconn := NewWsConn(0, conn, enc, errchan, inbound, 100, nil)
+	wconn.Go(fatchoy.EndpointReadWriter)
+	defer wconn.Close()
+
+	const count = 100
+	for i := 1; i <= count; i++ {
+		if err := wconn.SendPacket(packet.New(int32(i), uint16(i), 0, "ping")); err != nil {
+			t.Fatalf("SendPacket: %v", err)
+		}
+	}
+	var timer = time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+	for i := 1; i <= count; i++ {
+		select {
+		case pkt := <-inbound:
+			if pkt.Seq() != uint16(i) || pkt.BodyToString() != "pong" {
+				t.Fatalf("unexpected response %v: %s", pkt, pkt.BodyToString())
+			}
+		case err := <-errchan:
+			t.Fatalf("connection error: %v", err)
+		case <-timer.C:
+			t.Fatalf("timeout waiting response #%d", i)
+		}
+	}
+	if n := wconn.Stats().Get(StatPacketsRecv); n != count {
+		t.Fatalf("recv packets %d != %d", n, count)
+	}
+}
+
+func TestWsServerListenPaths(t *testing.T) {
+	var server = NewWsServer(codec.NewV2Encoder(0), make(chan fatchoy.IPacket, 10), 10)
+	defer server.Close()
+	if err := server.Listen("localhost:10014", "/ws"); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	if err := server.Listen("localhost:10015", "/ws2"); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	for _, url := range []string{"ws://localhost:10014/ws", "ws://localhost:10015/ws2", "ws://localhost:10014/ws2"} {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("Dial %s: %v", url, err)
+		}
+		var endpoint = <-server.BacklogChan()
+		endpoint.ForceClose(nil)
+		conn.Close()
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package qnet
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"qchen.fun/fatchoy"
+	"qchen.fun/fatchoy/codec"
+	"qchen.fun/fatchoy/log"
+	"qchen.fun/fatchoy/x/stats"
+)
+
+type WsServer struct {
+	done     chan struct{}
+	wg       sync.WaitGroup        // wait group
+	guard    sync.RWMutex          // 保护backlog的关闭
+	backlog  chan fatchoy.Endpoint // queue of incoming connections
+	errors   chan error            // error queue
+	lns      []net.Listener        // listener list
+	server   *http.Server          // http server
+	mux      *http.ServeMux        // 所有Listen注册的路径
+	paths    map[string]bool       // 已注册的路径
+	upgrader websocket.Upgrader    // websocket upgrader
+	enc      codec.Encoder         // message encode/decode
+	inbound  chan fatchoy.IPacket  // incoming message buffer queue
+	outsize  int                   // size of outbound message queue
+}
+
+func NewWsServer(enc codec.Encoder, inbound chan fatchoy.IPacket, outsize int) *WsServer {
+	return &WsServer{
+		enc:     enc,
+		inbound: inbound,
+		outsize: outsize,
+		done:    make(chan struct{}),
+		backlog: make(chan fatchoy.Endpoint, 128),
+		errors:  make(chan error, 16),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+		},
+	}
+}
+
+func (s *WsServer) BacklogChan() chan fatchoy.Endpoint {
+	return s.backlog
+}
+
+func (s *WsServer) ErrorChan() chan error {
+	return s.errors
+}
+
+// 设置跨域检查，默认只允许同源
+func (s *WsServer) SetCheckOrigin(f func(r *http.Request) bool) {
+	s.upgrader.CheckOrigin = f
+}
+
+// 在`addr`上监听，`path`为websocket的URL路径，多次Listen的路径在所有地址上都可用
+func (s *WsServer) Listen(addr, path string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if s.server == nil {
+		s.mux = http.NewServeMux()
+		s.paths = make(map[string]bool)
+		s.server = &http.Server{Handler: s.mux}
+	}
+	if !s.paths[path] {
+		s.mux.Handle(path, s)
+		s.paths[path] = true
+	}
+	s.lns = append(s.lns, ln)
+	s.wg.Add(1)
+	go s.serve(ln)
+	return nil
+}
+
+func (s *WsServer) testShouldExit() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *WsServer) serve(ln net.Listener) {
+	defer s.wg.Done()
+	if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Errorf("serve error: %v", err)
+	}
+}
+
+// 实现http.Handler，也可以挂载到已有的http服务上
+func (s *WsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.guard.RLock()
+	defer s.guard.RUnlock()
+	if s.testShouldExit() {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("upgrade %s: %v", r.RemoteAddr, err)
+		return
+	}
+	s.accept(conn)
+}
+
+func (s *WsServer) accept(conn *websocket.Conn) {
+	var endpoint = NewWsConn(0, conn, s.enc, s.errors, s.inbound, s.outsize, stats.New(NumStat))
+	endpoint.inQueue = s.inbound
+	select {
+	case s.backlog <- endpoint: // this may block current goroutine
+	case <-s.done:
+		conn.Close()
+	}
+}
+
+func (s *WsServer) Close() {
+	close(s.done)
+	if s.server != nil {
+		s.server.Close() // 已升级的websocket连接不受影响
+	}
+	s.wg.Wait()
+	s.guard.Lock()
+	close(s.backlog)
+	close(s.errors)
+	s.backlog = nil
+	s.errors = nil
+	s.lns = nil
+	s.inbound = nil
+	s.guard.Unlock()
+}
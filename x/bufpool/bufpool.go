@@ -0,0 +1,65 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package bufpool
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// 按2的幂分级的字节缓冲池，64B到4M，超出范围的直接分配，不放回池
+const (
+	minShift = 6
+	maxShift = 22
+
+	MinSize = 1 << minShift
+	MaxSize = 1 << maxShift
+)
+
+var (
+	pools [maxShift - minShift + 1]sync.Pool
+
+	// sync.Pool里存放*[]byte，复用指针本身避免Put时分配
+	headers = sync.Pool{New: func() interface{} { return new([]byte) }}
+)
+
+// 所属的级别，超出范围返回-1
+func classOf(n int) int {
+	if n <= MinSize {
+		return 0
+	}
+	if n > MaxSize {
+		return -1
+	}
+	return bits.Len(uint(n-1)) - minShift
+}
+
+// 获取长度为n的缓冲区，容量是不小于n的2的幂，内容不会清零
+func Get(n int) []byte {
+	var idx = classOf(n)
+	if idx < 0 {
+		return make([]byte, n)
+	}
+	if v := pools[idx].Get(); v != nil {
+		var p = v.(*[]byte)
+		var buf = (*p)[:n]
+		*p = nil
+		headers.Put(p)
+		return buf
+	}
+	return make([]byte, n, 1<<(idx+minShift))
+}
+
+// 放回缓冲池，`buf`必须是Get返回的切片（或者从0开始的子切片），Put之后不能再使用
+func Put(buf []byte) {
+	var size = cap(buf)
+	var idx = classOf(size)
+	if idx < 0 || size != 1<<(idx+minShift) {
+		return
+	}
+	var p = headers.Get().(*[]byte)
+	*p = buf[:0]
+	pools[idx].Put(p)
+}
@@ -0,0 +1,41 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package bufpool
+
+import (
+	"testing"
+)
+
+func TestGetPut(t *testing.T) {
+	tests := []struct {
+		size int
+		cap  int
+	}{
+		{0, MinSize},
+		{1, MinSize},
+		{64, 64},
+		{65, 128},
+		{1000, 1024},
+		{4096, 4096},
+		{MaxSize, MaxSize},
+		{MaxSize + 1, MaxSize + 1},
+	}
+	for _, tc := range tests {
+		var buf = Get(tc.size)
+		if len(buf) != tc.size || cap(buf) != tc.cap {
+			t.Fatalf("Get(%d): len %d cap %d, expect cap %d", tc.size, len(buf), cap(buf), tc.cap)
+		}
+		Put(buf)
+		Put(buf[:1:1]) // 容量不是2的幂，忽略
+	}
+}
+
+func BenchmarkGetPut(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var buf = Get(512)
+		Put(buf)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package cipher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/tjfoc/gmsm/sm4"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	AEADCounterSize = 8 // 密文前面的计数器大小
+	aeadSaltSize    = 4 // nonce里固定部分的大小
+)
+
+var (
+	ErrAuthFailed = errors.New("message authentication failed")
+	ErrReplayed   = errors.New("message replayed or out of order")
+)
+
+// 带认证的加密，每个消息的nonce由iv的前4字节和递增的8字节计数器组成，
+// 计数器以明文放在密文前面，解密时计数器必须严格递增，否则视为重放。
+// 两个方向必须使用不同的key
+type AEADCryptor interface {
+	BlockCryptor
+
+	// 加密并认证，`additional`是一起认证但不加密的附加数据，如消息头部
+	Seal(src, additional []byte) []byte
+
+	// 解密并认证，`additional`必须和Seal时一致，失败返回ErrAuthFailed或者ErrReplayed
+	Open(src, additional []byte) ([]byte, error)
+
+	// 密文比明文多出的长度
+	Overhead() int
+}
+
+type aeadCrypt struct {
+	aead     cipher.AEAD
+	key, iv  []byte
+	sent     uint64 // 最后发送的计数器
+	received uint64 // 最后收到的计数器
+}
+
+func newAEADCrypt(aead cipher.AEAD, key, iv []byte) *aeadCrypt {
+	if len(iv) < aeadSaltSize {
+		log.Panicf("iv size %d too small", len(iv))
+	}
+	return &aeadCrypt{
+		aead: aead,
+		key:  key,
+		iv:   iv,
+	}
+}
+
+// key must be 16, 24 or 32 bytes
+func NewAESGCM(key, iv []byte) AEADCryptor {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	return newAEADCrypt(aead, key, iv)
+}
+
+// key must be 16 bytes
+func NewSM4GCM(key, iv []byte) AEADCryptor {
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	return newAEADCrypt(aead, key, iv)
+}
+
+// key must be 32 bytes
+func NewChaCha20Poly1305(key, iv []byte) AEADCryptor {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		log.Panicf("%v", err)
+	}
+	return newAEADCrypt(aead, key, iv)
+}
+
+func (c *aeadCrypt) Key() []byte {
+	return c.key
+}
+
+func (c *aeadCrypt) IV() []byte {
+	return c.iv
+}
+
+func (c *aeadCrypt) nonce(counter uint64) []byte {
+	var nonce = make([]byte, c.aead.NonceSize())
+	copy(nonce, c.iv[:aeadSaltSize])
+	binary.BigEndian.PutUint64(nonce[len(nonce)-AEADCounterSize:], counter)
+	return nonce
+}
+
+func (c *aeadCrypt) Overhead() int {
+	return AEADCounterSize + c.aead.Overhead()
+}
+
+// 没有附加数据的Seal
+func (c *aeadCrypt) Encrypt(src []byte) []byte {
+	return c.Seal(src, nil)
+}
+
+// 没有附加数据的Open，认证失败时返回nil
+func (c *aeadCrypt) Decrypt(src []byte) []byte {
+	data, _ := c.Open(src, nil)
+	return data
+}
+
+// 返回 counter | ciphertext | tag
+func (c *aeadCrypt) Seal(src, additional []byte) []byte {
+	c.sent++
+	var dst = make([]byte, AEADCounterSize, len(src)+c.Overhead())
+	binary.BigEndian.PutUint64(dst, c.sent)
+	return c.aead.Seal(dst, c.nonce(c.sent), src, additional)
+}
+
+func (c *aeadCrypt) Open(src, additional []byte) ([]byte, error) {
+	if len(src) < AEADCounterSize+c.aead.Overhead() {
+		return nil, ErrAuthFailed
+	}
+	var counter = binary.BigEndian.Uint64(src)
+	if counter <= c.received {
+		return nil, ErrReplayed
+	}
+	var ciphertext = src[AEADCounterSize:]
+	data, err := c.aead.Open(ciphertext[:0], c.nonce(counter), ciphertext, additional)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	c.received = counter
+	return data, nil
+}
@@ -0,0 +1,84 @@
+// Copyright © 2021-present simon@qchen.fun All rights reserved.
+// Distributed under the terms and conditions of the BSD License.
+// See accompanying files LICENSE.
+
+package cipher
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestAEADCrypt(t *testing.T) {
+	for _, name := range []string{"aes-gcm", "sm4-gcm", "chacha20-poly1305"} {
+		key := randBytes(32)
+		iv := randBytes(16)
+		encryptor := NewCrypt(name, key, iv).(AEADCryptor)
+		decryptor := NewCrypt(name, key, iv).(AEADCryptor)
+		for i := 0; i < 100; i++ {
+			payload := randBytes(1 + rand.Int()%1000)
+			encrypted := encryptor.Encrypt(cloneBytes(payload))
+			decrypted, err := decryptor.Open(encrypted, nil)
+			if err != nil {
+				t.Fatalf("%s: Open: %v", name, err)
+			}
+			if !bytes.Equal(payload, decrypted) {
+				t.Fatalf("%s: encryption mismatch", name)
+			}
+		}
+	}
+}
+
+func TestAEADTamperAndReplay(t *testing.T) {
+	key := randBytes(32)
+	iv := randBytes(12)
+	encryptor := NewAESGCM(key, iv)
+	decryptor := NewAESGCM(key, iv)
+
+	first := encryptor.Encrypt([]byte("hello"))
+	second := encryptor.Encrypt([]byte("world"))
+
+	tampered := cloneBytes(first)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := decryptor.Open(tampered, nil); err != ErrAuthFailed {
+		t.Fatalf("tampered message: %v", err)
+	}
+	if _, err := decryptor.Open(cloneBytes(second), nil); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := decryptor.Open(first, nil); err != ErrReplayed {
+		t.Fatalf("out of order message: %v", err)
+	}
+	if _, err := decryptor.Open(second, nil); err != ErrReplayed {
+		t.Fatalf("replayed message: %v", err)
+	}
+	if data := decryptor.Decrypt([]byte("short")); data != nil {
+		t.Fatalf("Decrypt should return nil")
+	}
+}
+
+func TestAEADAdditionalData(t *testing.T) {
+	key := randBytes(32)
+	iv := randBytes(12)
+	encryptor := NewChaCha20Poly1305(key, iv)
+	decryptor := NewChaCha20Poly1305(key, iv)
+
+	sealed := encryptor.Seal([]byte("hello"), []byte("header"))
+	if len(sealed) != len("hello")+encryptor.Overhead() {
+		t.Fatalf("sealed size %d", len(sealed))
+	}
+	if _, err := decryptor.Open(cloneBytes(sealed), []byte("Header")); err != ErrAuthFailed {
+		t.Fatalf("tampered additional data: %v", err)
+	}
+	data, err := decryptor.Open(sealed, []byte("header"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Open: %q, %v", data, err)
+	}
+	if sealed = encryptor.Seal(nil, []byte("header")); len(sealed) != encryptor.Overhead() {
+		t.Fatalf("sealed empty size %d", len(sealed))
+	}
+	if data, err = decryptor.Open(sealed, []byte("header")); err != nil || len(data) != 0 {
+		t.Fatalf("Open empty: %q, %v", data, err)
+	}
+}
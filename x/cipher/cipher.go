@@ -29,6 +29,12 @@ func NewCrypt(name string, key, iv []byte) BlockCryptor {
 		return NewXTEA(key[:16], iv)
 	case "salsa20":
 		return NewSalsa20(key[:32], iv)
+	case "aes-gcm":
+		return NewAESGCM(key[:32], iv)
+	case "sm4-gcm":
+		return NewSM4GCM(key[:16], iv)
+	case "chacha20-poly1305":
+		return NewChaCha20Poly1305(key[:32], iv)
 	case "none":
 		return NewNoneCrypt(key, iv)
 	default: